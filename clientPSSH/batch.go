@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"clientPSSH/pssh"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes of the batch mode.
+const (
+	exitOK         = 0
+	exitCmdFailed  = 1 // a command was answered with a failure
+	exitUsage      = 2 // bad flags or an unreadable script
+	exitConnection = 3 // the server is unreachable, closed the connection or timed out
+)
+
+type batchCommand struct {
+	line   string
+	source string // e.g. "script.pssh:3", for messages
+}
+
+// parseScript takes one command per line. Blank lines and lines starting
+// with '#' are skipped.
+func parseScript(r io.Reader, name string) ([]batchCommand, error) {
+	var commands []batchCommand
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, batchCommand{line, fmt.Sprintf("%s:%d", name, n)})
+	}
+
+	return commands, scanner.Err()
+}
+
+// parseCommandLine splits "cmd; cmd" given with -c.
+func parseCommandLine(text string) []batchCommand {
+	var commands []batchCommand
+	for i, line := range strings.Split(text, ";") {
+		if line = strings.TrimSpace(line); line != "" {
+			commands = append(commands, batchCommand{line, fmt.Sprintf("-c #%d", i+1)})
+		}
+	}
+
+	return commands
+}
+
+// batchRunner runs a list of commands and stops on the first failed one,
+// unless keepGoing is set.
+type batchRunner struct {
+	commands  []batchCommand
+	keepGoing bool
+	timeout   time.Duration
+	key       crypto.Signer
+	tlsConfig *tls.Config
+	user      string // logged in before the commands, with key or pswd
+	pswd      string
+	out       io.Writer
+}
+
+// run returns the exit code.
+func (b *batchRunner) run(addr string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	client, err := pssh.Dial(ctx, addr, &pssh.Config{TLSConfig: b.tlsConfig})
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %s\n", err.Error())
+		return exitConnection
+	}
+	defer client.Close()
+
+	for _, line := range client.Greeting() {
+		fmt.Fprintln(b.out, "> "+line)
+	}
+
+	if b.user != "" {
+		if err := logIn(client, b.user, b.key, b.pswd, b.timeout); err != nil {
+			return loginFailed(err)
+		}
+	}
+
+	status := exitOK
+	for _, cmd := range b.commands {
+		if strings.Fields(cmd.line)[0] == "quit" {
+			break
+		}
+
+		err := b.exec(client, cmd.line)
+
+		var failure *pssh.Error
+		if errors.As(err, &failure) {
+			status = exitCmdFailed
+			fmt.Fprintf(os.Stderr, "%s: '%s' has failed.\n", cmd.source, strings.Fields(cmd.line)[0])
+			if !b.keepGoing {
+				break
+			}
+		} else if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = errors.New("the server did NOT answer in time")
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.source, err.Error())
+			return exitConnection
+		}
+	}
+
+	return status
+}
+
+// logIn logs in with the key if there is one, else with the password.
+func logIn(client *pssh.Client, user string, key crypto.Signer, pswd string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if key != nil {
+		return client.KeyLogin(ctx, user, key)
+	}
+	return client.Login(ctx, user, pswd)
+}
+
+// loginFailed reports a failed login and returns the exit code.
+func loginFailed(err error) int {
+	var failure *pssh.Error
+	if errors.As(err, &failure) {
+		fmt.Fprintf(os.Stderr, "login: %s\n", failure.Message)
+		return exitCmdFailed
+	} else if errors.Is(err, pssh.ErrBadArgument) {
+		fmt.Fprintf(os.Stderr, "login: %s\n", err.Error())
+		return exitUsage
+	}
+
+	fmt.Fprintf(os.Stderr, "login: %s\n", err.Error())
+	return exitConnection
+}
+
+// exec runs one command and answers the challenge of a "keylogin".
+func (b *batchRunner) exec(client *pssh.Client, line string) error {
+	return execLine(client, line, b.key, b.timeout, func(text string) {
+		fmt.Fprintln(b.out, text)
+	})
+}
+
+// execLine runs one command and shows its answer, line by line. If it is a
+// "keylogin", its challenge is answered with key.
+func execLine(client *pssh.Client, line string, key crypto.Signer, timeout time.Duration, show func(string)) error {
+	var resp *pssh.Response
+	err := pssh.Retry(context.Background(), timeout, func(ctx context.Context) error {
+		var err error
+		resp, err = client.Exec(ctx, line)
+		return err
+	})
+	if resp == nil {
+		return err
+	}
+
+	prefix := "> "
+	if err != nil {
+		prefix = "Error: "
+	}
+	challenge := ""
+	for _, text := range strings.Split(resp.Message, "\n") {
+		show(prefix + text)
+		if strings.HasPrefix(text, "Challenge: ") {
+			challenge = strings.TrimPrefix(text, "Challenge: ")
+		}
+	}
+
+	// Only the answer to this "keylogin" is signed, NOT a challenge in
+	// e.g. the text of a file.
+	if err != nil || key == nil || challenge == "" || !strings.HasPrefix(line, "keylogin ") {
+		return err
+	}
+	sig, err := pssh.SignChallenge(key, challenge)
+	if err != nil {
+		return err
+	}
+	return execLine(client, "keyauth "+sig, key, timeout, show)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks the json protocol. It answers each command by its
+// status in statuses, 200 if it is NOT there, and keeps what it was sent.
+// It closes the connection after "quit", as the server does.
+type fakeServer struct {
+	ln       net.Listener
+	statuses map[string][]int  // several ones are taken in turn
+	messages map[string]string // answers other than "ran {cmd}"
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newFakeServer(t *testing.T, statuses map[string][]int) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	fs := &fakeServer{ln: ln, statuses: statuses}
+	go fs.serve()
+	return fs
+}
+
+func (fs *fakeServer) addr() string {
+	return fs.ln.Addr().String()
+}
+
+func (fs *fakeServer) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.session(conn)
+	}
+}
+
+func (fs *fakeServer) session(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\n")
+
+		if line == "proto json" {
+			fs.reply(conn, "", 200, "The protocol is json.")
+			continue
+		}
+
+		id, cmd, _ := strings.Cut(line, " ")
+		fs.mu.Lock()
+		fs.received = append(fs.received, cmd)
+		status := 200
+		if list := fs.statuses[cmd]; len(list) > 0 {
+			status, fs.statuses[cmd] = list[0], list[1:]
+		}
+		message, ok := fs.messages[cmd]
+		fs.mu.Unlock()
+
+		if !ok {
+			message = "ran " + cmd
+		}
+		fs.reply(conn, id, status, message)
+		if cmd == "quit" {
+			return
+		}
+	}
+}
+
+func (fs *fakeServer) reply(w io.Writer, id string, status int, message string) {
+	frame, _ := json.Marshal(map[string]interface{}{"id": id, "type": "response", "status": status, "message": message})
+	_, _ = w.Write(append(frame, '\n'))
+}
+
+func (fs *fakeServer) commands() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.received...)
+}
+
+func TestParseScript(t *testing.T) {
+	script := "# provisioning\nreg dan Pw4Tests_x9\n\n  u2g devs dan  \n"
+
+	commands, err := parseScript(strings.NewReader(script), "users.pssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []batchCommand{{"reg dan Pw4Tests_x9", "users.pssh:2"}, {"u2g devs dan", "users.pssh:4"}}
+	if len(commands) != len(want) {
+		t.Fatalf("got %v, want %v", commands, want)
+	}
+	for i := range want {
+		if commands[i] != want[i] {
+			t.Errorf("#%d: got %v, want %v", i, commands[i], want[i])
+		}
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	commands := parseCommandLine("pwd; ls . ;; quit")
+
+	var lines []string
+	for _, cmd := range commands {
+		lines = append(lines, cmd.line)
+	}
+	if strings.Join(lines, ",") != "pwd,ls .,quit" {
+		t.Errorf("got %q", lines)
+	}
+	if commands[2].source != "-c #4" {
+		t.Errorf("source %q", commands[2].source)
+	}
+}
+
+func TestBatchRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  map[string][]int
+		commands  string
+		keepGoing bool
+		want      int
+		wantSent  []string
+	}{
+		{"all ok", nil, "pwd; ls .", false, exitOK, []string{"pwd", "ls ."}},
+		{"stop on failure", map[string][]int{"ls x": {404}}, "pwd; ls x; ls .", false, exitCmdFailed, []string{"pwd", "ls x"}},
+		{"keep going", map[string][]int{"ls x": {404}}, "pwd; ls x; ls .", true, exitCmdFailed, []string{"pwd", "ls x", "ls ."}},
+		{"stop on quit", nil, "pwd; quit; ls .", false, exitOK, []string{"pwd"}},
+		{"too many commands", map[string][]int{"pwd": {429, 429}}, "pwd", false, exitOK, []string{"pwd", "pwd", "pwd"}},
+		{"too many commands for good", map[string][]int{"pwd": {429, 429, 429, 429, 429, 429}}, "pwd", false, exitCmdFailed, []string{"pwd", "pwd", "pwd", "pwd", "pwd", "pwd"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFakeServer(t, tt.statuses)
+			b := &batchRunner{
+				commands:  parseCommandLine(tt.commands),
+				keepGoing: tt.keepGoing,
+				timeout:   time.Second,
+				out:       io.Discard,
+			}
+
+			if got := b.run(fs.addr()); got != tt.want {
+				t.Errorf("exit code %d, want %d", got, tt.want)
+			}
+
+			sent := fs.commands()
+			if n := len(sent); n > 0 && sent[n-1] == "quit" { // sent by Close
+				sent = sent[:n-1]
+			}
+			if strings.Join(sent, ",") != strings.Join(tt.wantSent, ",") {
+				t.Errorf("sent %q, want %q", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestBatchSignsOnlyKeylogin(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := "Challenge: " + base64.StdEncoding.EncodeToString([]byte("nonce"))
+
+	fs := newFakeServer(t, nil)
+	fs.messages = map[string]string{"read note.txt": challenge, "keylogin dan": challenge}
+	b := &batchRunner{
+		commands: parseCommandLine("read note.txt; keylogin dan"),
+		timeout:  time.Second,
+		key:      key,
+		out:      io.Discard,
+	}
+	if got := b.run(fs.addr()); got != exitOK {
+		t.Fatalf("exit code %d", got)
+	}
+
+	sent := fs.commands()
+	if len(sent) < 3 || sent[0] != "read note.txt" || sent[1] != "keylogin dan" || !strings.HasPrefix(sent[2], "keyauth ") {
+		t.Errorf("sent %q, want only the challenge of 'keylogin' answered", sent)
+	}
+}
+
+func TestBatchRunUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	b := &batchRunner{commands: parseCommandLine("pwd"), timeout: time.Second, out: io.Discard}
+	if got := b.run(addr); got != exitConnection {
+		t.Errorf("exit code %d, want %d", got, exitConnection)
+	}
+}
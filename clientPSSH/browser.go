@@ -0,0 +1,858 @@
+package main
+
+import (
+	"bufio"
+	"clientPSSH/pssh"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const browserHelp = "Up/Down move  Right/Enter open  Left back  r read  c chmod  m chmark  w watch  d delete  R refresh  q quit"
+
+// browser is the full-screen mode of -browse: the remote directory tree on
+// the left, the record and a preview of the selected file on the right.
+type browser struct {
+	timeout   time.Duration
+	key       crypto.Signer
+	tlsConfig *tls.Config
+	user      string // logged in with key or pswd
+	pswd      string
+	host      string
+	root      string // directory the tree starts in, "." for the home
+
+	client  *pssh.Client
+	in      *bufio.Reader
+	out     *bufio.Writer
+	keys    chan string
+	resized chan os.Signal
+
+	width, height int
+
+	nodes     []*node
+	sel       int
+	top       int
+	files     map[string]*fileState // by path, dropped when the file changes
+	status    string
+	prompting string // the question being answered on the status line
+}
+
+// node is a line of the tree.
+type node struct {
+	path     string // as the server takes it
+	name     string
+	depth    int
+	isDir    bool
+	expanded bool
+}
+
+// fileState is what the server has said about a file. It is fetched when
+// the file is selected the first time.
+type fileState struct {
+	info    *pssh.FileInfo
+	infoErr error
+	text    string
+	textErr error
+}
+
+// run returns the exit code, as the batch mode.
+func (b *browser) run(addr string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	client, err := pssh.Dial(ctx, addr, &pssh.Config{TLSConfig: b.tlsConfig})
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %s\n", err.Error())
+		return exitConnection
+	}
+	defer client.Close()
+	b.client = client
+
+	if err := logIn(client, b.user, b.key, b.pswd, b.timeout); err != nil {
+		return loginFailed(err)
+	}
+
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-browse needs a terminal: %s\n", err.Error())
+		return exitUsage
+	}
+	restore := func() { _ = term.Restore(fd, state) }
+
+	b.in = bufio.NewReader(os.Stdin)
+	b.out = bufio.NewWriter(os.Stdout)
+	b.keys = make(chan string)
+	b.resized = make(chan os.Signal, 1)
+	b.files = make(map[string]*fileState)
+	notifyResize(b.resized)
+	defer signal.Stop(b.resized)
+	b.resize()
+
+	/* The alternate screen keeps the terminal as it was. */
+	fmt.Fprint(b.out, "\x1b[?1049h\x1b[?25l")
+	code := b.loop()
+	fmt.Fprint(b.out, "\x1b[?25h\x1b[?1049l")
+	_ = b.out.Flush()
+	restore()
+
+	if code == exitConnection {
+		fmt.Fprintln(os.Stderr, "The connection has been closed.")
+	}
+	return code
+}
+
+func (b *browser) loop() int {
+	go b.readKeys()
+
+	nodes, err := b.list(b.root, 0)
+	if err != nil {
+		b.status = errText(err)
+	}
+	b.nodes = nodes
+
+	for {
+		b.load()
+		b.draw()
+
+		select {
+		case key, ok := <-b.keys:
+			if !ok || key == "q" || key == "ctrl-c" {
+				return exitOK
+			}
+			b.press(key)
+
+		case <-b.resized:
+			b.resize()
+
+		case <-b.client.Done():
+			return exitConnection
+		}
+	}
+}
+
+func (b *browser) press(key string) {
+	b.status = ""
+
+	switch key {
+	case "up", "k":
+		b.move(-1)
+	case "down", "j":
+		b.move(1)
+	case "pgup":
+		b.move(-b.rows())
+	case "pgdn":
+		b.move(b.rows())
+	case "home", "g":
+		b.move(-len(b.nodes))
+	case "end", "G":
+		b.move(len(b.nodes))
+
+	case "right", "l":
+		if n := b.selected(); n != nil && n.isDir && !n.expanded {
+			b.expand(b.sel)
+		}
+	case "enter":
+		if n := b.selected(); n != nil && n.isDir && n.expanded {
+			b.collapse(b.sel)
+		} else if n != nil && n.isDir {
+			b.expand(b.sel)
+		} else if n != nil {
+			b.read(n)
+		}
+	case "left", "h":
+		b.back()
+
+	case "r":
+		if n := b.selected(); n != nil && !n.isDir {
+			b.read(n)
+		}
+	case "c":
+		b.chmod()
+	case "m":
+		b.chmark()
+	case "w":
+		b.watch()
+	case "d", "delete":
+		b.remove()
+	case "R", "F5":
+		b.refresh()
+	}
+}
+
+// call runs a command with the timeout, again while the server refuses it as
+// too fast.
+func (b *browser) call(cmd func(ctx context.Context) error) error {
+	return pssh.Retry(context.Background(), b.timeout, cmd)
+}
+
+// errText is the message of the server, or the error itself.
+func errText(err error) string {
+	var failure *pssh.Error
+	if errors.As(err, &failure) {
+		return strings.ReplaceAll(failure.Message, "\n", " ")
+	}
+	return err.Error()
+}
+
+/* The tree. */
+
+// list returns the entries of dir, directories first.
+func (b *browser) list(dir string, depth int) ([]*node, error) {
+	var entries []pssh.Entry
+	err := b.call(func(ctx context.Context) (err error) {
+		entries, err = b.client.Ls(ctx, dir)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	nodes := make([]*node, 0, len(entries))
+	for _, e := range entries {
+		nodes = append(nodes, &node{path: path.Join(dir, e.Name), name: e.Name, depth: depth, isDir: e.IsDir})
+	}
+	return nodes, nil
+}
+
+func (b *browser) selected() *node {
+	if b.sel < 0 || b.sel >= len(b.nodes) {
+		return nil
+	}
+	return b.nodes[b.sel]
+}
+
+func (b *browser) move(step int) {
+	b.sel += step
+	if b.sel >= len(b.nodes) {
+		b.sel = len(b.nodes) - 1
+	}
+	if b.sel < 0 {
+		b.sel = 0
+	}
+}
+
+func (b *browser) expand(i int) {
+	n := b.nodes[i]
+	children, err := b.list(n.path, n.depth+1)
+	if err != nil {
+		b.status = errText(err)
+		return
+	}
+
+	n.expanded = true
+	rest := append(children, b.nodes[i+1:]...)
+	b.nodes = append(b.nodes[:i+1], rest...)
+	if len(children) == 0 {
+		b.status = fmt.Sprintf("'%s' is empty.", b.display(n.path))
+	}
+}
+
+func (b *browser) collapse(i int) {
+	n := b.nodes[i]
+	end := i + 1
+	for end < len(b.nodes) && b.nodes[end].depth > n.depth {
+		end++
+	}
+
+	n.expanded = false
+	b.nodes = append(b.nodes[:i+1], b.nodes[end:]...)
+}
+
+// back collapses the selected directory, or selects the parent one.
+func (b *browser) back() {
+	n := b.selected()
+	if n == nil {
+		return
+	}
+	if n.isDir && n.expanded {
+		b.collapse(b.sel)
+		return
+	}
+
+	for i := b.sel - 1; i >= 0; i-- {
+		if b.nodes[i].depth < n.depth {
+			b.sel = i
+			return
+		}
+	}
+}
+
+// refresh lists the tree again, with the same directories open, and
+// forgets the files.
+func (b *browser) refresh() {
+	expanded := make(map[string]bool)
+	for _, n := range b.nodes {
+		if n.expanded {
+			expanded[n.path] = true
+		}
+	}
+	current := ""
+	if n := b.selected(); n != nil {
+		current = n.path
+	}
+
+	nodes, err := b.list(b.root, 0)
+	if err != nil {
+		b.status = errText(err)
+		return
+	}
+	b.nodes = nodes
+	b.files = make(map[string]*fileState)
+
+	for i := 0; i < len(b.nodes); i++ {
+		if b.nodes[i].isDir && expanded[b.nodes[i].path] {
+			b.expand(i)
+		}
+	}
+
+	b.sel = 0
+	for i, n := range b.nodes {
+		if n.path == current {
+			b.sel = i
+		}
+	}
+	b.status = "Refreshed."
+}
+
+// load fetches the record and the text of the selected file.
+func (b *browser) load() {
+	n := b.selected()
+	if n == nil || n.isDir || b.files[n.path] != nil {
+		return
+	}
+
+	st := &fileState{}
+	st.infoErr = b.call(func(ctx context.Context) (err error) {
+		st.info, err = b.client.Stat(ctx, n.path)
+		return err
+	})
+	st.textErr = b.call(func(ctx context.Context) (err error) {
+		st.text, err = b.client.Read(ctx, n.path)
+		return err
+	})
+	b.files[n.path] = st
+}
+
+/* Commands on the selected file. */
+
+// selectedFile returns the selected file with its record, or nil with a
+// status.
+func (b *browser) selectedFile() (*node, *pssh.FileInfo) {
+	n := b.selected()
+	if n == nil || n.isDir {
+		b.status = "Select a file first."
+		return nil, nil
+	}
+
+	st := b.files[n.path]
+	if st == nil || st.info == nil {
+		b.status = fmt.Sprintf("'%s' has no record in the database.", b.display(n.path))
+		return nil, nil
+	}
+	return n, st.info
+}
+
+// done reports a command on n and drops what is known about it.
+func (b *browser) done(n *node, err error, success string) {
+	delete(b.files, n.path)
+	if err != nil {
+		b.status = errText(err)
+		return
+	}
+	b.status = success
+}
+
+func (b *browser) chmod() {
+	n, info := b.selectedFile()
+	if n == nil {
+		return
+	}
+
+	rights, ok := b.prompt(fmt.Sprintf("Rights of '%s' (rwrw): ", n.name), pssh.FormatRights(info.Rights))
+	if !ok {
+		return
+	}
+	if _, err := pssh.ParseRights(rights); err != nil {
+		b.status = err.Error()
+		return
+	}
+
+	err := b.call(func(ctx context.Context) error {
+		return b.client.Chmod(ctx, n.path, rights)
+	})
+	b.done(n, err, fmt.Sprintf("Rights of '%s' are %s now.", n.name, rights))
+}
+
+func (b *browser) chmark() {
+	n, info := b.selectedFile()
+	if n == nil {
+		return
+	}
+
+	text, ok := b.prompt(fmt.Sprintf("Mark of '%s': ", n.name), strconv.FormatUint(info.Mark, 10))
+	if !ok {
+		return
+	}
+	mark, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		b.status = fmt.Sprintf("The mark must be a number, NOT '%s'.", text)
+		return
+	}
+
+	err = b.call(func(ctx context.Context) error {
+		return b.client.Chmark(ctx, pssh.MarkFile, n.path, mark)
+	})
+	b.done(n, err, fmt.Sprintf("Mark of '%s' is %d now.", n.name, mark))
+}
+
+func (b *browser) watch() {
+	n, info := b.selectedFile()
+	if n == nil {
+		return
+	}
+
+	err := b.call(func(ctx context.Context) error {
+		return b.client.Watch(ctx, pssh.MarkFile, n.path)
+	})
+	state := "on"
+	if info.Audited {
+		state = "off"
+	}
+	b.done(n, err, fmt.Sprintf("Audit of '%s' is %s now.", n.name, state))
+}
+
+func (b *browser) remove() {
+	n := b.selected()
+	if n == nil {
+		return
+	}
+
+	answer, ok := b.prompt(fmt.Sprintf("Delete '%s'? (y/N): ", b.display(n.path)), "")
+	if !ok || (answer != "y" && answer != "yes") {
+		b.status = "Nothing deleted."
+		return
+	}
+
+	err := b.call(func(ctx context.Context) error {
+		return b.client.Remove(ctx, n.path)
+	})
+	b.done(n, err, fmt.Sprintf("'%s' has been deleted.", b.display(n.path)))
+	if err != nil {
+		return
+	}
+
+	if n.expanded {
+		b.collapse(b.sel)
+	}
+	b.nodes = append(b.nodes[:b.sel], b.nodes[b.sel+1:]...)
+	b.move(0)
+}
+
+// read shows the whole text of a file, until q or Left.
+func (b *browser) read(n *node) {
+	st := b.files[n.path]
+	if st == nil {
+		return
+	}
+	if st.textErr != nil {
+		b.status = errText(st.textErr)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(st.text, "\n"), "\n")
+	top := 0
+	for {
+		rows := b.height - 2
+		if top > len(lines)-rows {
+			top = len(lines) - rows
+		}
+		if top < 0 {
+			top = 0
+		}
+
+		fmt.Fprint(b.out, "\x1b[H")
+		fmt.Fprint(b.out, "\x1b[7m"+fit(" "+b.display(n.path), b.width)+"\x1b[0m\r\n")
+		for i := 0; i < rows; i++ {
+			line := ""
+			if top+i < len(lines) {
+				line = lines[top+i]
+			}
+			fmt.Fprint(b.out, fit(line, b.width)+"\r\n")
+		}
+		where := fmt.Sprintf(" Lines %d-%d of %d", top+1, min(top+rows, len(lines)), len(lines))
+		fmt.Fprint(b.out, "\x1b[7m"+fit(where+"  Up/Down/PgUp/PgDn scroll  q back", b.width)+"\x1b[0m")
+		_ = b.out.Flush()
+
+		select {
+		case key, ok := <-b.keys:
+			switch key {
+			case "up", "k":
+				top--
+			case "down", "j":
+				top++
+			case "pgup":
+				top -= rows
+			case "pgdn", " ":
+				top += rows
+			case "home", "g":
+				top = 0
+			case "end", "G":
+				top = len(lines)
+			case "q", "left", "h", "esc", "ctrl-c":
+				return
+			}
+			if !ok {
+				return
+			}
+
+		case <-b.resized:
+			b.resize()
+
+		case <-b.client.Done():
+			return
+		}
+	}
+}
+
+// prompt reads an answer on the status line. It returns false if it was
+// cancelled with Esc or Ctrl+C.
+func (b *browser) prompt(question, answer string) (string, bool) {
+	defer func() { b.prompting = "" }()
+
+	for {
+		b.prompting = question + answer
+		b.draw()
+
+		select {
+		case key, ok := <-b.keys:
+			switch {
+			case !ok || key == "esc" || key == "ctrl-c":
+				b.status = "Cancelled."
+				return "", false
+			case key == "enter":
+				return strings.TrimSpace(answer), true
+			case key == "backspace":
+				if r := []rune(answer); len(r) > 0 {
+					answer = string(r[:len(r)-1])
+				}
+			case len([]rune(key)) == 1 && key >= " ":
+				answer += key
+			}
+
+		case <-b.resized:
+			b.resize()
+		}
+	}
+}
+
+/* The terminal. */
+
+// readKeys turns what is typed into names of keys, e.g. "up", "enter", or
+// the typed character.
+func (b *browser) readKeys() {
+	defer close(b.keys)
+
+	for {
+		r, _, err := b.in.ReadRune()
+		if err != nil {
+			return
+		}
+
+		switch r {
+		case '\r', '\n':
+			b.keys <- "enter"
+		case 3:
+			b.keys <- "ctrl-c"
+		case 127, 8:
+			b.keys <- "backspace"
+		case 27:
+			b.keys <- b.escape()
+		default:
+			if r >= ' ' {
+				b.keys <- string(r)
+			}
+		}
+	}
+}
+
+// escape reads the rest of an escape sequence. A lone Esc has nothing
+// after it, the keys of a sequence arrive at once.
+func (b *browser) escape() string {
+	if b.in.Buffered() == 0 {
+		return "esc"
+	}
+	r, _, _ := b.in.ReadRune()
+	if r != '[' && r != 'O' {
+		return "esc"
+	}
+
+	r, _, _ = b.in.ReadRune()
+	switch r {
+	case 'A':
+		return "up"
+	case 'B':
+		return "down"
+	case 'C':
+		return "right"
+	case 'D':
+		return "left"
+	case 'H':
+		return "home"
+	case 'F':
+		return "end"
+	}
+
+	// e.g. ESC [ 5 ~ for PgUp, ESC [ 1 5 ~ for F5
+	seq := string(r)
+	for len(seq) < 4 {
+		r, _, _ = b.in.ReadRune()
+		if r < '0' || r > '9' {
+			break
+		}
+		seq += string(r)
+	}
+	switch seq {
+	case "1", "7":
+		return "home"
+	case "4", "8":
+		return "end"
+	case "3":
+		return "delete"
+	case "5":
+		return "pgup"
+	case "6":
+		return "pgdn"
+	case "15":
+		return "F5"
+	}
+	return ""
+}
+
+func (b *browser) resize() {
+	b.width, b.height = 80, 24
+	if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 && h > 0 {
+		b.width, b.height = w, h
+	}
+}
+
+// rows of the panes, between the title and the status and help lines.
+func (b *browser) rows() int {
+	if b.height < 4 {
+		return 1
+	}
+	return b.height - 3
+}
+
+// display is the path as the user sees it.
+func (b *browser) display(p string) string {
+	if b.root == "." {
+		return path.Join("/home", p)
+	}
+	return p
+}
+
+func (b *browser) draw() {
+	rows := b.rows()
+	if b.sel < b.top {
+		b.top = b.sel
+	}
+	if b.sel >= b.top+rows {
+		b.top = b.sel - rows + 1
+	}
+
+	left := b.width / 3
+	if left < 24 {
+		left = 24
+	}
+	if left > b.width-10 {
+		left = b.width / 2
+	}
+	right := b.width - left - 1
+
+	title := " " + b.user + "@" + b.host + "  " + b.display(b.root)
+	if n := b.selected(); n != nil {
+		title = " " + b.user + "@" + b.host + "  " + b.display(n.path)
+	}
+
+	details := b.details(right)
+
+	fmt.Fprint(b.out, "\x1b[H")
+	fmt.Fprint(b.out, "\x1b[7m"+fit(title, b.width)+"\x1b[0m\r\n")
+	for i := 0; i < rows; i++ {
+		line := fit("", left)
+		if j := b.top + i; j < len(b.nodes) {
+			line = b.treeLine(b.nodes[j], left)
+			if j == b.sel {
+				line = "\x1b[7m" + line + "\x1b[0m"
+			}
+		}
+
+		detail := ""
+		if i < len(details) {
+			detail = details[i]
+		}
+		fmt.Fprint(b.out, line+"│"+fit(detail, right)+"\r\n")
+	}
+
+	status := b.status
+	if b.prompting != "" {
+		status = b.prompting
+	}
+	fmt.Fprint(b.out, fit(status, b.width)+"\r\n")
+	fmt.Fprint(b.out, "\x1b[7m"+fit(browserHelp, b.width)+"\x1b[0m")
+
+	if b.prompting != "" {
+		fmt.Fprintf(b.out, "\x1b[%d;%dH\x1b[?25h", b.height-1, min(len([]rune(b.prompting))+1, b.width))
+	} else {
+		fmt.Fprint(b.out, "\x1b[?25l")
+	}
+	_ = b.out.Flush()
+}
+
+// treeLine shows a node, with the rights of a file and "A" if it is
+// audited, once they are known.
+func (b *browser) treeLine(n *node, width int) string {
+	name := strings.Repeat("  ", n.depth)
+	switch {
+	case n.isDir && n.expanded:
+		name += "- " + n.name + "/"
+	case n.isDir:
+		name += "+ " + n.name + "/"
+	default:
+		name += "  " + n.name
+	}
+
+	suffix := ""
+	if st := b.files[n.path]; st != nil && st.info != nil {
+		suffix = " " + pssh.FormatRights(st.info.Rights)
+		if st.info.Audited {
+			suffix += " A"
+		} else {
+			suffix += "  "
+		}
+	}
+	if width <= len(suffix) {
+		return fit(name, width)
+	}
+	return fit(name, width-len(suffix)) + suffix
+}
+
+// details are the lines of the right pane.
+func (b *browser) details(width int) []string {
+	n := b.selected()
+	if n == nil {
+		return []string{"", " Nothing here."}
+	}
+	if n.isDir && n.expanded {
+		return []string{"", " Directory " + b.display(n.path), "", " Left or Enter closes it."}
+	}
+	if n.isDir {
+		return []string{"", " Directory " + b.display(n.path), "", " Right or Enter lists it."}
+	}
+
+	st := b.files[n.path]
+	if st == nil {
+		return nil
+	}
+
+	lines := []string{"", " File    " + b.display(n.path)}
+	if st.infoErr != nil {
+		lines = append(lines, " Record  "+errText(st.infoErr))
+	} else {
+		info := st.info
+		lines = append(lines,
+			" Owner   "+info.Owner,
+			" Group   "+info.Group,
+			" Rights  "+pssh.FormatRights(info.Rights)+"  "+rightsText(info.Rights),
+			" Mark    "+strconv.FormatUint(info.Mark, 10),
+			" Audit   "+auditText(info),
+		)
+	}
+
+	lines = append(lines, "", " "+strings.Repeat("─", max(width-2, 0)))
+	if st.textErr != nil {
+		return append(lines, " "+errText(st.textErr))
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(st.text, "\n"), "\n") {
+		lines = append(lines, " "+line)
+	}
+	return lines
+}
+
+// rightsText spells the bits "rwrw" out, e.g. "owner rw, group r-".
+func rightsText(rights uint8) string {
+	bit := func(mask uint8, c string) string {
+		if rights&mask != 0 {
+			return c
+		}
+		return "-"
+	}
+	return "owner " + bit(0b1000, "r") + bit(0b0100, "w") + ", group " + bit(0b0010, "r") + bit(0b0001, "w")
+}
+
+func auditText(info *pssh.FileInfo) string {
+	if !info.Audited {
+		return "off"
+	}
+
+	text := "on"
+	switch info.AuditRW {
+	case 0b10:
+		text += ", reads"
+	case 0b01:
+		text += ", writes"
+	default:
+		text += ", reads and writes"
+	}
+	if info.AuditAmount > 0 {
+		text += fmt.Sprintf(", last %d", info.AuditAmount)
+	}
+	return text
+}
+
+// fit cuts or pads text to width columns. Control characters, e.g. tabs,
+// are shown as spaces.
+func fit(text string, width int) string {
+	r := []rune(text)
+	for i := range r {
+		if r[i] < ' ' || r[i] == 127 {
+			r[i] = ' '
+		}
+	}
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return string(r) + strings.Repeat(" ", width-len(r))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
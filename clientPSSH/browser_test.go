@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"clientPSSH/pssh"
+	"strings"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  string
+	}{
+		{"abc", 5, "abc  "},
+		{"abcdef", 3, "abc"},
+		{"a\tb", 3, "a b"},
+		{"файл", 2, "фа"},
+		{"abc", 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := fit(tt.text, tt.width); got != tt.want {
+			t.Errorf("fit(%q, %d) = %q, want %q", tt.text, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestRightsAndAuditText(t *testing.T) {
+	if got := rightsText(0b1110); got != "owner rw, group r-" {
+		t.Errorf("rightsText = %q", got)
+	}
+
+	tests := []struct {
+		info pssh.FileInfo
+		want string
+	}{
+		{pssh.FileInfo{}, "off"},
+		{pssh.FileInfo{Audited: true, AuditRW: 0b10}, "on, reads"},
+		{pssh.FileInfo{Audited: true, AuditRW: 0b01, AuditAmount: 5}, "on, writes, last 5"},
+		{pssh.FileInfo{Audited: true, AuditRW: 0b11}, "on, reads and writes"},
+	}
+
+	for _, tt := range tests {
+		if got := auditText(&tt.info); got != tt.want {
+			t.Errorf("auditText(%+v) = %q, want %q", tt.info, got, tt.want)
+		}
+	}
+}
+
+// testTree is docs/ open with a.txt and 2026/ open with b.txt, then c.txt.
+func testTree() *browser {
+	return &browser{
+		root:  ".",
+		files: make(map[string]*fileState),
+		nodes: []*node{
+			{path: "docs", name: "docs", isDir: true, expanded: true},
+			{path: "docs/a.txt", name: "a.txt", depth: 1},
+			{path: "docs/2026", name: "2026", depth: 1, isDir: true, expanded: true},
+			{path: "docs/2026/b.txt", name: "b.txt", depth: 2},
+			{path: "c.txt", name: "c.txt"},
+		},
+	}
+}
+
+func paths(b *browser) string {
+	var p []string
+	for _, n := range b.nodes {
+		p = append(p, n.path)
+	}
+	return strings.Join(p, ",")
+}
+
+func TestTree(t *testing.T) {
+	b := testTree()
+
+	b.move(10)
+	if b.sel != 4 {
+		t.Errorf("move past the end: %d", b.sel)
+	}
+	b.move(-10)
+	if b.sel != 0 {
+		t.Errorf("move past the start: %d", b.sel)
+	}
+
+	// From b.txt back to 2026/, then 2026/ is closed.
+	b.sel = 3
+	b.back()
+	if b.sel != 2 {
+		t.Errorf("back selected %d, want the parent", b.sel)
+	}
+	b.back()
+	if got := paths(b); got != "docs,docs/a.txt,docs/2026,c.txt" || b.nodes[2].expanded {
+		t.Errorf("back did NOT collapse: %s", got)
+	}
+
+	b.collapse(0)
+	if got := paths(b); got != "docs,c.txt" {
+		t.Errorf("collapse: %s", got)
+	}
+
+	// A node at the top has no parent to go back to.
+	b.sel = 1
+	b.back()
+	if b.sel != 1 {
+		t.Errorf("back from the top selected %d", b.sel)
+	}
+}
+
+func TestDraw(t *testing.T) {
+	for _, width := range []int{1, 2, 10, 33, 80} {
+		b := testTree()
+		b.width, b.height = width, 6
+		b.sel = 1
+		b.files["docs/a.txt"] = &fileState{info: &pssh.FileInfo{Owner: "dan", Rights: 0b1110}, text: "one\ntwo\n"}
+
+		var out strings.Builder
+		b.out = bufio.NewWriter(&out)
+		b.draw()
+		if !strings.Contains(out.String(), "\x1b[H") {
+			t.Errorf("width %d: nothing drawn", width)
+		}
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	b := &browser{
+		in:   bufio.NewReader(strings.NewReader("j\x1b[A\x1b[C\x1b[5~\x1b[15~\x1b[3~\r\x03")),
+		keys: make(chan string),
+	}
+	go b.readKeys()
+
+	var keys []string
+	for key := range b.keys {
+		keys = append(keys, key)
+	}
+	if got := strings.Join(keys, ","); got != "j,up,right,pgup,F5,delete,enter,ctrl-c" {
+		t.Errorf("keys %s", got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"clientPSSH/pssh"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quitTimeout is how long the server gets to answer "quit" on exit.
+const quitTimeout = 3 * time.Second
+
+// Reasons of the server's disconnects after which the session is NOT
+// resumed. After a shutdown it may be, by a server that keeps sessions.
+var finalReasons = map[string]bool{
+	"killed":        true,
+	"replaced":      true,
+	"resumed":       true,
+	"idle":          true,
+	"login-timeout": true,
+}
+
+// shell is the interactive session. It runs the lines typed by the user on
+// the server, over the json protocol, and shows the answers. It serves one
+// connection at a time, the lines typed meanwhile wait for the next one.
+type shell struct {
+	key       crypto.Signer
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	user      string // logged in as on connecting, with key or pswd
+	pswd      string
+
+	// Interactive mode, nil if stdin is NOT a terminal.
+	editor *lineEditor
+	host   string
+
+	lines     chan string   // typed by the user
+	leaving   chan struct{} // closed on Ctrl+C, Ctrl+D or the end of stdin
+	leaveOnce sync.Once
+	// exit restores the terminal and exits, on a second Ctrl+C.
+	exit func(code int)
+
+	stateMu sync.Mutex
+	client  *pssh.Client // of the current connection, nil between them
+	nick    string
+	remote  bool   // the server answers "complete"
+	quit    bool   // the user has left, the connection is closed by us
+	final   bool   // the server has ended the session, do NOT reconnect
+	token   string // to resume the session with
+}
+
+// print shows a line to the user, above the edited line if there is one.
+func (sh *shell) print(text string) {
+	if sh.editor != nil {
+		sh.editor.printAbove(text)
+		return
+	}
+	fmt.Println(text)
+}
+
+// hasQuit reports whether the user has left or the server has ended the
+// session.
+func (sh *shell) hasQuit() bool {
+	sh.stateMu.Lock()
+	defer sh.stateMu.Unlock()
+
+	return sh.quit || sh.final
+}
+
+// leave asks to quit the session and exit. The session is quit on the
+// server, unless it is called again: then the client exits at once.
+func (sh *shell) leave(interrupted bool) {
+	left := true
+	sh.leaveOnce.Do(func() {
+		left = false
+		sh.stateMu.Lock()
+		sh.quit = true
+		sh.stateMu.Unlock()
+		close(sh.leaving)
+	})
+
+	if left && interrupted {
+		sh.print("Exiting.")
+		sh.exit(1)
+	}
+	if interrupted {
+		sh.print("Quitting. Press CTRL+C again to exit at once.")
+	}
+}
+
+// readLines reads the commands of the user until Ctrl+C, Ctrl+D or the end
+// of stdin, with the line editor if there is one.
+func (sh *shell) readLines() {
+	sh.lines = make(chan string)
+	sh.leaving = make(chan struct{})
+	sh.remote = true
+
+	if sh.editor != nil {
+		sh.editor.setPrompt(sh.host + "> ")
+		sh.editor.complete = func(line string) []string {
+			sh.stateMu.Lock()
+			client := sh.client
+			sh.stateMu.Unlock()
+			if client == nil {
+				return nil
+			}
+			return sh.complete(client, line)
+		}
+	}
+
+	go func() {
+		if sh.editor != nil {
+			for {
+				line, err := sh.editor.readLine()
+				if err != nil {
+					sh.leave(errors.Is(err, errInterrupt))
+					break
+				}
+				sh.lines <- line
+			}
+
+			// The terminal is raw, Ctrl+C is a key, NOT a signal.
+			if sh.editor.waitInterrupt() {
+				sh.leave(true)
+			}
+			return
+		}
+
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			sh.lines <- scanner.Text()
+		}
+		sh.leave(false)
+	}()
+}
+
+// connect dials addr and serves the session until the connection is gone or
+// the user leaves. It returns an error only if it can NOT connect.
+func (sh *shell) connect(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sh.timeout)
+	client, err := pssh.Dial(ctx, addr, &pssh.Config{TLSConfig: sh.tlsConfig, OnEvent: sh.event})
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, line := range client.Greeting() {
+		sh.print("> " + line)
+	}
+	sh.serve(client)
+	return nil
+}
+
+func (sh *shell) serve(client *pssh.Client) {
+	sh.stateMu.Lock()
+	sh.client = client
+	sh.stateMu.Unlock()
+
+	defer func() {
+		sh.stateMu.Lock()
+		sh.client = nil
+		sh.stateMu.Unlock()
+	}()
+
+	sh.authenticate(client)
+	sh.refresh(client)
+
+	for {
+		select {
+		case line := <-sh.lines:
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+
+			if fields[0] == "quit" {
+				sh.stateMu.Lock()
+				sh.quit = true
+				sh.stateMu.Unlock()
+				sh.sayQuit(client)
+				return
+			}
+
+			sh.exec(client, line)
+			if stateCommands[fields[0]] {
+				sh.refresh(client)
+			}
+
+		case <-sh.leaving:
+			sh.sayQuit(client)
+			return
+
+		case <-client.Done():
+			return
+		}
+	}
+}
+
+// exec runs a line and shows the answer. A "keylogin" of the line, and only
+// of it, gets its challenge answered with the key.
+func (sh *shell) exec(client *pssh.Client, line string) {
+	err := execLine(client, line, sh.key, sh.timeout, sh.print)
+
+	var failure *pssh.Error
+	switch {
+	case err == nil, errors.As(err, &failure), errors.Is(err, pssh.ErrClosed):
+	case errors.Is(err, context.DeadlineExceeded):
+		sh.print("The server did NOT answer in time.")
+	default:
+		sh.print(err.Error())
+	}
+}
+
+// event shows a message of the server that is NOT an answer, e.g. that the
+// session has been killed.
+func (sh *shell) event(resp pssh.Response) {
+	for _, text := range strings.Split(resp.Message, "\n") {
+		sh.print("> " + text)
+	}
+
+	if finalReasons[resp.Reason()] {
+		sh.stateMu.Lock()
+		sh.final = true
+		sh.stateMu.Unlock()
+	}
+}
+
+// sayQuit quits the session, so that the server logs it out and closes the
+// connection.
+func (sh *shell) sayQuit(client *pssh.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), quitTimeout)
+	defer cancel()
+
+	resp, err := client.Exec(ctx, "quit")
+	if errors.Is(err, context.DeadlineExceeded) {
+		sh.print("The server has NOT answered 'quit' in time.")
+		return
+	}
+	if resp == nil {
+		return
+	}
+	for _, text := range strings.Split(resp.Message, "\n") {
+		sh.print("> " + text)
+	}
+}
+
+// authenticate resumes the session of the previous connection, or logs in
+// as set up.
+func (sh *shell) authenticate(client *pssh.Client) {
+	sh.stateMu.Lock()
+	token := sh.token
+	sh.stateMu.Unlock()
+
+	if token != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), sh.timeout)
+		next, err := client.Resume(ctx, token)
+		cancel()
+
+		sh.setToken(next)
+		if err == nil {
+			sh.print("The session has been resumed.")
+			return
+		}
+	}
+
+	switch {
+	case sh.user == "":
+	case sh.key != nil:
+		sh.exec(client, "keylogin "+sh.user)
+	default:
+		sh.exec(client, "login "+sh.user+" "+sh.pswd)
+	}
+}
+
+// refresh follows the state of the session: it keeps a resume token while
+// logged in and shows the user and the current directory in the prompt.
+func (sh *shell) refresh(client *pssh.Client) {
+	sh.stateMu.Lock()
+	remote := sh.remote
+	sh.stateMu.Unlock()
+	if !remote {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	nick, dir, err := client.State(ctx)
+	if err != nil {
+		sh.completeFailed(err)
+		return
+	}
+
+	sh.stateMu.Lock()
+	renewToken := nick != "" && (nick != sh.nick || sh.token == "")
+	sh.nick = nick
+	sh.stateMu.Unlock()
+
+	switch {
+	case nick == "":
+		sh.setToken("")
+	case renewToken:
+		token, err := client.ResumeToken(ctx)
+		if err == nil {
+			sh.setToken(token)
+		}
+	}
+
+	if sh.editor == nil {
+		return
+	}
+	if nick == "" {
+		sh.editor.setPrompt(sh.host + "> ")
+		return
+	}
+	sh.editor.setPrompt(fmt.Sprintf("%s@%s:%s> ", nick, sh.host, dir))
+}
+
+func (sh *shell) setToken(token string) {
+	sh.stateMu.Lock()
+	sh.token = token
+	sh.stateMu.Unlock()
+}
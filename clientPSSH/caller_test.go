@@ -0,0 +1,115 @@
+package main
+
+import (
+	"clientPSSH/pssh"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveShell runs a session of sh on a fake server until it returns.
+func serveShell(t *testing.T, sh *shell) (*fakeServer, chan struct{}) {
+	t.Helper()
+	fs := newFakeServer(t, nil)
+
+	done := make(chan struct{})
+	go func() {
+		if err := sh.connect(fs.addr()); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	return fs, done
+}
+
+func newTestShell() (*shell, *int) {
+	code := -1
+	return &shell{
+		timeout: time.Second,
+		lines:   make(chan string),
+		leaving: make(chan struct{}),
+		exit:    func(c int) { code = c },
+	}, &code
+}
+
+// typed returns the lines of the user the server got, without the queries
+// of the prompt.
+func typed(fs *fakeServer) []string {
+	var lines []string
+	for _, line := range fs.commands() {
+		if !strings.HasPrefix(line, "complete ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestLeaveQuitsSession(t *testing.T) {
+	sh, code := newTestShell()
+	fs, done := serveShell(t, sh)
+
+	sh.leave(true)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the session has NOT ended after 'quit'")
+	}
+
+	if sent := typed(fs); len(sent) == 0 || sent[len(sent)-1] != "quit" {
+		t.Errorf("sent %q", sent)
+	}
+	if !sh.hasQuit() {
+		t.Error("the shell does NOT know it has quit")
+	}
+	if *code != -1 {
+		t.Errorf("exited with %d after the first CTRL+C", *code)
+	}
+
+	sh.leave(true)
+	if *code != 1 {
+		t.Errorf("exited with %d after the second CTRL+C, want 1", *code)
+	}
+}
+
+func TestTypedQuit(t *testing.T) {
+	sh, _ := newTestShell()
+	fs, done := serveShell(t, sh)
+
+	sh.lines <- "pwd"
+	sh.lines <- "quit"
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the session has NOT ended after 'quit'")
+	}
+
+	if strings.Join(typed(fs), ",") != "pwd,quit" {
+		t.Errorf("sent %q", typed(fs))
+	}
+	if !sh.hasQuit() {
+		t.Error("the shell would reconnect after 'quit'")
+	}
+}
+
+func TestFinalEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		resp      pssh.Response
+		wantFinal bool
+	}{
+		{"killed", pssh.Response{Type: "disconnect", Message: "Your session has been killed by 'root'.", Data: []byte(`{"reason":"killed"}`)}, true},
+		{"login timeout", pssh.Response{Type: "disconnect", Message: "You have NOT logged in within 1m0s. Disconnecting.", Data: []byte(`{"reason":"login-timeout"}`)}, true},
+		{"shutdown", pssh.Response{Type: "disconnect", Message: "Your session has been closed.", Data: []byte(`{"reason":"shutdown"}`)}, false},
+		{"like a kill", pssh.Response{Type: "event", Message: "Your session has been killed by 'root'."}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sh, _ := newTestShell()
+			sh.event(tt.resp)
+			if sh.hasQuit() != tt.wantFinal {
+				t.Errorf("final %v, want %v", sh.hasQuit(), tt.wantFinal)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"clientPSSH/pssh"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queryTimeout is how long the server gets to answer the completions and the
+// state of the prompt.
+const queryTimeout = time.Second
+
+var commandNames = []string{
+	"reg", "chpswd", "login", "pwd", "write", "read", "ls", "logout", "help",
+	"rmuser", "lsusers", "quit", "addgroup", "u2g", "trimgroup", "rmgroup",
+	"rr", "chmod", "append", "chmark", "gm", "watch", "replay", "who",
+	"sessions", "kill", "unlock", "keylogin", "keyauth", "addkey", "lskey",
+	"rmkey", "otp", "2fa", "passwd", "reload", "resume", "put", "get", "mkdir",
+	"chgrp", "rm",
+}
+
+// Commands after which the prompt is refreshed from the server.
+var stateCommands = map[string]bool{
+	"login": true, "logout": true, "keylogin": true, "keyauth": true,
+	"otp": true, "passwd": true, "resume": true,
+}
+
+// argKind tells what the argument i (from 1) of a command is.
+func argKind(args []string, i int) string {
+	switch args[0] {
+	case "read", "write", "append", "ls", "chmod", "rr", "put", "get", "mkdir", "rm":
+		if i == 1 {
+			return "path"
+		}
+
+	case "chgrp":
+		switch i {
+		case 1:
+			return "path"
+		case 2:
+			return "group"
+		}
+
+	case "login", "keylogin", "rmuser", "chpswd", "unlock":
+		if i == 1 {
+			return "user"
+		}
+
+	case "u2g", "trimgroup":
+		switch i {
+		case 1:
+			return "group"
+		case 2:
+			return "user"
+		}
+
+	case "rmgroup":
+		if i == 1 {
+			return "group"
+		}
+
+	case "chmark", "gm", "watch":
+		switch {
+		case i == 1:
+			return "kind"
+		case i == 2 && args[1] == "f":
+			return "path"
+		case i == 2 && args[1] == "u":
+			return "user"
+		case i == 2 && args[1] == "g":
+			return "group"
+		}
+	}
+
+	return ""
+}
+
+func matchPrefix(names []string, prefix string) []string {
+	var matched []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+
+	return matched
+}
+
+// complete returns the candidates for the last word of line. Command names
+// are known locally, paths, users and groups are asked from the server.
+func (sh *shell) complete(client *pssh.Client, line string) []string {
+	args := strings.Split(line, " ")
+	word := args[len(args)-1]
+	if len(args) == 1 {
+		return matchPrefix(commandNames, word)
+	}
+
+	kind := argKind(args, len(args)-1)
+	switch kind {
+	case "":
+		return nil
+	case "kind":
+		return matchPrefix([]string{"f", "u", "g"}, word)
+	}
+
+	sh.stateMu.Lock()
+	ready := sh.nick != "" && sh.remote
+	sh.stateMu.Unlock()
+	if !ready {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	names, err := client.Complete(ctx, kind, word)
+	if err != nil {
+		sh.completeFailed(err)
+		return nil
+	}
+	return names
+}
+
+// completeFailed stops asking the server for completions if the listener
+// does NOT allow "complete".
+func (sh *shell) completeFailed(err error) {
+	if errors.Is(err, pssh.ErrForbidden) || errors.Is(err, pssh.ErrBadRequest) {
+		sh.stateMu.Lock()
+		sh.remote = false
+		sh.stateMu.Unlock()
+	}
+}
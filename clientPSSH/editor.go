@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const historySize = 1000
+
+var errInterrupt = errors.New("interrupted")
+
+// lineEditor reads lines from a raw terminal with readline-like editing:
+// arrows, Home/End, Ctrl+A/E/B/F/K/U/W/L/P/N, history and Tab completion.
+// Output of the server is printed above the line being edited.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	mu     sync.Mutex
+	prompt string
+	buf    []rune
+	pos    int
+	active bool // a line is being edited
+
+	history  []string
+	histPos  int
+	histFile string
+
+	// complete returns the candidates for the last word of line.
+	complete func(line string) []string
+}
+
+func newLineEditor(in io.Reader, out io.Writer, histFile string) *lineEditor {
+	e := &lineEditor{
+		in:       bufio.NewReader(in),
+		out:      out,
+		histFile: histFile,
+	}
+	e.loadHistory()
+
+	return e
+}
+
+func (e *lineEditor) setPrompt(prompt string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.prompt = prompt
+	if e.active {
+		e.redraw()
+	}
+}
+
+// printAbove prints text, which may be several lines, above the edited line.
+func (e *lineEditor) printAbove(text string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The terminal is raw, "\n" does NOT return the cursor.
+	text = strings.ReplaceAll(strings.TrimSuffix(text, "\n"), "\n", "\r\n") + "\r\n"
+
+	if !e.active {
+		fmt.Fprint(e.out, text)
+		return
+	}
+
+	fmt.Fprint(e.out, "\r\x1b[K"+text)
+	e.redraw()
+}
+
+// redraw must be called with mu held.
+func (e *lineEditor) redraw() {
+	fmt.Fprint(e.out, "\r\x1b[K"+e.prompt+string(e.buf))
+	if back := len(e.buf) - e.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (e *lineEditor) readLine() (string, error) {
+	e.mu.Lock()
+	e.buf = e.buf[:0]
+	e.pos = 0
+	e.histPos = len(e.history)
+	e.active = true
+	e.redraw()
+	e.mu.Unlock()
+
+	defer func() {
+		e.mu.Lock()
+		e.active = false
+		e.mu.Unlock()
+	}()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		e.mu.Lock()
+		line, done, err := e.key(r)
+		e.mu.Unlock()
+		if err != nil || done {
+			return line, err
+		}
+	}
+}
+
+// waitInterrupt reads the keys until Ctrl+C, which it reports, or the end
+// of the input.
+func (e *lineEditor) waitInterrupt() bool {
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return false
+		}
+		if r == 3 {
+			fmt.Fprint(e.out, "^C\r\n")
+			return true
+		}
+	}
+}
+
+// key handles one key press. It must be called with mu held.
+func (e *lineEditor) key(r rune) (string, bool, error) {
+	switch r {
+	case '\r', '\n':
+		line := string(e.buf)
+		fmt.Fprint(e.out, "\r\n")
+		e.addHistory(line)
+		return line, true, nil
+
+	case 3: // Ctrl+C
+		fmt.Fprint(e.out, "^C\r\n")
+		return "", true, errInterrupt
+
+	case 4: // Ctrl+D
+		if len(e.buf) == 0 {
+			fmt.Fprint(e.out, "\r\n")
+			return "", true, io.EOF
+		}
+		e.deleteAt(e.pos)
+
+	case 127, 8: // Backspace
+		if e.pos > 0 {
+			e.pos--
+			e.deleteAt(e.pos)
+		}
+
+	case 1: // Ctrl+A
+		e.pos = 0
+	case 5: // Ctrl+E
+		e.pos = len(e.buf)
+	case 2: // Ctrl+B
+		e.left()
+	case 6: // Ctrl+F
+		e.right()
+
+	case 11: // Ctrl+K
+		e.buf = e.buf[:e.pos]
+
+	case 21: // Ctrl+U
+		e.buf = append(e.buf[:0], e.buf[e.pos:]...)
+		e.pos = 0
+
+	case 23: // Ctrl+W
+		start := e.pos
+		for start > 0 && e.buf[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && e.buf[start-1] != ' ' {
+			start--
+		}
+		e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+		e.pos = start
+
+	case 12: // Ctrl+L
+		fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+
+	case 16: // Ctrl+P
+		e.historyStep(-1)
+	case 14: // Ctrl+N
+		e.historyStep(1)
+
+	case '\t':
+		e.tab()
+
+	case 27: // ESC, an escape sequence follows
+		e.escape()
+
+	default:
+		if r < 32 {
+			return "", false, nil
+		}
+		e.buf = append(e.buf, 0)
+		copy(e.buf[e.pos+1:], e.buf[e.pos:])
+		e.buf[e.pos] = r
+		e.pos++
+	}
+
+	e.redraw()
+	return "", false, nil
+}
+
+func (e *lineEditor) escape() {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return
+	}
+
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return
+	}
+
+	switch r {
+	case 'A':
+		e.historyStep(-1)
+	case 'B':
+		e.historyStep(1)
+	case 'C':
+		e.right()
+	case 'D':
+		e.left()
+	case 'H':
+		e.pos = 0
+	case 'F':
+		e.pos = len(e.buf)
+	case '1', '3', '4', '7', '8': // e.g. ESC [ 3 ~ for Delete
+		if next, _, _ := e.in.ReadRune(); next != '~' {
+			return
+		}
+		switch r {
+		case '1', '7':
+			e.pos = 0
+		case '4', '8':
+			e.pos = len(e.buf)
+		case '3':
+			e.deleteAt(e.pos)
+		}
+	}
+}
+
+func (e *lineEditor) left() {
+	if e.pos > 0 {
+		e.pos--
+	}
+}
+
+func (e *lineEditor) right() {
+	if e.pos < len(e.buf) {
+		e.pos++
+	}
+}
+
+func (e *lineEditor) deleteAt(i int) {
+	if i < len(e.buf) {
+		e.buf = append(e.buf[:i], e.buf[i+1:]...)
+	}
+}
+
+func (e *lineEditor) historyStep(step int) {
+	i := e.histPos + step
+	if i < 0 || i > len(e.history) {
+		return
+	}
+
+	e.histPos = i
+	if i == len(e.history) {
+		e.buf = e.buf[:0]
+	} else {
+		e.buf = []rune(e.history[i])
+	}
+	e.pos = len(e.buf)
+}
+
+// tab completes the word before the cursor. A single candidate is taken
+// whole, several ones are listed after their common prefix is taken.
+func (e *lineEditor) tab() {
+	if e.complete == nil {
+		return
+	}
+
+	before := string(e.buf[:e.pos])
+	word := before[strings.LastIndex(before, " ")+1:]
+
+	// The server may be asked, so the line is NOT locked meanwhile.
+	e.mu.Unlock()
+	candidates := e.complete(before)
+	e.mu.Lock()
+
+	if len(candidates) == 0 {
+		fmt.Fprint(e.out, "\a")
+		return
+	}
+
+	insert := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(insert, "/") {
+		insert += " "
+	}
+
+	if len(insert) > len(word) && strings.HasPrefix(insert, word) {
+		add := []rune(insert[len(word):])
+		rest := append(add, e.buf[e.pos:]...)
+		e.buf = append(e.buf[:e.pos], rest...)
+		e.pos += len(add)
+		return
+	}
+
+	fmt.Fprint(e.out, "\r\x1b[K"+strings.Join(candidates, "  ")+"\r\n")
+}
+
+func commonPrefix(list []string) string {
+	prefix := list[0]
+	for _, s := range list[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+
+	return prefix
+}
+
+// Lines with passwords are kept for this session only, NOT in the file.
+func isSecret(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch fields[0] {
+	case "login", "reg", "chpswd", "passwd", "otp", "resume":
+		return true
+	}
+
+	return false
+}
+
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if len(e.history) > historySize {
+		e.history = e.history[len(e.history)-historySize:]
+	}
+
+	if e.histFile == "" || isSecret(line) {
+		return
+	}
+
+	f, err := os.OpenFile(e.histFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	_, _ = f.WriteString(line + "\n")
+	_ = f.Close()
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.histFile == "" {
+		return
+	}
+
+	content, err := os.ReadFile(e.histFile)
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > historySize {
+		lines = lines[len(lines)-historySize:]
+		_ = os.WriteFile(e.histFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, line := range lines {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+}
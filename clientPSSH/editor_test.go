@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		history []string
+		want    string
+		wantErr error
+	}{
+		{"plain", "ls .\r", nil, "ls .", nil},
+		{"backspace", "lss\x7f .\r", nil, "ls .", nil},
+		{"home and insert", "s .\x01l\r", nil, "ls .", nil},
+		{"left and delete", "ls x.\x1b[D\x1b[D\x1b[3~\r", nil, "ls .", nil},
+		{"kill to the end", "ls . -la\x1b[D\x1b[D\x1b[D\x1b[D\x0b\r", nil, "ls .", nil},
+		{"kill to the start", "rm ls .\x01\x1b[C\x1b[C\x1b[C\x15\r", nil, "ls .", nil},
+		{"kill a word", "ls docs \x17.\r", nil, "ls .", nil},
+		{"history", "\x1b[A\x1b[A\r", []string{"ls .", "pwd"}, "ls .", nil},
+		{"history down", "\x1b[A\x1b[A\x1b[B\r", []string{"ls .", "pwd"}, "pwd", nil},
+		{"interrupt", "ls\x03", nil, "", errInterrupt},
+		{"end of input", "\x04", nil, "", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newLineEditor(strings.NewReader(tt.keys), io.Discard, "")
+			e.history = tt.history
+
+			line, err := e.readLine()
+			if line != tt.want || err != tt.wantErr {
+				t.Errorf("got %q, %v, want %q, %v", line, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTab(t *testing.T) {
+	tests := []struct {
+		name       string
+		keys       string
+		candidates []string
+		want       string
+	}{
+		{"single", "read da\t\r", []string{"data.txt"}, "read data.txt "},
+		{"directory", "ls do\t\r", []string{"docs/"}, "ls docs/"},
+		{"common prefix", "read d\t\r", []string{"data.txt", "date.txt"}, "read dat"},
+		{"common prefix of runes", "read \t\r", []string{"файл", "фото"}, "read ф"},
+		{"none", "read x\t\r", nil, "read x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newLineEditor(strings.NewReader(tt.keys), io.Discard, "")
+			e.complete = func(line string) []string { return tt.candidates }
+
+			if line, _ := e.readLine(); line != tt.want {
+				t.Errorf("got %q, want %q", line, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintAbove(t *testing.T) {
+	var out strings.Builder
+	e := newLineEditor(strings.NewReader(""), &out, "")
+
+	e.printAbove("Usage:\n  ls [path]\n")
+	e.printAbove("done")
+	if want := "Usage:\r\n  ls [path]\r\ndone\r\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	histFile := filepath.Join(t.TempDir(), "history")
+
+	e := newLineEditor(strings.NewReader("ls .\rlogin root secret\rls .\rpwd\r"), io.Discard, histFile)
+	for i := 0; i < 4; i++ {
+		if _, err := e.readLine(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(e.history) != 4 {
+		t.Errorf("history of the session %q", e.history)
+	}
+
+	content, _ := os.ReadFile(histFile)
+	if got := string(content); got != "ls .\nls .\npwd\n" {
+		t.Errorf("history file %q", got)
+	}
+
+	e = newLineEditor(strings.NewReader(""), io.Discard, histFile)
+	if strings.Join(e.history, ",") != "ls .,ls .,pwd" {
+		t.Errorf("loaded history %q", e.history)
+	}
+}
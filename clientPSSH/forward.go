@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"clientPSSH/pssh"
+)
+
+// forwardFlag collects the specs of -L or -R, which may be repeated.
+type forwardFlag []string
+
+func (f *forwardFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *forwardFlag) Set(spec string) error {
+	*f = append(*f, spec)
+	return nil
+}
+
+// forward is "[bind:]port:host:hostport", as "ssh -L" and "ssh -R" take it.
+type forward struct {
+	spec   string
+	listen string // bind:port
+	target string // host:hostport
+}
+
+// parseForward splits a spec at the colons outside of brackets, so that
+// IPv6 addresses are written "[::1]".
+func parseForward(spec string, bind string) (forward, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, spec[start:])
+
+	if len(parts) == 4 {
+		bind, parts = strings.Trim(parts[0], "[]"), parts[1:]
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return forward{}, fmt.Errorf("'%s' must be \"[bind:]port:host:hostport\"", spec)
+	}
+
+	return forward{
+		spec:   spec,
+		listen: net.JoinHostPort(bind, parts[0]),
+		target: net.JoinHostPort(strings.Trim(parts[1], "[]"), parts[2]),
+	}, nil
+}
+
+// forwarder holds the tunnels of -L and -R open until it is interrupted or
+// the connection is closed, as "ssh -N" does.
+type forwarder struct {
+	timeout   time.Duration
+	key       crypto.Signer
+	tlsConfig *tls.Config
+	user      string
+	pswd      string
+	locals    []forward
+	remotes   []forward
+
+	client *pssh.Client
+}
+
+func (f *forwarder) run(addr string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	client, err := pssh.Dial(ctx, addr, &pssh.Config{TLSConfig: f.tlsConfig})
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %s\n", err.Error())
+		return exitConnection
+	}
+	defer client.Close()
+	f.client = client
+
+	if err := logIn(client, f.user, f.key, f.pswd, f.timeout); err != nil {
+		return loginFailed(err)
+	}
+
+	/* Local listeners, each connection to them gets a tunnel. */
+	for _, fw := range f.locals {
+		ln, err := net.Listen("tcp", fw.listen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-L %s: %s\n", fw.spec, err.Error())
+			return exitCmdFailed
+		}
+		defer ln.Close()
+
+		go f.serveLocal(ln, fw)
+		fmt.Fprintf(os.Stderr, "Forwarding '%s' to '%s' through the server.\n", ln.Addr(), fw.target)
+	}
+
+	/* Listeners on the server, each connection to them is dialed here. */
+	for _, fw := range f.remotes {
+		ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+		l, err := client.ListenTunnel(ctx, fw.listen)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-R %s: %s\n", fw.spec, errText(err))
+			return forwardFailed(err)
+		}
+
+		go f.serveRemote(l, fw)
+		fmt.Fprintf(os.Stderr, "Forwarding '%s' of the server to '%s'.\n", l.Addr(), fw.target)
+	}
+	fmt.Fprintln(os.Stderr, "To stop forwarding press CTRL+C.")
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case <-stop:
+		return exitOK
+	case <-client.Done():
+		fmt.Fprintln(os.Stderr, "The connection has been closed.")
+		return exitConnection
+	}
+}
+
+func (f *forwarder) serveLocal(ln net.Listener, fw forward) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+			t, err := f.client.DialTunnel(ctx, fw.target)
+			cancel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-L %s: %s\n", fw.spec, errText(err))
+				_ = conn.Close()
+				return
+			}
+			pipe(conn, t)
+		}()
+	}
+}
+
+func (f *forwarder) serveRemote(l *pssh.TunnelListener, fw forward) {
+	for {
+		t, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, err := net.DialTimeout("tcp", fw.target, f.timeout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-R %s: %s\n", fw.spec, err.Error())
+				_ = t.Close()
+				return
+			}
+			pipe(conn, t)
+		}()
+	}
+}
+
+// pipe copies both ways until both ends are done. An end that stops
+// writing is only half closed, the other one may still answer.
+func pipe(conn net.Conn, t *pssh.Tunnel) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(t, conn)
+		_ = t.CloseWrite()
+		close(done)
+	}()
+
+	_, _ = io.Copy(conn, t)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	<-done
+
+	_ = conn.Close()
+	_ = t.Close()
+}
+
+// forwardFailed returns the exit code of a tunnel the server has refused.
+func forwardFailed(err error) int {
+	var failure *pssh.Error
+	if errors.As(err, &failure) || errors.Is(err, pssh.ErrBadArgument) {
+		return exitCmdFailed
+	}
+	return exitConnection
+}
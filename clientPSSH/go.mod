@@ -2,6 +2,6 @@ module clientPSSH
 
 go 1.19
 
-require github.com/reiver/go-telnet v0.0.0-20180421082511-9ff0b2ab096e
+require golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
 
-require github.com/reiver/go-oi v1.0.0 // indirect
+require golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10 // indirect
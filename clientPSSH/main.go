@@ -2,54 +2,351 @@ package main
 
 import (
 	"C"
+	"clientPSSH/pssh"
 	"flag"
 	"fmt"
-	"github.com/reiver/go-telnet"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
+
+	"golang.org/x/term"
 )
 
 func main() {
-	if len(os.Args) < 3 {
+	help := flag.Bool("help", false, "Display help")
+	configFile := flag.String("config", pssh.DefaultConfigPath(), "File of named profiles, like ~/.ssh/config")
+	port := flag.String("p", pssh.DefaultPort, "Port of the server")
+	user := flag.String("l", "", "User to log in as, right after connecting")
+	keyFile := flag.String("key", "", "Private key (PKCS#8 PEM) to answer 'keylogin' challenges with")
+	useTLS := flag.Bool("tls", false, "Connect to a TLS listener")
+	tlsCA := flag.String("tls-ca", "", "With -tls, PEM file of the CA certificates to trust")
+	tlsServerName := flag.String("tls-server-name", "", "With -tls, name to verify the server's certificate against")
+	tlsInsecure := flag.Bool("tls-insecure", false, "With -tls, do NOT verify the server's certificate")
+	passwordEnv := flag.String("password-env", pssh.DefaultPasswordEnv, "Environment variable to take the password of -l from")
+	commandLine := flag.String("c", "", `Commands to run, separated by ';', e.g. "lsusers; who"`)
+	scriptFile := flag.String("f", "", "Script to run, one command per line, '-' for stdin")
+	keepGoing := flag.Bool("continue", false, "With -c or -f, go on after a command has failed")
+	reconnects := flag.Int("reconnect", 5, "Times to reconnect after the connection has dropped, 0 disables it")
+	timeout := flag.Duration("timeout", 30*time.Second, "Time the server gets to answer a command")
+	browse := flag.Bool("browse", false, "Browse the remote files full-screen, see -help")
+	browseDir := flag.String("browse-dir", ".", "With -browse, remote directory to start in, e.g. 'users/' for admins")
+	var locals, remotes forwardFlag
+	flag.Var(&locals, "L", "Forward '[bind:]port:host:hostport': connections to bind:port here go to host:hostport from the server, may be repeated")
+	flag.Var(&remotes, "R", "Forward '[bind:]port:host:hostport': connections to bind:port of the server go to host:hostport from here, may be repeated")
+	args := parseArgs()
+
+	if *help {
 		printHelpMsg()
 	}
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: clientPSSH [flags] [profile | host [port]], see -help.")
+		os.Exit(exitUsage)
+	}
 
-	ip := os.Args[1]
-	port := os.Args[2]
+	/* Profile, then positional arguments, then flags. */
+	p, err := pssh.LoadProfile(*configFile, args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if p.HostName == "" {
+		p.HostName = args[0]
+	}
+	if p.Port == "" {
+		p.Port = pssh.DefaultPort
+	}
+	if len(args) == 2 {
+		p.Port = args[1]
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			p.Port = *port
+		case "l":
+			p.User = *user
+		case "key":
+			p.KeyFile = *keyFile
+		case "tls":
+			p.TLS = *useTLS
+		case "tls-ca":
+			p.TLSCA = *tlsCA
+		case "tls-server-name":
+			p.TLSServerName = *tlsServerName
+		case "tls-insecure":
+			p.TLSInsecure = *tlsInsecure
+		case "password-env":
+			p.PasswordEnv = *passwordEnv
+		}
+	})
 
-	help := flag.Bool("help", false, "Display help")
-	flag.Parse()
+	tlsConfig, err := p.TLSConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
 
-	if *help {
-		printHelpMsg()
+	sh := &shell{timeout: *timeout, tlsConfig: tlsConfig}
+	if p.KeyFile != "" {
+		key, err := pssh.LoadPrivateKey(p.KeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		sh.key = key
+	}
+
+	/* Log in with the key if there is one, else with a password. */
+	pswd := ""
+	if p.User != "" && sh.key == nil {
+		if pswd, err = p.Password(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	addr := net.JoinHostPort(p.HostName, p.Port)
+	if len(locals) > 0 || len(remotes) > 0 {
+		if p.User == "" {
+			fmt.Fprintln(os.Stderr, "-L and -R need a user to log in as, see -l.")
+			os.Exit(exitUsage)
+		}
+		if *browse || *commandLine != "" || *scriptFile != "" {
+			fmt.Fprintln(os.Stderr, "-L and -R can NOT be used with -c, -f or -browse.")
+			os.Exit(exitUsage)
+		}
+
+		f := &forwarder{
+			timeout:   *timeout,
+			key:       sh.key,
+			tlsConfig: tlsConfig,
+			user:      p.User,
+			pswd:      pswd,
+		}
+		for _, spec := range locals {
+			fw, err := parseForward(spec, "localhost")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-L %s\n", err.Error())
+				os.Exit(exitUsage)
+			}
+			f.locals = append(f.locals, fw)
+		}
+		for _, spec := range remotes {
+			fw, err := parseForward(spec, "127.0.0.1")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "-R %s\n", err.Error())
+				os.Exit(exitUsage)
+			}
+			f.remotes = append(f.remotes, fw)
+		}
+		os.Exit(f.run(addr))
+	}
+	if *browse {
+		if p.User == "" {
+			fmt.Fprintln(os.Stderr, "-browse needs a user to log in as, see -l.")
+			os.Exit(exitUsage)
+		}
+		os.Exit((&browser{
+			timeout:   *timeout,
+			key:       sh.key,
+			tlsConfig: tlsConfig,
+			user:      p.User,
+			pswd:      pswd,
+			host:      p.HostName,
+			root:      *browseDir,
+		}).run(addr))
+	}
+	if *commandLine != "" || *scriptFile != "" {
+		os.Exit(runBatch(addr, *commandLine, *scriptFile, &batchRunner{
+			keepGoing: *keepGoing,
+			timeout:   *timeout,
+			key:       sh.key,
+			tlsConfig: tlsConfig,
+			user:      p.User,
+			pswd:      pswd,
+			out:       os.Stdout,
+		}))
+	}
+
+	sh.user, sh.pswd = p.User, pswd
+
+	/* Line editing, if stdin is a terminal. */
+	fd := int(os.Stdin.Fd())
+	restore := func() {}
+	if state, err := term.MakeRaw(fd); err == nil {
+		restore = func() { _ = term.Restore(fd, state) }
+		sh.host = p.HostName
+		sh.editor = newLineEditor(os.Stdin, os.Stdout, historyPath())
+	}
+	sh.exit = func(code int) {
+		restore()
+		os.Exit(code)
 	}
+	sh.readLines()
 
-	/* Handle CTRL+C. */
-	c := make(chan os.Signal)
+	/* Handle CTRL+C: quit the session, or exit at once the second time. */
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-c
-		fmt.Println("\nExiting.")
-		//os.Stdin.WriteString("\\quit\r\n")
-		//time.Sleep(5 * time.Second)
-		os.Exit(0)
+		for range c {
+			sh.leave(true)
+		}
 	}()
 
 	/* Client itself. */
-	fmt.Printf("Connecting to %s:%s\n", ip, port)
-	fmt.Println("To exit the program press CTRL+C.")
+	sh.print(fmt.Sprintf("Connecting to %s", addr))
+	sh.print("To exit the program press CTRL+C or CTRL+D.")
 
-	var caller telnet.Caller = telnet.StandardCaller
-	err := telnet.DialToAndCall(ip+":"+port, caller)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	/* A dropped connection is dialed again, the session is resumed. */
+	for attempt, connected := 0, false; ; {
+		err = sh.connect(addr)
+		if sh.hasQuit() {
+			break
+		}
+
+		if err == nil {
+			connected, attempt = true, 0
+		} else if !connected {
+			restore()
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		attempt++
+		if attempt > *reconnects {
+			if err != nil {
+				sh.print(fmt.Sprintf("Could NOT reconnect: %s", err.Error()))
+				restore()
+				os.Exit(1)
+			}
+			break
+		}
+
+		pause := reconnectPause(attempt)
+		sh.print(fmt.Sprintf("Connection lost. Reconnecting in %s (%d of %d).", pause, attempt, *reconnects))
+		select {
+		case <-time.After(pause):
+		case <-sh.leaving:
+		}
+		if sh.hasQuit() {
+			break
+		}
 	}
+
+	sh.stateMu.Lock()
+	quit := sh.quit
+	sh.stateMu.Unlock()
+	if !quit {
+		sh.print("Connection closed.")
+	}
+	restore()
+}
+
+// reconnectPause is 1s before the first attempt and doubles up to 30s.
+func reconnectPause(attempt int) time.Duration {
+	pause := time.Second << (attempt - 1)
+	if attempt > 6 || pause > 30*time.Second {
+		pause = 30 * time.Second
+	}
+
+	return pause
+}
+
+// parseArgs parses the flags wherever they are, e.g. after the host, and
+// returns the positional arguments.
+func parseArgs() []string {
+	var positional []string
+
+	args := os.Args[1:]
+	for {
+		_ = flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runBatch runs the commands of -c and of -f, in this order, and returns
+// the exit code.
+func runBatch(addr, commandLine, scriptFile string, b *batchRunner) int {
+	b.commands = parseCommandLine(commandLine)
+
+	if scriptFile != "" {
+		r := os.Stdin
+		if scriptFile != "-" {
+			f, err := os.Open(scriptFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitUsage
+			}
+			defer f.Close()
+			r = f
+		}
+
+		commands, err := parseScript(r, scriptFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		b.commands = append(b.commands, commands...)
+	}
+
+	return b.run(addr)
 }
 
 func printHelpMsg() {
 	fmt.Println("This program allows to connect to a pseudo ssh server.")
-	fmt.Println("Usage: Run './clientPSSH [ip] [port]' to connect to a server.")
+	fmt.Println("Usage: Run './clientPSSH [flags] [host] [port]' or './clientPSSH [flags] [profile]'")
+	fmt.Println("to connect to a server. Flags may also follow the host.")
+	fmt.Println("With -key, 'keylogin [nick]' challenges are answered automatically.")
+	fmt.Println()
+	fmt.Println("Profiles are read from ~/.pssh/config (see -config), written like ~/.ssh/config:")
+	fmt.Println("  Host prod-audit")
+	fmt.Println("      HostName audit.example.com")
+	fmt.Println("      Port 8888")
+	fmt.Println("      User auditor")
+	fmt.Println("      TLS yes")
+	fmt.Println("      TLSCA ~/.pssh/ca.pem")
+	fmt.Println("      KeyFile ~/.pssh/auditor.pem")
+	fmt.Println("Other settings: TLSServerName, TLSInsecure yes|no, PasswordEnv NAME. Flags")
+	fmt.Println("override the profile. With a user (User or -l) the client logs in right away:")
+	fmt.Println("with the key if there is one, else with the password of $PSSH_PASSWORD (see")
+	fmt.Println("-password-env) or, if it is NOT set, typed at a prompt.")
+	fmt.Println()
+	fmt.Println("If the connection drops, the client dials again (see -reconnect) and resumes the")
+	fmt.Println("session where it was, or logs in again if the server can NOT resume it.")
+	fmt.Println("In a terminal, lines can be edited, Up/Down walk the history and Tab completes")
+	fmt.Println("commands, paths, users and groups. The history is kept in ~/.pssh_history.")
+	fmt.Println()
+	fmt.Println("Browser: './clientPSSH -browse -l [nick] [host]' shows the remote tree on the left and")
+	fmt.Println("the owner, group, rights, mark, audit and text of the selected file on the right.")
+	fmt.Println("Keys: r read, c chmod, m chmark, w watch (audit on/off), d delete, R refresh, q quit.")
+	fmt.Println("Selecting a file reads it, so the reads of audited files are audited.")
+	fmt.Println()
+	fmt.Println("Forwarding: './clientPSSH -L 5432:db.lab:5432 -l [nick] [host]' forwards connections to")
+	fmt.Println("localhost:5432 to db.lab:5432 as the server sees it, -R 9000:localhost:80 forwards")
+	fmt.Println("connections to 127.0.0.1:9000 of the server to localhost:80 here. Both may be repeated")
+	fmt.Println("and run until CTRL+C. The server allows them by the 'forwarding' rules of its config.")
+	fmt.Println()
+	fmt.Println("Batch mode: './clientPSSH [-c \"cmd; cmd\"] [-f script.pssh] [-continue] [ip] [port]'")
+	fmt.Println("runs the commands and stops on the first failed one, unless -continue is given.")
+	fmt.Println("A script has one command per line, '#' starts a comment. Exit codes: 0 all the")
+	fmt.Println("commands succeeded, 1 a command failed, 2 bad usage or script, 3 connection error.")
+	fmt.Println()
+	flag.PrintDefaults()
 	os.Exit(0)
 }
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".pssh_history")
+}
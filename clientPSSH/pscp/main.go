@@ -0,0 +1,572 @@
+package main
+
+import (
+	"clientPSSH/pssh"
+	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes, as in the batch mode of clientPSSH.
+const (
+	exitOK         = 0
+	exitFailed     = 1 // a file could NOT be copied
+	exitUsage      = 2 // bad flags or arguments
+	exitConnection = 3 // the server is unreachable, closed the connection or timed out
+)
+
+var (
+	help          = flag.Bool("help", false, "Display help")
+	configFile    = flag.String("config", pssh.DefaultConfigPath(), "File of named profiles, like ~/.ssh/config")
+	port          = flag.String("P", "", "Port of the server")
+	keyFile       = flag.String("key", "", "Private key (PKCS#8 PEM) to log in with 'keylogin'")
+	useTLS        = flag.Bool("tls", false, "Connect to a TLS listener")
+	tlsCA         = flag.String("tls-ca", "", "With -tls, PEM file of the CA certificates to trust")
+	tlsServerName = flag.String("tls-server-name", "", "With -tls, name to verify the server's certificate against")
+	tlsInsecure   = flag.Bool("tls-insecure", false, "With -tls, do NOT verify the server's certificate")
+	passwordEnv   = flag.String("password-env", pssh.DefaultPasswordEnv, "Environment variable to take the password from")
+	recursive     = flag.Bool("r", false, "Copy directories with everything in them")
+	group         = flag.String("g", "", "Group to set on the uploaded files, instead of keeping the one of the old file")
+	rights        = flag.String("m", "", "Rights 'rwrw' to set on the uploaded files, e.g. 1110, instead of keeping the old ones")
+	mark          = flag.String("cm", "", "Mark to set on the uploaded files, instead of keeping the old one")
+	quiet         = flag.Bool("q", false, "Do NOT show the progress")
+	timeout       = flag.Duration("timeout", 30*time.Second, "Time the server gets to answer a command or to take the next chunk of a file")
+)
+
+var errTimeout = errors.New("the server did NOT answer in time")
+
+// remote is an argument "[user@]host:path", host may be a profile.
+type remote struct {
+	user string
+	host string
+	path string
+}
+
+// parseRemote returns false for a local path. "C:\x" or "./a:b" are local.
+func parseRemote(arg string) (remote, bool) {
+	host, p, ok := strings.Cut(arg, ":")
+	if !ok || host == "" || strings.ContainsAny(host, `/\`) || len(host) == 1 {
+		return remote{}, false
+	}
+
+	r := remote{host: host, path: p}
+	if user, h, ok := strings.Cut(host, "@"); ok {
+		r.user, r.host = user, h
+	}
+	return r, true
+}
+
+// serverPath maps a remote path to one the server takes. "/home/x" and
+// "~/x" are in the home of the user, the current directory after login.
+// Paths like "users/<nick>/home/x" are passed as they are.
+func serverPath(p string) string {
+	switch {
+	case p == "" || p == "~" || p == "/home" || p == "/home/":
+		return "."
+	case strings.HasPrefix(p, "/home/"):
+		return strings.TrimPrefix(p, "/home/")
+	case strings.HasPrefix(p, "~/"):
+		return strings.TrimPrefix(p, "~/")
+	}
+	return p
+}
+
+// attrs are set on the uploaded files. Unset ones are kept from the old file.
+type attrs struct {
+	group  string
+	rights string
+	mark   string
+}
+
+type copier struct {
+	client *pssh.Client
+	attrs  attrs
+	failed bool
+}
+
+func main() {
+	args := parseArgs()
+	if *help {
+		printHelpMsg()
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: pscp [flags] src... [user@]host:dst or pscp [flags] [user@]host:src... dst, see -help.")
+		os.Exit(exitUsage)
+	}
+
+	/* Either all the sources are remote, or the destination is. */
+	var target remote
+	var sources []string
+	var remotes []remote
+	dst, upload := parseRemote(args[len(args)-1])
+	if upload {
+		target = dst
+		for _, arg := range args[:len(args)-1] {
+			if _, ok := parseRemote(arg); ok {
+				usageError("copying between two servers is NOT supported")
+			}
+			sources = append(sources, arg)
+		}
+	} else {
+		for _, arg := range args[:len(args)-1] {
+			r, ok := parseRemote(arg)
+			if !ok {
+				usageError("one side must be local, the other remote: [user@]host:path")
+			}
+			if len(remotes) > 0 && (r.user != remotes[0].user || r.host != remotes[0].host) {
+				usageError("all the sources must be on the same server")
+			}
+			remotes = append(remotes, r)
+		}
+		target = remotes[0]
+	}
+
+	if *rights != "" {
+		if _, err := pssh.ParseRights(*rights); err != nil {
+			usageError(err.Error())
+		}
+	}
+	if *mark != "" {
+		if _, err := strconv.ParseUint(*mark, 10, 64); err != nil {
+			usageError(fmt.Sprintf("-cm must be a number, NOT '%s'", *mark))
+		}
+	}
+
+	client, code := connect(target)
+	if client == nil {
+		os.Exit(code)
+	}
+
+	c := &copier{client: client, attrs: attrs{*group, *rights, *mark}}
+	if upload {
+		into := len(sources) > 1 || c.isRemoteDir(serverPath(target.path))
+		for _, src := range sources {
+			c.upload(src, serverPath(target.path), into)
+		}
+	} else {
+		local := args[len(args)-1]
+		info, err := os.Stat(local)
+		into := len(remotes) > 1 || (err == nil && info.IsDir())
+		if len(remotes) > 1 && !into {
+			usageError(fmt.Sprintf("'%s' must be a directory", local))
+		}
+		for _, r := range remotes {
+			c.download(serverPath(r.path), local, into)
+		}
+	}
+
+	_ = c.run(client.Logout)
+	client.Close()
+
+	if c.failed {
+		os.Exit(exitFailed)
+	}
+	os.Exit(exitOK)
+}
+
+func usageError(text string) {
+	fmt.Fprintf(os.Stderr, "pscp: %s\n", text)
+	os.Exit(exitUsage)
+}
+
+// parseArgs parses the flags wherever they are and returns the positional
+// arguments.
+func parseArgs() []string {
+	var positional []string
+
+	args := os.Args[1:]
+	for {
+		_ = flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// connect dials the server of r and logs in. It returns nil and the exit
+// code on failure.
+func connect(r remote) (*pssh.Client, int) {
+	/* Profile, then the argument, then flags. */
+	p, err := pssh.LoadProfile(*configFile, r.host)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitUsage
+	}
+	if p.HostName == "" {
+		p.HostName = r.host
+	}
+	if p.Port == "" {
+		p.Port = pssh.DefaultPort
+	}
+	if r.user != "" {
+		p.User = r.user
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "P":
+			p.Port = *port
+		case "key":
+			p.KeyFile = *keyFile
+		case "tls":
+			p.TLS = *useTLS
+		case "tls-ca":
+			p.TLSCA = *tlsCA
+		case "tls-server-name":
+			p.TLSServerName = *tlsServerName
+		case "tls-insecure":
+			p.TLSInsecure = *tlsInsecure
+		case "password-env":
+			p.PasswordEnv = *passwordEnv
+		}
+	})
+	if p.User == "" {
+		fmt.Fprintf(os.Stderr, "pscp: no user to log in as, use user@%s:path or User in a profile\n", r.host)
+		return nil, exitUsage
+	}
+
+	tlsConfig, err := p.TLSConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitUsage
+	}
+
+	var key crypto.Signer
+	pswd := ""
+	if p.KeyFile != "" {
+		if key, err = pssh.LoadPrivateKey(p.KeyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, exitUsage
+		}
+	} else if pswd, err = p.Password(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(p.HostName, p.Port)
+	client, err := pssh.Dial(ctx, addr, &pssh.Config{TLSConfig: tlsConfig})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %s\n", err.Error())
+		return nil, exitConnection
+	}
+
+	if key != nil {
+		err = client.KeyLogin(ctx, p.User, key)
+	} else {
+		err = client.Login(ctx, p.User, pswd)
+	}
+	if err != nil {
+		client.Close()
+		fmt.Fprintf(os.Stderr, "login: %s\n", err.Error())
+		var failure *pssh.Error
+		if errors.As(err, &failure) {
+			return nil, exitFailed
+		}
+		return nil, exitConnection
+	}
+
+	return client, exitOK
+}
+
+// fail reports a file that could NOT be copied. The other files are still
+// copied, unless the connection is gone.
+func (c *copier) fail(name string, err error) {
+	c.failed = true
+	fmt.Fprintf(os.Stderr, "pscp: %s: %s\n", name, err.Error())
+
+	select {
+	case <-c.client.Done():
+		os.Exit(exitConnection)
+	default:
+	}
+	if errors.Is(err, errTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		c.client.Close()
+		os.Exit(exitConnection)
+	}
+}
+
+// run runs a command with -timeout, again while the server refuses it as
+// too fast.
+func (c *copier) run(cmd func(ctx context.Context) error) error {
+	return pssh.Retry(context.Background(), *timeout, cmd)
+}
+
+func (c *copier) isRemoteDir(dir string) bool {
+	err := c.run(func(ctx context.Context) error {
+		_, err := c.client.Ls(ctx, dir)
+		return err
+	})
+	return err == nil
+}
+
+func (c *copier) upload(src, dst string, into bool) {
+	if into {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	if !info.IsDir() {
+		c.putFile(src, dst)
+		return
+	}
+	if !*recursive {
+		c.fail(src, errors.New("is a directory, use -r"))
+		return
+	}
+
+	err = c.run(func(ctx context.Context) error {
+		return c.client.Mkdir(ctx, dst)
+	})
+	if err != nil {
+		c.fail(dst, err)
+		return
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+	for _, e := range entries {
+		c.upload(filepath.Join(src, e.Name()), path.Join(dst, e.Name()), false)
+	}
+}
+
+// putFile uploads one file and sets the group, rights and mark of the
+// flags. Those the file already had are kept by the server.
+func (c *copier) putFile(src, dst string) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		c.fail(src, err)
+		return
+	}
+
+	p := newProgress(dst)
+	if err := c.transfer(func(ctx context.Context, progress pssh.Progress) error {
+		return c.client.Put(ctx, dst, data, progress)
+	}, p.update); err != nil {
+		p.done(false)
+		c.fail(dst, err)
+		return
+	}
+	p.done(true)
+
+	if c.attrs == (attrs{}) {
+		return
+	}
+	if err := c.setAttrs(dst, c.attrs); err != nil {
+		c.fail(dst, err)
+	}
+}
+
+// setAttrs changes only what differs from the file as it is now.
+func (c *copier) setAttrs(file string, want attrs) error {
+	var now *pssh.FileInfo
+	err := c.run(func(ctx context.Context) (err error) {
+		now, err = c.client.Stat(ctx, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if want.group != "" && want.group != now.Group {
+		err := c.run(func(ctx context.Context) error {
+			return c.client.Chgrp(ctx, file, want.group)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if want.rights != "" && want.rights != pssh.FormatRights(now.Rights) {
+		err := c.run(func(ctx context.Context) error {
+			return c.client.Chmod(ctx, file, want.rights)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if want.mark != "" && want.mark != strconv.FormatUint(now.Mark, 10) {
+		m, _ := strconv.ParseUint(want.mark, 10, 64)
+		err := c.run(func(ctx context.Context) error {
+			return c.client.Chmark(ctx, pssh.MarkFile, file, m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *copier) download(src, dst string, into bool) {
+	if into {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	var entries []pssh.Entry
+	err := c.run(func(ctx context.Context) (err error) {
+		entries, err = c.client.Ls(ctx, src)
+		return err
+	})
+	if err != nil {
+		c.getFile(src, dst)
+		return
+	}
+	if !*recursive {
+		c.fail(src, errors.New("is a directory, use -r"))
+		return
+	}
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		c.fail(dst, err)
+		return
+	}
+	for _, e := range entries {
+		local, err := localPath(dst, e.Name)
+		if err != nil {
+			c.fail(path.Join(src, e.Name), err)
+			continue
+		}
+		c.download(path.Join(src, e.Name), local, false)
+	}
+}
+
+// localPath joins dst and the name of an entry the server has listed. The
+// name must NOT lead out of dst, whatever the server sends.
+func localPath(dst, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("the server has sent an unsafe name %q", name)
+	}
+
+	local := filepath.Join(dst, name)
+	if rel, err := filepath.Rel(dst, local); err != nil || rel != name {
+		return "", fmt.Errorf("the server has sent an unsafe name %q", name)
+	}
+	return local, nil
+}
+
+func (c *copier) getFile(src, dst string) {
+	p := newProgress(src)
+
+	var data []byte
+	if err := c.transfer(func(ctx context.Context, progress pssh.Progress) (err error) {
+		data, err = c.client.Get(ctx, src)
+		return err
+	}, nil); err != nil {
+		p.done(false)
+		c.fail(src, err)
+		return
+	}
+	p.update(len(data), len(data))
+
+	if err := os.WriteFile(dst, data, 0o644); err != nil {
+		p.done(false)
+		c.fail(dst, err)
+		return
+	}
+	p.done(true)
+}
+
+// transfer runs a copy, which fails if the server takes more than -timeout
+// for a chunk, NOT for the whole file.
+func (c *copier) transfer(run func(ctx context.Context, progress pssh.Progress) error, progress pssh.Progress) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stalled := time.AfterFunc(*timeout, cancel)
+	defer stalled.Stop()
+
+	err := run(ctx, func(done, total int) {
+		stalled.Reset(*timeout)
+		if progress != nil {
+			progress(done, total)
+		}
+	})
+	if errors.Is(err, context.Canceled) {
+		err = errTimeout
+	}
+	return err
+}
+
+// progress is a line on stderr, rewritten as the file goes. If stderr is
+// NOT a terminal, only the last state is written.
+type progress struct {
+	name     string
+	line     string
+	terminal bool
+}
+
+func newProgress(name string) *progress {
+	info, err := os.Stderr.Stat()
+	return &progress{name: name, terminal: err == nil && info.Mode()&os.ModeCharDevice != 0}
+}
+
+func (p *progress) update(done, total int) {
+	if *quiet {
+		return
+	}
+
+	percent := 100
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	p.line = fmt.Sprintf("%-40s %3d%% %10d bytes", p.name, percent, done)
+	if p.terminal {
+		fmt.Fprint(os.Stderr, "\r"+p.line)
+	}
+}
+
+func (p *progress) done(ok bool) {
+	if *quiet || p.line == "" {
+		return
+	}
+	if !p.terminal {
+		fmt.Fprint(os.Stderr, p.line)
+	}
+	if !ok {
+		fmt.Fprintln(os.Stderr, " failed")
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+func printHelpMsg() {
+	fmt.Println("pscp copies files between this computer and a pseudo ssh server.")
+	fmt.Println("Usage: pscp [flags] local... [user@]host:remote")
+	fmt.Println("       pscp [flags] [user@]host:remote... local")
+	fmt.Println()
+	fmt.Println("host may be a profile of ~/.pssh/config (see clientPSSH -help), the user may")
+	fmt.Println("then come from it. The password is taken from $PSSH_PASSWORD (see -password-env)")
+	fmt.Println("or typed at a prompt, unless a key is given.")
+	fmt.Println()
+	fmt.Println("Remote paths are in the home of the user: '/home/x.txt', '~/x.txt' and 'x.txt'")
+	fmt.Println("are the same file. Admins may give paths like 'users/<nick>/home/x.txt'.")
+	fmt.Println("The destination is a directory if it exists as one or if there are several")
+	fmt.Println("sources. With -r, directories are copied with everything in them.")
+	fmt.Println()
+	fmt.Println("An uploaded file keeps the group, rights and mark of the file it replaces,")
+	fmt.Println("unless -g, -m or -cm are given. Exit codes: 0 all the files were copied, 1 a")
+	fmt.Println("file could NOT be copied, 2 bad usage, 3 connection error.")
+	fmt.Println()
+	flag.PrintDefaults()
+	os.Exit(0)
+}
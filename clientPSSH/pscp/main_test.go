@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	dst := filepath.Join("tmp", "copy")
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"a.txt", filepath.Join(dst, "a.txt"), false},
+		{"..a", filepath.Join(dst, "..a"), false},
+		{"", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{"../../.bashrc", "", true},
+		{"docs/a.txt", "", true},
+		{`..\evil`, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := localPath(dst, tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("localPath(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Package pssh is a client of the PseudoSSH server. It speaks the server's
+// json protocol, so every call gets a typed result or an *Error.
+//
+// A Client is safe for use by several goroutines. The server runs the
+// commands of one session one after another, in the order they were sent.
+package pssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config of a connection. The zero value connects over plain TCP.
+type Config struct {
+	// TLSConfig, if set, is used to connect to a TLS listener.
+	TLSConfig *tls.Config
+
+	// OnEvent, if set, gets the messages that are NOT answers to requests.
+	// The end of the session by the server, e.g. a kill, is of type
+	// "disconnect", see Response.Reason. It must NOT block.
+	OnEvent func(Response)
+}
+
+// Response is a frame of the json protocol.
+type Response struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Status  int             `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Client is a session on a PseudoSSH server.
+type Client struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	onEvent  func(Response)
+	greeting []string
+
+	wmu sync.Mutex // writes
+
+	nextID  uint64
+	mu      sync.Mutex
+	pending map[string]chan Response
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // why the connection is closed
+
+	// See tunnel.go.
+	tmu       sync.Mutex
+	tunnels   map[string]*Tunnel
+	listeners map[string]*TunnelListener
+	early     map[string][]tunnelEvent // events of ids NOT known yet
+}
+
+// Dial connects to addr, e.g. "host:8888", or "unix:/path/to.sock" for a
+// unix socket listener, and switches the session to the json protocol.
+func Dial(ctx context.Context, addr string, cfg *Config) (*Client, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLSConfig != nil {
+		tlsConfig := cfg.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" && network == "tcp" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c, err := NewClient(ctx, conn, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewClient starts a session on an open connection.
+func NewClient(ctx context.Context, conn net.Conn, cfg *Config) (*Client, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	c := &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		onEvent: cfg.OnEvent,
+		pending: make(map[string]chan Response),
+		closed:  make(chan struct{}),
+
+		tunnels:   make(map[string]*Tunnel),
+		listeners: make(map[string]*TunnelListener),
+		early:     make(map[string][]tunnelEvent),
+	}
+
+	if err := c.handshake(ctx); err != nil {
+		return nil, err
+	}
+
+	go c.readFrames()
+	return c, nil
+}
+
+// handshake asks for the json protocol. The server may greet first, in text.
+func (c *Client) handshake(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := c.conn.Write([]byte("proto json\n")); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("pssh: no answer to the protocol request: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if !strings.HasPrefix(line, "{") {
+			if strings.HasPrefix(line, "Error: ") || strings.HasPrefix(line, "> Connection refused") {
+				return fmt.Errorf("pssh: %s", strings.TrimPrefix(line, "> "))
+			}
+			c.greeting = append(c.greeting, strings.TrimPrefix(line, "> "))
+			continue
+		}
+
+		var resp Response
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			return fmt.Errorf("pssh: bad frame: %w", err)
+		}
+		if resp.Type != "response" {
+			continue
+		}
+
+		return responseError(&resp)
+	}
+}
+
+// Greeting returns what the server said before the session began, e.g. its
+// banner.
+func (c *Client) Greeting() []string {
+	return c.greeting
+}
+
+func (c *Client) readFrames() {
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			continue
+		}
+
+		if resp.Type == "tunnel" {
+			c.tunnelFrame(&resp)
+			continue
+		}
+
+		if resp.Type == "event" || resp.Type == "disconnect" {
+			if c.onEvent != nil {
+				c.onEvent(resp)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = fmt.Errorf("%w: %s", ErrClosed, err.Error())
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+// Close quits the session and closes the connection.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, _ = c.Exec(ctx, "quit")
+	c.shutdown(errors.New("closed by the client"))
+	return nil
+}
+
+// Done is closed when the connection is gone.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Exec runs a raw command line and returns the server's response. If the
+// command has failed, the error is an *Error and the response is returned
+// too.
+func (c *Client) Exec(ctx context.Context, line string) (*Response, error) {
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("%w: a command can NOT contain a line break", ErrBadArgument)
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&c.nextID, 1), 10)
+	ch := make(chan Response, 1)
+
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}
+
+	if err := c.send(ctx, id+" "+line+"\n"); err != nil {
+		forget()
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return &resp, responseError(&resp)
+
+	case <-ctx.Done():
+		// The server still runs the command, its answer is dropped.
+		forget()
+		return nil, ctx.Err()
+
+	case <-c.closed:
+		forget()
+		return nil, c.err
+	}
+}
+
+func (c *Client) send(ctx context.Context, line string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.closed:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	} else {
+		_ = c.conn.SetWriteDeadline(time.Time{})
+	}
+
+	n, err := c.conn.Write([]byte(line))
+	var netErr net.Error
+	if n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+		return ctx.Err() // nothing is sent, the connection is still fine
+	}
+	if err != nil {
+		// Half a line would be joined with the next one.
+		c.shutdown(err)
+		return c.err
+	}
+	return nil
+}
+
+// call runs a command of words, which can NOT contain spaces. The last one,
+// if text is set, can.
+func (c *Client) call(ctx context.Context, text bool, words ...string) (*Response, error) {
+	for i, w := range words {
+		if w == "" {
+			return nil, fmt.Errorf("%w: '%s' needs all of its arguments", ErrBadArgument, words[0])
+		}
+		if strings.Contains(w, " ") && !(text && i == len(words)-1) {
+			return nil, fmt.Errorf("%w: '%s' can NOT contain spaces", ErrBadArgument, w)
+		}
+	}
+
+	return c.Exec(ctx, strings.Join(words, " "))
+}
+
+func (c *Client) do(ctx context.Context, words ...string) error {
+	_, err := c.call(ctx, false, words...)
+	return err
+}
+
+// decode runs a command and decodes the payload of its response into v.
+func (c *Client) decode(ctx context.Context, v interface{}, words ...string) error {
+	resp, err := c.call(ctx, false, words...)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Data) == 0 {
+		return fmt.Errorf("pssh: '%s' has returned no data", words[0])
+	}
+	return json.Unmarshal(resp.Data, v)
+}
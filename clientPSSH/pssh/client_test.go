@@ -0,0 +1,193 @@
+package pssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serverFunc answers a command of the json protocol with a status, a
+// message and a payload.
+type serverFunc func(cmd string) (int, string, interface{})
+
+// newTestClient starts a session with a server on the other end of a pipe,
+// which greets with greeting and then answers the commands with answer.
+func newTestClient(t *testing.T, greeting string, answer serverFunc) *Client {
+	t.Helper()
+	server, conn := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		var wmu sync.Mutex
+		reply := func(id string, status int, message string, data interface{}) {
+			frame, _ := json.Marshal(map[string]interface{}{"id": id, "type": "response", "status": status, "message": message, "data": data})
+			wmu.Lock()
+			_, _ = server.Write(append(frame, '\n'))
+			wmu.Unlock()
+		}
+
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "proto json" {
+				// A pipe has no buffer, so the greeting can NOT come first.
+				if greeting != "" {
+					_, _ = server.Write([]byte(greeting + "\n"))
+				}
+				reply("", StatusOK, "Protocol 'json' is on.", map[string]int{"version": 1})
+				continue
+			}
+
+			id, cmd, _ := strings.Cut(line, " ")
+			if cmd == "quit" {
+				return
+			}
+			go func() {
+				status, message, data := answer(cmd)
+				reply(id, status, message, data)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c, err := NewClient(ctx, conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestHandshake(t *testing.T) {
+	c := newTestClient(t, "> Welcome to PseudoSSH.", func(cmd string) (int, string, interface{}) {
+		return StatusOK, "", nil
+	})
+
+	if g := c.Greeting(); len(g) != 1 || g[0] != "Welcome to PseudoSSH." {
+		t.Errorf("greeting %q", g)
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	server, conn := net.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(server)
+		scanner.Scan()
+		_, _ = server.Write([]byte("> Connection refused: the server has too many connections.\n"))
+		_ = server.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := NewClient(ctx, conn, nil)
+	if err == nil || !strings.Contains(err.Error(), "too many connections") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestConcurrentExec(t *testing.T) {
+	c := newTestClient(t, "", func(cmd string) (int, string, interface{}) {
+		if cmd == "read slow.txt" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return StatusOK, "", map[string]string{"text": cmd}
+	})
+
+	var wg sync.WaitGroup
+	for _, file := range []string{"slow.txt", "a.txt", "b.txt", "c.txt"} {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			text, err := c.Read(ctx, file)
+			if err != nil || text != "read "+file {
+				t.Errorf("Read(%s) = %q, %v", file, text, err)
+			}
+		}(file)
+	}
+	wg.Wait()
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t, "", func(cmd string) (int, string, interface{}) {
+		switch cmd {
+		case "ls secret":
+			return StatusForbidden, "DS: NOT allowed to read 'secret'.", nil
+		case "ls missing":
+			return StatusNotFound, "Directory 'missing' does NOT exist.", nil
+		case "ls teapot":
+			return 418, "I'm a teapot.", nil
+		case "login dan pw":
+			return StatusUnauthorized, "Two-factor code required. Send \"otp [code]\".", nil
+		case "ls slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return StatusOK, "", map[string]interface{}{"entries": []Entry{{Name: "a.txt"}}}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"forbidden", func() error { _, err := c.Ls(ctx, "secret"); return err }, ErrForbidden},
+		{"not found", func() error { _, err := c.Ls(ctx, "missing"); return err }, ErrNotFound},
+		{"other 4xx", func() error { _, err := c.Ls(ctx, "teapot"); return err }, ErrBadRequest},
+		{"two-factor", func() error { return c.Login(ctx, "dan", "pw") }, ErrOTPRequired},
+		{"space in an argument", func() error { return c.Login(ctx, "dan", "a b") }, ErrBadArgument},
+		{"line break", func() error { return c.Write(ctx, "a.txt", "a\nb") }, ErrBadArgument},
+		{"timeout", func() error {
+			short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := c.Ls(short, "slow")
+			return err
+		}, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	entries, err := c.Ls(ctx, ".")
+	if err != nil || len(entries) != 1 || entries[0].Name != "a.txt" {
+		t.Errorf("Ls = %v, %v", entries, err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	c := newTestClient(t, "", func(cmd string) (int, string, interface{}) {
+		return StatusOK, "", nil
+	})
+	_ = c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done is NOT closed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := c.Exec(ctx, "pwd"); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want %v", err, ErrClosed)
+	}
+}
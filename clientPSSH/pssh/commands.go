@@ -0,0 +1,351 @@
+package pssh
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MarkKind tells what a mark belongs to.
+type MarkKind string
+
+const (
+	MarkFile  MarkKind = "f"
+	MarkUser  MarkKind = "u"
+	MarkGroup MarkKind = "g"
+)
+
+// Entry is a file or directory listed by Ls.
+type Entry struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"isDir"`
+}
+
+// FileInfo is the record of a file in the server's database. Rights are
+// the bits "rwrw" of the owner and of the group, e.g. 0b1110. An audited
+// file keeps the last AuditAmount accesses (all if 0) of AuditRW: 0b10
+// reads, 0b01 writes, -1 both.
+type FileInfo struct {
+	Owner       string `json:"owner"`
+	Group       string `json:"group"`
+	Rights      uint8  `json:"rights"`
+	Mark        uint64 `json:"cm"`
+	Audited     bool   `json:"isBeingAudited"`
+	AuditAmount uint64 `json:"amountOfAudits"`
+	AuditRW     int64  `json:"auditReadWriteRights"`
+}
+
+// User is an account, as listed by Users.
+type User struct {
+	Nick        string `json:"nick"`
+	Mark        uint64 `json:"cm"`
+	IsAdmin     bool   `json:"isAdmin"`
+	IsAudit     bool   `json:"isAudit"`
+	IsActive    bool   `json:"isActive"`
+	PswdChanged int64  `json:"pswdChanged"` // unix seconds
+}
+
+// Session is a connection to the server. Nick and Dir are empty if nobody
+// is logged in on it. A detached session has lost its connection and waits
+// to be resumed.
+type Session struct {
+	ID        string
+	Nick      string
+	Peer      string
+	Listener  string
+	Dir       string
+	Connected time.Time
+	LoggedIn  time.Time
+	Idle      time.Duration
+	Detached  bool
+}
+
+// Login logs in with a password. It returns ErrOTPRequired if OTP must follow.
+func (c *Client) Login(ctx context.Context, nick, pswd string) error {
+	return c.do(ctx, "login", nick, pswd)
+}
+
+// OTP completes a login with a two-factor or recovery code.
+func (c *Client) OTP(ctx context.Context, code string) error {
+	return c.do(ctx, "otp", code)
+}
+
+// KeyLogin logs in by signing the server's challenge with key.
+func (c *Client) KeyLogin(ctx context.Context, nick string, key crypto.Signer) error {
+	resp, err := c.call(ctx, false, "keylogin", nick)
+	if err != nil {
+		return err
+	}
+
+	challenge := ""
+	for _, line := range strings.Split(resp.Message, "\n") {
+		if strings.HasPrefix(line, "Challenge: ") {
+			challenge = strings.TrimPrefix(line, "Challenge: ")
+		}
+	}
+	if challenge == "" {
+		return &Error{Status: StatusUnauthorized, Message: resp.Message}
+	}
+
+	sig, err := SignChallenge(key, challenge)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, "keyauth", sig)
+}
+
+// ResumeToken returns a token to take the session over from another
+// connection with Resume, e.g. after this one has dropped. It is empty if
+// the server does NOT resume sessions.
+func (c *Client) ResumeToken(ctx context.Context) (string, error) {
+	var data struct {
+		Token string `json:"token"`
+	}
+	resp, err := c.call(ctx, false, "resume")
+	if err != nil || len(resp.Data) == 0 {
+		return "", err
+	}
+	err = resp.DecodeData(&data)
+	return data.Token, err
+}
+
+// Resume takes over a session, which stays logged in as it was, and returns
+// the token for the next resume.
+func (c *Client) Resume(ctx context.Context, token string) (string, error) {
+	var data struct {
+		Token string `json:"token"`
+	}
+	err := c.decode(ctx, &data, "resume", token)
+	return data.Token, err
+}
+
+// Logout ends the login and its tunnels. The connection stays open.
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, "logout")
+}
+
+// Passwd changes the password of the logged in user.
+func (c *Client) Passwd(ctx context.Context, oldPswd, newPswd string) error {
+	return c.do(ctx, "passwd", oldPswd, newPswd)
+}
+
+// Pwd returns the current directory.
+func (c *Client) Pwd(ctx context.Context) (string, error) {
+	var data struct {
+		Dir string `json:"dir"`
+	}
+	err := c.decode(ctx, &data, "pwd")
+	return data.Dir, err
+}
+
+// Ls lists a directory, "." for the current one.
+func (c *Client) Ls(ctx context.Context, dir string) ([]Entry, error) {
+	var data struct {
+		Entries []Entry `json:"entries"`
+	}
+	err := c.decode(ctx, &data, "ls", dir)
+	return data.Entries, err
+}
+
+// Read returns the text of a file.
+func (c *Client) Read(ctx context.Context, file string) (string, error) {
+	var data struct {
+		Text string `json:"text"`
+	}
+	err := c.decode(ctx, &data, "read", file)
+	return data.Text, err
+}
+
+// Write replaces the text of a file, creating it if needed. The text can
+// NOT contain line breaks.
+func (c *Client) Write(ctx context.Context, file, text string) error {
+	_, err := c.call(ctx, true, "write", file, text)
+	return err
+}
+
+// Append adds text to the end of a file.
+func (c *Client) Append(ctx context.Context, file, text string) error {
+	_, err := c.call(ctx, true, "append", file, text)
+	return err
+}
+
+// Stat returns the record of a file ("rr").
+func (c *Client) Stat(ctx context.Context, file string) (*FileInfo, error) {
+	var info FileInfo
+	if err := c.decode(ctx, &info, "rr", file); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Chmod sets the rights of a file, e.g. "1110" for rw of the owner and r of
+// the group.
+func (c *Client) Chmod(ctx context.Context, file, rights string) error {
+	return c.do(ctx, "chmod", file, rights)
+}
+
+// Chmark sets the mark of a file of the user, or of a user or a group as an admin.
+func (c *Client) Chmark(ctx context.Context, kind MarkKind, object string, mark uint64) error {
+	return c.do(ctx, "chmark", string(kind), object, strconv.FormatUint(mark, 10))
+}
+
+// Mark returns the mark of a file, a user or a group ("gm").
+func (c *Client) Mark(ctx context.Context, kind MarkKind, object string) (uint64, error) {
+	var data struct {
+		Mark uint64 `json:"mark"`
+	}
+	err := c.decode(ctx, &data, "gm", string(kind), object)
+	return data.Mark, err
+}
+
+// Watch turns the audit of a file, a user or a group on or off. Audit only.
+func (c *Client) Watch(ctx context.Context, kind MarkKind, object string) error {
+	return c.do(ctx, "watch", string(kind), object)
+}
+
+// Reg registers a user with a mark. Admins only.
+func (c *Client) Reg(ctx context.Context, nick, pswd string, mark uint64) error {
+	return c.do(ctx, "reg", nick, pswd, strconv.FormatUint(mark, 10))
+}
+
+// ChPswd sets the password of a user. Admins only.
+func (c *Client) ChPswd(ctx context.Context, nick, pswd string) error {
+	return c.do(ctx, "chpswd", nick, pswd)
+}
+
+// RmUser removes a user. Admins only.
+func (c *Client) RmUser(ctx context.Context, nick string) error {
+	return c.do(ctx, "rmuser", nick)
+}
+
+// Users lists the accounts. Admins only.
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.decode(ctx, &users, "lsusers")
+	return users, err
+}
+
+// AddGroup creates a group with a mark. Admins only.
+func (c *Client) AddGroup(ctx context.Context, group string, mark uint64) error {
+	return c.do(ctx, "addgroup", group, "mark", strconv.FormatUint(mark, 10))
+}
+
+// U2G adds a user to a group.
+func (c *Client) U2G(ctx context.Context, group, user string) error {
+	return c.do(ctx, "u2g", group, user)
+}
+
+// TrimGroup removes a user from a group.
+func (c *Client) TrimGroup(ctx context.Context, group, user string) error {
+	return c.do(ctx, "trimgroup", group, user)
+}
+
+// RmGroup removes a group. Admins only.
+func (c *Client) RmGroup(ctx context.Context, group string) error {
+	return c.do(ctx, "rmgroup", group)
+}
+
+// Who lists the logged in sessions. Their directories are only in Sessions.
+func (c *Client) Who(ctx context.Context) ([]Session, error) {
+	return c.sessions(ctx, "who")
+}
+
+// Sessions lists all the connections. Admins only.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	return c.sessions(ctx, "sessions")
+}
+
+func (c *Client) sessions(ctx context.Context, cmd string) ([]Session, error) {
+	var data []struct {
+		ID        string `json:"id"`
+		Nick      string `json:"nick"`
+		Peer      string `json:"peer"`
+		Listener  string `json:"listener"`
+		Dir       string `json:"dir"`
+		Connected int64  `json:"connected"`
+		LoggedIn  int64  `json:"loggedIn"`
+		Idle      int64  `json:"idle"`
+		Detached  bool   `json:"detached"`
+	}
+	if err := c.decode(ctx, &data, cmd); err != nil {
+		return nil, err
+	}
+
+	list := make([]Session, 0, len(data))
+	for _, d := range data {
+		s := Session{
+			ID:        d.ID,
+			Nick:      d.Nick,
+			Peer:      d.Peer,
+			Listener:  d.Listener,
+			Dir:       d.Dir,
+			Connected: time.Unix(d.Connected, 0),
+			Idle:      time.Duration(d.Idle) * time.Second,
+			Detached:  d.Detached,
+		}
+		if d.LoggedIn != 0 {
+			s.LoggedIn = time.Unix(d.LoggedIn, 0)
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// Kill closes a session. Admins only.
+func (c *Client) Kill(ctx context.Context, sessionID string) error {
+	return c.do(ctx, "kill", sessionID)
+}
+
+// Unlock lifts the lockout of a nick or of an address.
+func (c *Client) Unlock(ctx context.Context, object string) error {
+	return c.do(ctx, "unlock", object)
+}
+
+// State returns the nick and the current directory of the session, both
+// empty if nobody is logged in.
+func (c *Client) State(ctx context.Context) (string, string, error) {
+	var data struct {
+		Nick string `json:"nick"`
+		Dir  string `json:"dir"`
+	}
+	resp, err := c.call(ctx, false, "complete", "state")
+	if err != nil || len(resp.Data) == 0 {
+		return "", "", err
+	}
+	err = resp.DecodeData(&data)
+	return data.Nick, data.Dir, err
+}
+
+// Complete returns the names of kind, "path", "user" or "group", that start
+// with prefix. Directories end with '/'.
+func (c *Client) Complete(ctx context.Context, kind, prefix string) ([]string, error) {
+	words := []string{"complete", kind}
+	if prefix != "" {
+		words = append(words, prefix)
+	}
+
+	var names []string
+	err := c.decode(ctx, &names, words...)
+	return names, err
+}
+
+// Reason returns why the server has ended the session, for a frame of type
+// "disconnect": "killed", "replaced", "resumed", "idle" or "shutdown".
+func (r *Response) Reason() string {
+	var data struct {
+		Reason string `json:"reason"`
+	}
+	if r.Type != "disconnect" || r.DecodeData(&data) != nil {
+		return ""
+	}
+	return data.Reason
+}
+
+// DecodeData decodes the payload of a response got with Exec.
+func (r *Response) DecodeData(v interface{}) error {
+	return json.Unmarshal(r.Data, v)
+}
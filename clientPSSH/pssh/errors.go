@@ -0,0 +1,87 @@
+package pssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Status codes of the server's responses, after the HTTP ones.
+const (
+	StatusOK           = 200
+	StatusBadRequest   = 400
+	StatusUnauthorized = 401
+	StatusForbidden    = 403
+	StatusNotFound     = 404
+	StatusConflict     = 409
+	StatusTooMany      = 429
+	StatusError        = 500
+	StatusUnavailable  = 503
+)
+
+// Errors to test an *Error against with errors.Is.
+var (
+	ErrBadRequest      = errors.New("pssh: bad request")
+	ErrUnauthorized    = errors.New("pssh: unauthorized")
+	ErrForbidden       = errors.New("pssh: forbidden")
+	ErrNotFound        = errors.New("pssh: not found")
+	ErrConflict        = errors.New("pssh: conflict")
+	ErrTooManyCommands = errors.New("pssh: too many commands")
+	ErrServer          = errors.New("pssh: server error")
+	ErrUnavailable     = errors.New("pssh: server unavailable")
+
+	// ErrOTPRequired: the password was right, "OTP" must follow.
+	ErrOTPRequired = errors.New("pssh: two-factor code required")
+	// ErrPasswordExpired: logged in, but only "Passwd" is allowed.
+	ErrPasswordExpired = errors.New("pssh: password expired")
+)
+
+// ErrClosed is returned once the connection is gone.
+var ErrClosed = errors.New("pssh: connection closed")
+
+// ErrBadArgument is returned for arguments the protocol can NOT carry, e.g.
+// a nick with a space. Such commands are NOT sent.
+var ErrBadArgument = errors.New("pssh: bad argument")
+
+// Error is a response of the server with a failure status.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pssh: %s (%d)", e.Message, e.Status)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrOTPRequired:
+		return strings.Contains(e.Message, "Two-factor code required")
+	case ErrPasswordExpired:
+		return strings.Contains(e.Message, "password has expired")
+	}
+
+	return target == statusErrors[e.Status] ||
+		(target == ErrBadRequest && e.Status >= 400 && e.Status < 500 && statusErrors[e.Status] == nil) ||
+		(target == ErrServer && e.Status >= 500 && statusErrors[e.Status] == nil)
+}
+
+var statusErrors = map[int]error{
+	StatusBadRequest:   ErrBadRequest,
+	StatusUnauthorized: ErrUnauthorized,
+	StatusForbidden:    ErrForbidden,
+	StatusNotFound:     ErrNotFound,
+	StatusConflict:     ErrConflict,
+	StatusTooMany:      ErrTooManyCommands,
+	StatusError:        ErrServer,
+	StatusUnavailable:  ErrUnavailable,
+}
+
+// responseError returns nil for a successful response.
+func responseError(resp *Response) error {
+	if resp.Status < 400 {
+		return nil
+	}
+
+	return &Error{Status: resp.Status, Message: resp.Message}
+}
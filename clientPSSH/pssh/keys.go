@@ -0,0 +1,77 @@
+package pssh
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const keyauthPrefix = "pssh-keyauth:"
+
+// LoadPrivateKey reads an Ed25519 or RSA key in PKCS#8 PEM, e.g. made by
+// "openssl genpkey -algorithm ed25519 -out key.pem".
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("'%s' is NOT a PEM file", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, errors.New("only Ed25519 and RSA keys are supported")
+	}
+}
+
+// SignChallenge answers a "keylogin" challenge of the server with key.
+func SignChallenge(key crypto.Signer, challenge string) (string, error) {
+	nonce, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	msg := append([]byte(keyauthPrefix), nonce...)
+
+	var sig []byte
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = key.Sign(rand.Reader, msg, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(msg)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
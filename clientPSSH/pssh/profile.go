@@ -0,0 +1,226 @@
+package pssh
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// DefaultPort of the server.
+const DefaultPort = "8888"
+
+// DefaultPasswordEnv is the environment variable with the password of a
+// profile without PasswordEnv.
+const DefaultPasswordEnv = "PSSH_PASSWORD"
+
+// Profile is a named connection of the configuration file, which is
+// written like ~/.ssh/config:
+//
+//	# comment
+//	Host prod-audit
+//	    HostName audit.example.com
+//	    Port 8888
+//	    User auditor
+//	    TLS yes
+//	    TLSCA ~/.pssh/ca.pem
+//	    TLSServerName audit.example.com
+//	    TLSInsecure no
+//	    KeyFile ~/.pssh/auditor.pem
+//	    PasswordEnv PSSH_AUDIT_PASSWORD
+//
+//	Host *
+//	    Port 8888
+//
+// A Host line may have several patterns with '*' and '?'. For each setting
+// the first value found in the matching sections is taken.
+type Profile struct {
+	HostName      string
+	Port          string
+	User          string
+	TLS           bool
+	TLSCA         string
+	TLSServerName string
+	TLSInsecure   bool
+	KeyFile       string
+	PasswordEnv   string
+}
+
+// DefaultConfigPath is ~/.pssh/config.
+func DefaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".pssh", "config")
+}
+
+// LoadProfile returns the settings for name, which are empty if no section
+// matches. A missing file is NOT an error.
+func LoadProfile(path, name string) (p Profile, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	matches := false
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value := splitSetting(line)
+		if value == "" {
+			return p, fmt.Errorf("%s:%d: '%s' has no value", path, n, key)
+		}
+
+		key = strings.ToLower(key)
+		if key == "host" {
+			matches = false
+			for _, pattern := range strings.Fields(value) {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					matches = true
+				}
+			}
+			continue
+		}
+
+		if !matches || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		switch key {
+		case "hostname":
+			p.HostName = value
+		case "port":
+			p.Port = value
+		case "user":
+			p.User = value
+		case "tls":
+			p.TLS, err = parseYesNo(value)
+		case "tlsca":
+			p.TLSCA = expandHome(value)
+		case "tlsservername":
+			p.TLSServerName = value
+		case "tlsinsecure":
+			p.TLSInsecure, err = parseYesNo(value)
+		case "keyfile":
+			p.KeyFile = expandHome(value)
+		case "passwordenv":
+			p.PasswordEnv = value
+		default:
+			err = fmt.Errorf("unknown setting '%s'", key)
+		}
+		if err != nil {
+			return p, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+	}
+
+	return p, scanner.Err()
+}
+
+// splitSetting splits "Key Value" or "Key=Value".
+func splitSetting(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, ""
+	}
+
+	return line[:i], strings.TrimSpace(strings.TrimLeft(line[i:], " \t="))
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on":
+		return true, nil
+	case "no", "false", "off":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("'%s' must be either of 'yes', 'no'", value)
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// TLSConfig returns nil if the profile does NOT use TLS.
+func (p *Profile) TLSConfig() (*tls.Config, error) {
+	if !p.TLS {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         p.TLSServerName,
+		InsecureSkipVerify: p.TLSInsecure,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = p.HostName
+	}
+
+	if p.TLSCA != "" {
+		pem, err := os.ReadFile(p.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("'%s' has no PEM certificates", p.TLSCA)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Password is taken from the environment variable of the profile, or read
+// from the terminal without echo. It is never given on the command line.
+func (p *Profile) Password() (string, error) {
+	env := p.PasswordEnv
+	if env == "" {
+		env = DefaultPasswordEnv
+	}
+	if pswd, ok := os.LookupEnv(env); ok {
+		return pswd, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no password for '%s': set %s or run in a terminal", p.User, env)
+	}
+
+	// On stderr, as stdout may be the output of a batch.
+	fmt.Fprintf(os.Stderr, "Password for %s@%s: ", p.User, p.HostName)
+	defer fmt.Fprintln(os.Stderr)
+
+	pswd, err := term.ReadPassword(fd)
+	if err != nil {
+		return "", err
+	}
+	return string(pswd), nil
+}
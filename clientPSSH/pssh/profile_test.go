@@ -0,0 +1,118 @@
+package pssh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# profiles
+Host prod-audit audit-*
+    HostName audit.example.com
+    User auditor
+    TLS yes
+    KeyFile ~/.pssh/auditor.pem
+
+Host prod-?
+    HostName=prod.example.com
+    Port = 9999
+
+Host *
+    Port 8888
+    User guest
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	home, _ := os.UserHomeDir()
+
+	tests := []struct {
+		name string
+		want Profile
+	}{
+		{"prod-audit", Profile{HostName: "audit.example.com", Port: "8888", User: "auditor", TLS: true, KeyFile: filepath.Join(home, ".pssh/auditor.pem")}},
+		{"audit-eu", Profile{HostName: "audit.example.com", Port: "8888", User: "auditor", TLS: true, KeyFile: filepath.Join(home, ".pssh/auditor.pem")}},
+		{"prod-1", Profile{HostName: "prod.example.com", Port: "9999", User: "guest"}},
+		{"prod-10", Profile{Port: "8888", User: "guest"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := LoadProfile(path, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tt.want {
+				t.Errorf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadProfileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"no value", "Host *\n    Port\n", ":2: 'Port' has no value"},
+		{"unknown setting", "Host *\n    Proxy x\n", ":2: unknown setting 'proxy'"},
+		{"bad yes or no", "Host *\n    TLS maybe\n", ":2: 'maybe' must be either of 'yes', 'no'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadProfile(writeConfig(t, tt.content), "prod")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if p, err := LoadProfile(filepath.Join(t.TempDir(), "missing"), "prod"); err != nil || p != (Profile{}) {
+		t.Errorf("missing file: %+v, %v", p, err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	p := Profile{HostName: "audit.example.com"}
+	if cfg, err := p.TLSConfig(); cfg != nil || err != nil {
+		t.Errorf("without TLS: %v, %v", cfg, err)
+	}
+
+	p.TLS = true
+	cfg, err := p.TLSConfig()
+	if err != nil || cfg.ServerName != "audit.example.com" {
+		t.Errorf("server name: %v, %v", cfg, err)
+	}
+
+	p.TLSCA = writeConfig(t, "no certificates")
+	if _, err := p.TLSConfig(); err == nil {
+		t.Error("a CA file without certificates is accepted")
+	}
+}
+
+func TestPasswordFromEnv(t *testing.T) {
+	t.Setenv(DefaultPasswordEnv, "Pw4Tests_x9")
+	t.Setenv("PSSH_AUDIT_PASSWORD", "Audit_Pw4Tests")
+
+	p := Profile{User: "dan"}
+	if pswd, err := p.Password(); err != nil || pswd != "Pw4Tests_x9" {
+		t.Errorf("default variable: %q, %v", pswd, err)
+	}
+
+	p.PasswordEnv = "PSSH_AUDIT_PASSWORD"
+	if pswd, err := p.Password(); err != nil || pswd != "Audit_Pw4Tests" {
+		t.Errorf("variable of the profile: %q, %v", pswd, err)
+	}
+}
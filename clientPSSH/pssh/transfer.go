@@ -0,0 +1,140 @@
+package pssh
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MaxLineLength is the longest command line of a server with the default
+// settings. Put splits files into chunks that fit into it.
+const MaxLineLength = 4096
+
+// MaxRetries is how many times a command the server refused as too fast is
+// sent again before its error is returned.
+const MaxRetries = 5
+
+// Progress is called with the bytes transferred so far and the size of the
+// file.
+type Progress func(done, total int)
+
+// Put uploads a file, creating it if needed. Unlike Write, the data may be
+// any bytes. A file that exists keeps its group, rights and mark.
+func (c *Client) Put(ctx context.Context, file string, data []byte, progress Progress) error {
+	// "{id} put {file} {base64}"
+	room := MaxLineLength - 32 - len(file)
+	if room < 64 {
+		return fmt.Errorf("%w: the name '%s' is too long to upload", ErrBadArgument, file)
+	}
+	chunkSize := room / 4 * 3
+
+	for done := 0; done < len(data); {
+		end := done + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := base64.StdEncoding.EncodeToString(data[done:end])
+		if err := c.retry(ctx, "put", file, chunk); err != nil {
+			return err
+		}
+
+		done = end
+		if progress != nil {
+			progress(done, len(data))
+		}
+	}
+
+	// The chunks are written at once, an empty file has none.
+	if err := c.retry(ctx, "put", file); err != nil {
+		return err
+	}
+	if progress != nil && len(data) == 0 {
+		progress(0, 0)
+	}
+	return nil
+}
+
+// Get downloads a file.
+func (c *Client) Get(ctx context.Context, file string) ([]byte, error) {
+	var data struct {
+		Data string `json:"data"`
+	}
+	if err := c.decode(ctx, &data, "get", file); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(data.Data)
+}
+
+// Mkdir creates a directory with its parents.
+func (c *Client) Mkdir(ctx context.Context, dir string) error {
+	return c.do(ctx, "mkdir", dir)
+}
+
+// Remove deletes a file of the user, or an empty directory.
+func (c *Client) Remove(ctx context.Context, file string) error {
+	return c.do(ctx, "rm", file)
+}
+
+// Chgrp sets the group of a file. The owner must be in the group, unless
+// it is an admin.
+func (c *Client) Chgrp(ctx context.Context, file, group string) error {
+	return c.do(ctx, "chgrp", file, group)
+}
+
+// FormatRights returns the "rwrw" bits of rights as chmod takes them.
+func FormatRights(rights uint8) string {
+	return fmt.Sprintf("%04b", rights&0b1111)
+}
+
+// ParseRights parses "rwrw" bits, e.g. "1110".
+func ParseRights(s string) (uint8, error) {
+	rights, err := strconv.ParseUint(s, 2, 8)
+	if err != nil || len(s) != 4 {
+		return 0, fmt.Errorf("%w: rights must be 4 bits 'rwrw', e.g. 1110, NOT '%s'", ErrBadArgument, s)
+	}
+	return uint8(rights), nil
+}
+
+// Retry runs cmd until the server does NOT refuse it as too fast, pausing
+// longer each time, at most MaxRetries times again. Each run gets its own
+// context of ctx with timeout, or ctx itself if timeout is 0.
+func Retry(ctx context.Context, timeout time.Duration, cmd func(ctx context.Context) error) error {
+	pause := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := runWithin(ctx, timeout, cmd)
+		if !errors.Is(err, ErrTooManyCommands) || attempt == MaxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if pause < 2*time.Second {
+			pause *= 2
+		}
+	}
+}
+
+// runWithin runs cmd once, with timeout if it is NOT 0.
+func runWithin(ctx context.Context, timeout time.Duration, cmd func(ctx context.Context) error) error {
+	if timeout == 0 {
+		return cmd(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return cmd(ctx)
+}
+
+// retry runs a command with Retry, so that the chunks of a long file do NOT
+// fail on the rate limit.
+func (c *Client) retry(ctx context.Context, words ...string) error {
+	return Retry(ctx, 0, func(ctx context.Context) error {
+		return c.do(ctx, words...)
+	})
+}
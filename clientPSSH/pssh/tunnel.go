@@ -0,0 +1,383 @@
+package pssh
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnelChunk is the most bytes of a tunnel sent in one line.
+const tunnelChunk = (MaxLineLength - 64) / 4 * 3
+
+// Tunnel is a TCP connection forwarded through the server: to a destination
+// the server connects to ("ssh -L"), or from a client of a listener on the
+// server ("ssh -R"). The server must allow it by its 'forwarding' rules.
+//
+// The data of all the tunnels and the responses share the connection, so a
+// tunnel whose data is NOT read holds up the others.
+type Tunnel struct {
+	c    *Client
+	id   string
+	addr string
+
+	incoming chan []byte
+	buf      []byte
+
+	mu          sync.Mutex
+	err         error         // why it has failed
+	ready       chan struct{} // closed once it is open, or has failed to
+	eof         chan struct{} // closed once no more data comes
+	isReady     bool
+	isEOF       bool
+	isClosed    bool
+	writeClosed bool
+}
+
+// TunnelListener accepts the connections of a listener on the server.
+type TunnelListener struct {
+	c    *Client
+	id   string
+	addr string
+
+	accepted  chan *Tunnel
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tunnelEvent is the payload of the frames of type "tunnel".
+type tunnelEvent struct {
+	Tunnel   string `json:"tunnel"`
+	Event    string `json:"event"` // "open", "accept", "data", "eof" or "close"
+	Data     string `json:"data"`
+	Listener string `json:"listener"`
+	From     string `json:"from"`
+	Reason   string `json:"reason"`
+}
+
+// DialTunnel opens a tunnel to addr, "host:port", as the server sees it.
+func (c *Client) DialTunnel(ctx context.Context, addr string) (*Tunnel, error) {
+	var info struct {
+		ID string `json:"id"`
+	}
+	if err := c.decode(ctx, &info, "tunnel", "open", addr); err != nil {
+		return nil, err
+	}
+
+	t := c.addTunnel(info.ID, addr)
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		_ = t.Close()
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, c.err
+	}
+
+	t.mu.Lock()
+	err := t.err
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListenTunnel listens on addr, "host:port", of the server. Each connection
+// to it comes as a Tunnel from Accept.
+func (c *Client) ListenTunnel(ctx context.Context, addr string) (*TunnelListener, error) {
+	var info struct {
+		ID   string `json:"id"`
+		Addr string `json:"addr"`
+	}
+	if err := c.decode(ctx, &info, "tunnel", "listen", addr); err != nil {
+		return nil, err
+	}
+
+	l := &TunnelListener{
+		c:        c,
+		id:       info.ID,
+		addr:     info.Addr,
+		accepted: make(chan *Tunnel, 16),
+		done:     make(chan struct{}),
+	}
+
+	c.tmu.Lock()
+	c.listeners[l.id] = l
+	early := c.early[l.id]
+	delete(c.early, l.id)
+	c.tmu.Unlock()
+
+	// Connections accepted before the response.
+	for _, ev := range early {
+		c.tmu.Lock()
+		t := c.tunnels[ev.Tunnel]
+		c.tmu.Unlock()
+		if t != nil {
+			l.deliver(t)
+		}
+	}
+	return l, nil
+}
+
+func (c *Client) addTunnel(id, addr string) *Tunnel {
+	t := &Tunnel{
+		c:        c,
+		id:       id,
+		addr:     addr,
+		incoming: make(chan []byte, 64),
+		ready:    make(chan struct{}),
+		eof:      make(chan struct{}),
+	}
+
+	c.tmu.Lock()
+	c.tunnels[id] = t
+	early := c.early[id]
+	delete(c.early, id)
+	c.tmu.Unlock()
+
+	// A tunnel may connect before the response to "tunnel open" comes.
+	for _, ev := range early {
+		t.handle(ev)
+	}
+	return t
+}
+
+// tunnelFrame passes a frame of type "tunnel" to its tunnel.
+func (c *Client) tunnelFrame(resp *Response) {
+	var ev tunnelEvent
+	if err := json.Unmarshal(resp.Data, &ev); err != nil {
+		return
+	}
+
+	if ev.Event == "accept" {
+		t := c.addTunnel(ev.Tunnel, ev.From)
+		t.handle(ev)
+
+		c.tmu.Lock()
+		l := c.listeners[ev.Listener]
+		if l == nil {
+			c.early[ev.Listener] = append(c.early[ev.Listener], ev)
+		}
+		c.tmu.Unlock()
+
+		if l != nil {
+			l.deliver(t)
+		}
+		return
+	}
+
+	c.tmu.Lock()
+	t := c.tunnels[ev.Tunnel]
+	if t == nil && (ev.Event == "open" || ev.Event == "close") {
+		c.early[ev.Tunnel] = append(c.early[ev.Tunnel], ev)
+	}
+	c.tmu.Unlock()
+
+	if t != nil {
+		t.handle(ev)
+	}
+}
+
+func (t *Tunnel) handle(ev tunnelEvent) {
+	switch ev.Event {
+	case "open", "accept":
+		t.setReady(nil)
+
+	case "data":
+		data, err := base64.StdEncoding.DecodeString(ev.Data)
+		if err != nil {
+			return
+		}
+		select {
+		case t.incoming <- data:
+		case <-t.eof:
+		}
+
+	case "eof":
+		t.endInput()
+
+	case "close":
+		t.c.tmu.Lock()
+		delete(t.c.tunnels, t.id)
+		t.c.tmu.Unlock()
+
+		var err error
+		if ev.Reason != "" {
+			err = fmt.Errorf("pssh: tunnel %s to '%s': %s", t.id, t.addr, ev.Reason)
+		}
+		t.setReady(err)
+		t.endInput()
+
+		t.mu.Lock()
+		t.isClosed = true
+		t.mu.Unlock()
+	}
+}
+
+func (t *Tunnel) setReady(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.isReady {
+		return
+	}
+	t.isReady = true
+	t.err = err
+	close(t.ready)
+}
+
+func (t *Tunnel) endInput() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.isEOF {
+		t.isEOF = true
+		close(t.eof)
+	}
+}
+
+// ID returns the id of the tunnel on the server.
+func (t *Tunnel) ID() string {
+	return t.id
+}
+
+// Addr returns the destination of the tunnel, or the address of the client
+// a listener has accepted it from.
+func (t *Tunnel) Addr() string {
+	return t.addr
+}
+
+// Read reads what comes from the other end. It returns io.EOF once the other
+// end has closed the tunnel or its writing side.
+func (t *Tunnel) Read(p []byte) (int, error) {
+	if len(t.buf) == 0 {
+		select {
+		case t.buf = <-t.incoming:
+		case <-t.eof:
+			// The data sent before the end is still buffered.
+			select {
+			case t.buf = <-t.incoming:
+			default:
+				return 0, io.EOF
+			}
+		case <-t.c.closed:
+			return 0, t.c.err
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// Write sends p to the other end.
+func (t *Tunnel) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	closed := t.isClosed || t.writeClosed
+	t.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	for done := 0; done < len(p); {
+		end := done + tunnelChunk
+		if end > len(p) {
+			end = len(p)
+		}
+
+		line := "@" + t.id + " " + base64.StdEncoding.EncodeToString(p[done:end]) + "\n"
+		if err := t.c.send(context.Background(), line); err != nil {
+			return done, err
+		}
+		done = end
+	}
+	return len(p), nil
+}
+
+// CloseWrite tells the other end that nothing more is written, reading goes
+// on until it closes too.
+func (t *Tunnel) CloseWrite() error {
+	t.mu.Lock()
+	if t.isClosed || t.writeClosed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.writeClosed = true
+	t.mu.Unlock()
+
+	return t.c.send(context.Background(), "@"+t.id+"\n")
+}
+
+// Close closes the tunnel at both ends.
+func (t *Tunnel) Close() error {
+	t.endInput()
+
+	t.mu.Lock()
+	if t.isClosed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.isClosed = true
+	t.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The server may have closed it meanwhile.
+	if err := t.c.retry(ctx, "tunnel", "close", t.id); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (l *TunnelListener) deliver(t *Tunnel) {
+	select {
+	case l.accepted <- t:
+	case <-l.done:
+		go t.Close()
+	}
+}
+
+// Addr returns the address the server listens on.
+func (l *TunnelListener) Addr() string {
+	return l.addr
+}
+
+// Accept waits for the next connection to the listener.
+func (l *TunnelListener) Accept() (*Tunnel, error) {
+	select {
+	case t := <-l.accepted:
+		return t, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.c.closed:
+		return nil, l.c.err
+	}
+}
+
+// Close stops the listener on the server. The tunnels it has accepted stay
+// open.
+func (l *TunnelListener) Close() error {
+	first := false
+	l.closeOnce.Do(func() {
+		first = true
+		close(l.done)
+	})
+	if !first {
+		return nil
+	}
+
+	l.c.tmu.Lock()
+	delete(l.c.listeners, l.id)
+	l.c.tmu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.c.retry(ctx, "tunnel", "close", l.id)
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/sjson"
+	"golang.org/x/term"
+)
+
+const admin_mark uint64 = 100
+
+// isInitialized reports whether any user has been registered yet.
+func isInitialized() bool {
+	matches, _ := filepath.Glob(filepath.Join(db_path, "*.json"))
+	return len(matches) > 0
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func readLine(r *bufio.Reader, w io.Writer, prompt string) (string, error) {
+	fmt.Fprint(w, prompt)
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// terminalOf returns the descriptor of r if it is a terminal, or -1.
+func terminalOf(r io.Reader) int {
+	if f, ok := r.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		return int(f.Fd())
+	}
+	return -1
+}
+
+// readPassword reads a line without echoing it if r is a terminal.
+func readPassword(in *bufio.Reader, r io.Reader, w io.Writer, prompt string) (string, error) {
+	fd := terminalOf(r)
+	if fd < 0 {
+		return readLine(in, w, prompt)
+	}
+
+	fmt.Fprint(w, prompt)
+	pswd, err := term.ReadPassword(fd)
+	fmt.Fprintln(w)
+	return string(pswd), err
+}
+
+// bootstrap lays out the data directories and creates the first admin:
+// "serverPSSH init {nick} {cm}". The password is read from r, without echo
+// and twice if r is a terminal.
+func bootstrap(args []string, r io.Reader, w io.Writer) error {
+	if isInitialized() {
+		return fmt.Errorf("'%s' already has users, use 'reg' to add more", db_path)
+	}
+
+	in := bufio.NewReader(r)
+
+	nick := ""
+	if len(args) > 0 {
+		nick = args[0]
+	} else {
+		var err error
+		if nick, err = readLine(in, w, "Admin nick [admin]: "); err != nil {
+			return err
+		}
+	}
+	if nick == "" {
+		nick = "admin"
+	}
+	if !isValidNick(nick) {
+		return fmt.Errorf("nick '%s' must NOT contain '/', '\\', '.' or spaces", nick)
+	}
+
+	mark := admin_mark
+	if len(args) > 1 {
+		cm, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return errors.New("mark must be >= 0")
+		}
+		mark = cm
+	}
+
+	pswd, err := readPassword(in, r, w, fmt.Sprintf("Password for '%s': ", nick))
+	if err != nil {
+		return err
+	}
+	if err := checkPassword(nick, pswd, ""); err != nil {
+		return err
+	}
+	if terminalOf(r) >= 0 {
+		again, err := readPassword(in, r, w, "Repeat the password: ")
+		if err != nil {
+			return err
+		}
+		if again != pswd {
+			return errors.New("passwords do NOT match")
+		}
+	}
+
+	for _, dir := range []string{db_path, users_path + nick + "/home", group_path, filepath.Dir(db_files), audits_path} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	// "write" puts files of admins into the group 'admins' and the others
+	// into 'users'.
+	admins, _ := sjson.Set("", "name", "admins")
+	admins, _ = sjson.Set(admins, "cm", mark)
+	admins, _ = sjson.Set(admins, "users", []string{nick})
+
+	users, _ := sjson.Set("", "name", "users")
+	users, _ = sjson.Set(users, "cm", conf().defaultMark)
+	users, _ = sjson.Set(users, "users", []string{})
+
+	db, _ := sjson.Set("", "nick", nick)
+	db = setPassword(db, pswd)
+	db, _ = sjson.Set(db, "cm", mark)
+	db, _ = sjson.Set(db, "isAdmin", true)
+	db, _ = sjson.Set(db, "isAudit", true)
+
+	files := map[string]string{
+		group_path + "admins.json": admins,
+		group_path + "users.json":  users,
+		db_path + nick + ".json":   db,
+	}
+	for path, content := range files {
+		if _, err := os.Stat(path); err == nil && !strings.HasPrefix(path, db_path) {
+			continue // keep the groups of an earlier setup
+		}
+		if err := os.WriteFile(path, []byte(content), conf().fileMode); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "You have successfully created admin '%s'.\n", nick)
+	return nil
+}
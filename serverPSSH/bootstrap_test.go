@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestBootstrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		input   string
+		wantErr string
+		wantAs  string
+	}{
+		{"defaults", nil, "\n" + rootPswd + "\n", "", "admin"},
+		{"nick and mark", []string{"root", "90"}, rootPswd + "\n", "", "root"},
+		{"nick from input", nil, "boss\n" + rootPswd + "\n", "", "boss"},
+		{"path as nick", []string{"../root"}, rootPswd + "\n", "must NOT contain", ""},
+		{"bad mark", []string{"root", "-1"}, rootPswd + "\n", "mark must be >= 0", ""},
+		{"weak password", []string{"root"}, "short\n", "at least 8 characters", ""},
+		{"no password", []string{"root"}, "", "EOF", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+
+			err := bootstrap(tt.args, strings.NewReader(tt.input), io.Discard)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if isInitialized() {
+					t.Error("a user has been created")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			content, err := os.ReadFile(db_path + tt.wantAs + ".json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !gjson.GetBytes(content, "isAdmin").Bool() || gjson.GetBytes(content, "pswd").String() != hashPassword(rootPswd) {
+				t.Errorf("db of '%s': %s", tt.wantAs, content)
+			}
+
+			if err := bootstrap(tt.args, strings.NewReader(tt.input), io.Discard); err == nil {
+				t.Error("a second bootstrap has succeeded")
+			}
+		})
+	}
+}
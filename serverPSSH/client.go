@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type client struct {
@@ -21,7 +25,10 @@ type client struct {
 	homeDir    string
 	currDir    string
 	commands   chan<- command
-	isConnErr  bool
+	isConnErr  atomic.Bool // set by readInput
+
+	// Set on the first login, read by readInput for the login timeout.
+	hasLoggedIn atomic.Bool
 
 	// lab2
 	groups []string
@@ -33,6 +40,38 @@ type client struct {
 	isAudit        bool
 	isBeingAudited bool
 	loginAttempts  uint
+
+	sessionID  string
+	peer       string
+	listener   *listener
+	recMu      sync.Mutex // rec is read by readInput too
+	rec        *recorder
+	connTime   time.Time
+	loginTime  time.Time
+	lastActive time.Time
+	challenge  *keyChallenge
+	pending2FA *pendingLogin
+
+	// See resume.go.
+	resumeHash string
+	detached   bool // the connection has dropped, the session waits for a resume
+	expiry     *time.Timer
+
+	upload  *upload    // chunks of "put", see transfer.go
+	tunnels *tunnelSet // see tunnel.go
+
+	// Until each of these commands succeeds, the session can run nothing else.
+	restrictions map[commandID]string
+	restriction  string
+
+	wmu sync.Mutex // writes, as tunnels write from their own goroutines
+
+	// json protocol, used by the server's loop only
+	structured bool
+	inRequest  bool // a command of this session is being run
+	reqOpen    bool
+	reqID      string
+	resp       *response
 }
 
 func isNetConnClosedErr(err error) bool {
@@ -49,209 +88,596 @@ func isNetConnClosedErr(err error) bool {
 }
 
 func (c *client) readInput() {
-	for {
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		if isNetConnClosedErr(err) {
-			c.isConnErr = true
-			c.commands <- command{
-				id:     CmdLogout,
-				client: c,
-			}
+	c.commands <- command{
+		id:     CmdJoin,
+		client: c,
+	}
+
+	// A connection that does NOT log in in time is dropped, idle or not.
+	var loginBy time.Time
+	if conf().loginTimeout > 0 {
+		loginBy = time.Now().Add(conf().loginTimeout)
+	}
+
+	var limiter rateLimiter
+	var partial []byte  // of a line cut by the login deadline
+	structured := false // the json protocol, see protocol.go
+	reader := bufio.NewReaderSize(c.conn, conf().maxLineLength)
+	for lineNo := 1; ; lineNo++ {
+		var deadline time.Time
+		if conf().idleTimeout > 0 {
+			deadline = time.Now().Add(conf().idleTimeout)
+		}
+		if !loginBy.IsZero() && !c.hasLoggedIn.Load() && (deadline.IsZero() || loginBy.Before(deadline)) {
+			deadline = loginBy
 		}
+		_ = c.conn.SetReadDeadline(deadline)
 
-		msg = strings.Trim(msg, "\r\n")
+		tooLong := false
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = reader.ReadSlice('\n')
+			}
+			tooLong = true
+		}
 
-		args := strings.Split(msg, " ")
-		cmd := strings.TrimSpace(args[0])
+		var netErr net.Error
+		timedOut := errors.As(err, &netErr) && netErr.Timeout()
+		loginTimedOut := timedOut && deadline.Equal(loginBy)
+		if loginTimedOut && c.hasLoggedIn.Load() {
+			// The login has been run after the deadline was set.
+			partial = append(partial, line...)
+			lineNo--
+			continue
+		}
+		if err == nil && len(partial) > 0 {
+			line = append(partial, line...)
+			partial = nil
+		}
 
-		switch cmd {
-		case "reg":
-			c.commands <- command{
-				id:     CmdReg,
-				client: c,
-				args:   args,
+		if err != nil {
+			if timedOut {
+				reason, text := "idle", fmt.Sprintf("You have been idle for %s. Disconnecting.", conf().idleTimeout)
+				if loginTimedOut {
+					reason, text = "login-timeout", fmt.Sprintf("You have NOT logged in within %s. Disconnecting.", conf().loginTimeout)
+				}
+				if structured {
+					c.recording().event("o", "> "+text+"\n")
+					c.writeFrame(disconnectFrame(reason, text))
+				} else {
+					c.msg(text)
+				}
+				log.Printf("Session %s from %s has timed out.", c.sessionID, c.peer)
+			} else if !isNetConnClosedErr(err) {
+				log.Printf("[%s] Failed to read from %s.", err.Error(), c.peer)
 			}
 
-		case "chpswd":
-			c.commands <- command{
-				id:     CmdChPswd,
-				client: c,
-				args:   args,
+			// A session that has timed out can NOT be resumed.
+			next := CmdDetach
+			if timedOut {
+				next = CmdLogout
 			}
 
-		case "login":
+			c.isConnErr.Store(true)
 			c.commands <- command{
-				id:     CmdLogout,
+				id:     next,
 				client: c,
 			}
 			c.commands <- command{
-				id:     CmdLogin,
+				id:     CmdDisconnect,
 				client: c,
-				args:   args,
 			}
+			_ = c.conn.Close()
+			conns.release(c.peer)
+			return
+		}
 
-		case "pwd":
-			c.commands <- command{
-				id:     CmdPwd,
-				client: c,
-			}
+		msg := strings.Trim(string(line), "\r\n")
 
-		case "write":
-			c.commands <- command{
-				id:     CmdWrite,
-				client: c,
-				args:   args,
-			}
+		// Data of a tunnel is NOT a command, see tunnel.go.
+		if structured && !tooLong && strings.HasPrefix(msg, "@") {
+			c.feedTunnel(msg[1:])
+			continue
+		}
 
-		case "read":
-			c.commands <- command{
-				id:     CmdRead,
-				client: c,
-				args:   args,
+		inJSON := structured
+		if inJSON {
+			id := ""
+			if !tooLong {
+				id, msg = splitRequestID(msg)
 			}
-
-		case "ls":
 			c.commands <- command{
-				id:     CmdLs,
+				id:     CmdBegin,
 				client: c,
-				args:   args,
+				args:   []string{id},
 			}
+		}
 
-		case "logout":
-			c.commands <- command{
-				id:     CmdLogout,
-				client: c,
-			}
+		switch {
+		case tooLong:
+			c.reply(statusBadRequest, fmt.Sprintf("The line is longer than %d bytes. Ignored.", reader.Size()), nil)
 
-		case "help":
-			c.commands <- command{
-				id:     CmdHelp,
-				client: c,
-				args:   args,
-			}
+		case !limiter.allow(time.Now()):
+			c.reply(statusTooMany, "Too many commands. Slow down.", nil)
 
-		case "rmuser":
-			c.commands <- command{
-				id:     CmdRmUser,
-				client: c,
-				args:   args,
+		default:
+			if c.dispatch(msg, lineNo == 1) {
+				structured = true
 			}
+		}
 
-		case "lsusers":
+		if inJSON {
 			c.commands <- command{
-				id:     CmdLsUsers,
+				id:     CmdEnd,
 				client: c,
 			}
+		}
+	}
+}
 
-		case "quit":
-			c.commands <- command{
-				id:     CmdLogout,
-				client: c,
-			}
-			c.commands <- command{
-				id:     CmdQuit,
-				client: c,
-			}
+// dispatch passes a line to the server's loop. It reports whether the line
+// has switched the session to the json protocol.
+func (c *client) dispatch(msg string, isFirstLine bool) bool {
+	c.recording().event("i", redactInput(msg)+"\n")
 
-		// lab 2
-		case "addgroup":
-			c.commands <- command{
-				id:     CmdAddGroup,
-				client: c,
-				args:   args,
-			}
+	args := strings.Split(msg, " ")
+	cmd := strings.TrimSpace(args[0])
 
-		case "u2g":
-			c.commands <- command{
-				id:     CmdU2G,
-				client: c,
-				args:   args,
-			}
+	if cmd != "proto" && !c.listener.allows(cmd) {
+		c.reply(statusForbidden, fmt.Sprintf("'%s' is NOT allowed on this connection.", cmd), nil)
+		return false
+	}
 
-		case "trimgroup":
-			c.commands <- command{
-				id:     CmdTrimGroup,
-				client: c,
-				args:   args,
-			}
+	switch cmd {
+	case "reg":
+		c.commands <- command{
+			id:     CmdReg,
+			client: c,
+			args:   args,
+		}
 
-		case "rmgroup":
-			c.commands <- command{
-				id:     CmdRmGroup,
-				client: c,
-				args:   args,
-			}
+	case "chpswd":
+		c.commands <- command{
+			id:     CmdChPswd,
+			client: c,
+			args:   args,
+		}
 
-		case "rr":
-			c.commands <- command{
-				id:     CmdRR,
-				client: c,
-				args:   args,
-			}
+	case "login":
+		c.commands <- command{
+			id:     CmdLogout,
+			client: c,
+		}
+		c.commands <- command{
+			id:     CmdLogin,
+			client: c,
+			args:   args,
+		}
 
-		case "chmod":
-			c.commands <- command{
-				id:     CmdChMod,
-				client: c,
-				args:   args,
-			}
+	case "pwd":
+		c.commands <- command{
+			id:     CmdPwd,
+			client: c,
+		}
 
-		// lab3
-		case "append":
-			c.commands <- command{
-				id:     CmdAppend,
-				client: c,
-				args:   args,
-			}
+	case "write":
+		c.commands <- command{
+			id:     CmdWrite,
+			client: c,
+			args:   args,
+		}
 
-		case "chmark":
-			c.commands <- command{
-				id:     CmdChMark,
-				client: c,
-				args:   args,
-			}
+	case "read":
+		c.commands <- command{
+			id:     CmdRead,
+			client: c,
+			args:   args,
+		}
 
-		case "gm":
-			c.commands <- command{
-				id:     CmdGM,
-				client: c,
-				args:   args,
-			}
+	case "ls":
+		c.commands <- command{
+			id:     CmdLs,
+			client: c,
+			args:   args,
+		}
+
+	case "logout":
+		c.commands <- command{
+			id:     CmdLogout,
+			client: c,
+		}
+
+	case "help":
+		c.commands <- command{
+			id:     CmdHelp,
+			client: c,
+			args:   args,
+		}
+
+	case "rmuser":
+		c.commands <- command{
+			id:     CmdRmUser,
+			client: c,
+			args:   args,
+		}
+
+	case "lsusers":
+		c.commands <- command{
+			id:     CmdLsUsers,
+			client: c,
+		}
+
+	case "quit":
+		c.commands <- command{
+			id:     CmdLogout,
+			client: c,
+		}
+		c.commands <- command{
+			id:     CmdQuit,
+			client: c,
+		}
+
+	// lab 2
+	case "addgroup":
+		c.commands <- command{
+			id:     CmdAddGroup,
+			client: c,
+			args:   args,
+		}
+
+	case "u2g":
+		c.commands <- command{
+			id:     CmdU2G,
+			client: c,
+			args:   args,
+		}
 
-		// lab4
-		case "watch":
+	case "trimgroup":
+		c.commands <- command{
+			id:     CmdTrimGroup,
+			client: c,
+			args:   args,
+		}
+
+	case "rmgroup":
+		c.commands <- command{
+			id:     CmdRmGroup,
+			client: c,
+			args:   args,
+		}
+
+	case "rr":
+		c.commands <- command{
+			id:     CmdRR,
+			client: c,
+			args:   args,
+		}
+
+	case "chmod":
+		c.commands <- command{
+			id:     CmdChMod,
+			client: c,
+			args:   args,
+		}
+
+	case "chgrp":
+		c.commands <- command{
+			id:     CmdChGrp,
+			client: c,
+			args:   args,
+		}
+
+	case "mkdir":
+		c.commands <- command{
+			id:     CmdMkdir,
+			client: c,
+			args:   args,
+		}
+
+	case "put":
+		c.commands <- command{
+			id:     CmdPut,
+			client: c,
+			args:   args,
+		}
+
+	case "get":
+		c.commands <- command{
+			id:     CmdRead,
+			client: c,
+			args:   args,
+		}
+
+	case "rm":
+		c.commands <- command{
+			id:     CmdRm,
+			client: c,
+			args:   args,
+		}
+
+	case "tunnel":
+		c.commands <- command{
+			id:     CmdTunnel,
+			client: c,
+			args:   args,
+		}
+
+	// lab3
+	case "append":
+		c.commands <- command{
+			id:     CmdAppend,
+			client: c,
+			args:   args,
+		}
+
+	case "chmark":
+		c.commands <- command{
+			id:     CmdChMark,
+			client: c,
+			args:   args,
+		}
+
+	case "gm":
+		c.commands <- command{
+			id:     CmdGM,
+			client: c,
+			args:   args,
+		}
+
+	// lab4
+	case "watch":
+		c.commands <- command{
+			id:     CmdWatch,
+			client: c,
+			args:   args,
+		}
+
+	case "replay":
+		c.commands <- command{
+			id:     CmdReplay,
+			client: c,
+			args:   args,
+		}
+
+	case "who":
+		c.commands <- command{
+			id:     CmdWho,
+			client: c,
+		}
+
+	case "sessions":
+		c.commands <- command{
+			id:     CmdSessions,
+			client: c,
+		}
+
+	case "kill":
+		c.commands <- command{
+			id:     CmdKill,
+			client: c,
+			args:   args,
+		}
+
+	case "unlock":
+		c.commands <- command{
+			id:     CmdUnlock,
+			client: c,
+			args:   args,
+		}
+
+	case "keylogin":
+		c.commands <- command{
+			id:     CmdKeyLogin,
+			client: c,
+			args:   args,
+		}
+
+	case "keyauth":
+		c.commands <- command{
+			id:     CmdKeyAuth,
+			client: c,
+			args:   args,
+		}
+
+	case "addkey":
+		c.commands <- command{
+			id:     CmdAddKey,
+			client: c,
+			args:   args,
+		}
+
+	case "lskey":
+		c.commands <- command{
+			id:     CmdLsKey,
+			client: c,
+		}
+
+	case "rmkey":
+		c.commands <- command{
+			id:     CmdRmKey,
+			client: c,
+			args:   args,
+		}
+
+	case "otp":
+		c.commands <- command{
+			id:     CmdOTP,
+			client: c,
+			args:   args,
+		}
+
+	case "2fa":
+		c.commands <- command{
+			id:     CmdTwoFA,
+			client: c,
+			args:   args,
+		}
+
+	case "passwd":
+		c.commands <- command{
+			id:     CmdPasswd,
+			client: c,
+			args:   args,
+		}
+
+	case "reload":
+		c.commands <- command{
+			id:     CmdReload,
+			client: c,
+		}
+
+	case "complete":
+		c.commands <- command{
+			id:     CmdComplete,
+			client: c,
+			args:   args,
+		}
+
+	case "resume":
+		if len(args) > 1 {
 			c.commands <- command{
-				id:     CmdWatch,
+				id:     CmdLogout,
 				client: c,
-				args:   args,
 			}
+		}
+		c.commands <- command{
+			id:     CmdResume,
+			client: c,
+			args:   args,
+		}
 
-		default:
-			c.err(fmt.Errorf(`unknown command "%s"`, cmd))
+	case "proto":
+		if !isFirstLine {
+			c.reply(statusBadRequest, "'proto' must be the first line of a connection.", nil)
+			return false
+		}
+		c.commands <- command{
+			id:     CmdProto,
+			client: c,
+			args:   args,
 		}
+		return len(args) > 1 && args[1] == "json"
+
+	default:
+		c.reply(statusBadRequest, "", fmt.Errorf(`unknown command "%s"`, cmd))
+	}
+
+	return false
+}
+
+// reply answers a line without running it. The reply goes through the
+// server's loop, so that it comes after the replies to the earlier lines.
+func (c *client) reply(status int, msg string, err error) {
+	c.commands <- command{
+		id:     CmdReply,
+		client: c,
+		args:   []string{msg},
+		status: status,
+		err:    err,
+	}
+}
+
+func (c *client) restrict(reason string, until commandID) {
+	if c.restrictions == nil {
+		c.restrictions = make(map[commandID]string)
+	}
+	c.restrictions[until] = reason
+	c.restriction = reason
+}
+
+func (c *client) unrestrict(id commandID) {
+	delete(c.restrictions, id)
+
+	c.restriction = ""
+	for _, reason := range c.restrictions {
+		c.restriction = reason
+		break
+	}
+}
+
+func (c *client) isAllowed(id commandID) bool {
+	if len(c.restrictions) == 0 {
+		return true
 	}
+
+	switch id {
+	case CmdLogin, CmdLogout, CmdQuit, CmdHelp, CmdJoin, CmdDisconnect, CmdComplete, CmdDetach, CmdExpire:
+		return true
+	}
+
+	_, ok := c.restrictions[id]
+	return ok
 }
 
 func (c *client) err(err error) {
-	if c.isConnErr {
+	if c.isConnErr.Load() {
 		return
 	}
 
-	write, err := c.conn.Write([]byte("Error: " + err.Error() + "\n"))
-	if err != nil {
-		log.Printf("Error c.err(): %s. Bytes written: %d", err.Error(), write)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		c.status(statusNotFound)
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, errAboveRoot):
+		c.status(statusForbidden)
+	}
+
+	out := "Error: " + err.Error() + "\n"
+	c.recording().event("o", out)
+
+	if c.structured {
+		c.collect(err.Error(), true)
 		return
 	}
+	c.write(out, "c.err()")
 }
 
 func (c *client) msg(msg string) {
-	if c.isConnErr {
+	c.secretMsg(msg, msg)
+}
+
+// secretMsg is msg, but the recording gets the recorded text instead.
+func (c *client) secretMsg(msg string, recorded string) {
+	if c.isConnErr.Load() {
 		return
 	}
 
-	write, err := c.conn.Write([]byte("> " + msg + "\n"))
+	c.recording().event("o", "> "+recorded+"\n")
+
+	if c.structured {
+		c.collect(msg, false)
+		return
+	}
+	c.write("> "+msg+"\n", "c.msg()")
+}
+
+func (c *client) recording() *recorder {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	return c.rec
+}
+
+// setRecording replaces the recorder of c and returns the previous one.
+func (c *client) setRecording(r *recorder) *recorder {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	old := c.rec
+	c.rec = r
+	return old
+}
+
+func (c *client) write(out string, from string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if conf().writeTimeout > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(conf().writeTimeout))
+	}
+
+	write, err := c.conn.Write([]byte(out))
 	if err != nil {
-		log.Printf("Error c.msg(): %s. Bytes written: %d", err.Error(), write)
+		log.Printf("Error %s: %s. Bytes written: %d", from, err.Error(), write)
+		_ = c.conn.Close() // a client that does NOT take its replies is dropped
 		return
 	}
 }
@@ -29,10 +29,46 @@ const (
 	CmdChMark
 	CmdGM
 	CmdWatch
+	CmdReplay
+
+	CmdJoin
+	CmdDisconnect
+	CmdWho
+	CmdSessions
+	CmdKill
+	CmdUnlock
+	CmdKeyLogin
+	CmdKeyAuth
+	CmdAddKey
+	CmdLsKey
+	CmdRmKey
+	CmdOTP
+	CmdTwoFA
+	CmdPasswd
+	CmdReload
+	CmdShutdown
+	CmdComplete
+	CmdReply
+	CmdProto
+	CmdBegin
+	CmdEnd
+	CmdResume
+	CmdDetach
+	CmdExpire
+	CmdChGrp
+	CmdMkdir
+	CmdPut
+	CmdRm
+	CmdTunnel
+	CmdTunnelUp     // a local tunnel has connected, see tunnel.go
+	CmdTunnelAccept // a tunnel listener has accepted a connection
+	CmdTunnelEnd    // a side of a tunnel has ended its data
 )
 
 type command struct {
 	id     commandID
 	client *client
 	args   []string
+	status int   // of CmdReply
+	err    error // of CmdReply
 }
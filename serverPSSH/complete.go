@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// complete answers the completion requests of interactive clients:
+// "complete (state|path|user|group) {prefix}". The candidates are sent on
+// one line, as names can NOT contain spaces.
+func (s *server) complete(c *client, args []string) {
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "complete (state|path|user|group) {prefix}"`)
+		return
+	}
+
+	if args[1] == "state" {
+		if !c.isLoggedIn {
+			c.msg("State: - -")
+			return
+		}
+		c.msg(fmt.Sprintf("State: %s %s", c.nick, c.currDir))
+		c.setData(map[string]string{"nick": c.nick, "dir": c.currDir})
+		return
+	}
+
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	prefix := ""
+	if len(args) > 2 {
+		prefix = args[2]
+	}
+
+	var candidates []string
+	switch args[1] {
+	case "path":
+		candidates = completePath(c, prefix)
+
+	case "user":
+		if !c.isAdmin {
+			candidates = matchPrefix([]string{c.nick}, prefix)
+			break
+		}
+		candidates = matchPrefix(jsonNames(db_path), prefix)
+
+	case "group":
+		if !c.isAdmin {
+			c.groups = c.groups[:0]
+			appendGroups(c)
+			candidates = matchPrefix(c.groups, prefix)
+			break
+		}
+		candidates = matchPrefix(jsonNames(group_path), prefix)
+
+	default:
+		c.status(statusBadRequest)
+		c.msg("First option must be either of 'state', 'path', 'user', 'group'")
+		return
+	}
+
+	c.msg("Completions: " + strings.Join(candidates, " "))
+	c.setData(candidates)
+}
+
+// completePath lists the entries of the directory of prefix that start with
+// its last element. Directories end with '/'.
+func completePath(c *client, prefix string) []string {
+	dir, base := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, base = prefix[:i+1], prefix[i+1:]
+	}
+
+	path, err := getPathToFile(c, dir)
+	if err != nil || !strings.HasPrefix(path, users_path) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), base) {
+			continue
+		}
+
+		name := dir + entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		candidates = append(candidates, name)
+	}
+
+	return candidates
+}
+
+func jsonNames(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+
+	var names []string
+	for _, file := range matches {
+		names = append(names, strings.TrimSuffix(filepath.Base(file), ".json"))
+	}
+
+	return names
+}
+
+func matchPrefix(names []string, prefix string) []string {
+	var matched []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			matched = append(matched, name)
+		}
+	}
+	sort.Strings(matched)
+
+	return matched
+}
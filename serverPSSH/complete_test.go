@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	h := newHarness(t)
+
+	root := h.login("10.0.0.1", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	h.do(root, "addgroup devs")
+	h.do(root, "addgroup dbas")
+	h.do(root, "u2g devs dan")
+	dan := h.login("10.0.0.2", "dan", "Pw4Tests_x9")
+	_ = os.MkdirAll(dan.actDir+"/docs", os.ModePerm)
+	h.do(dan, "write data.txt 42")
+	anon, _ := h.connect("10.0.0.3")
+
+	tests := []struct {
+		name string
+		c    *client
+		line string
+		want string
+	}{
+		{"state of a guest", anon, "complete state", "State: - -"},
+		{"state", dan, "complete state", "State: dan " + dan.currDir},
+		{"needs a login", anon, "complete path d", "You must log in first."},
+		{"paths", dan, "complete path d", "Completions: data.txt docs/"},
+		{"users of an admin", root, "complete user d", "Completions: dan"},
+		{"users of a user", dan, "complete user r", "Completions: \n"},
+		{"groups of an admin", root, "complete group d", "Completions: dbas devs"},
+		{"groups of a user", dan, "complete group d", "Completions: devs\n"},
+		{"unknown kind", dan, "complete file d", "First option must be either of"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(tt.c, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+}
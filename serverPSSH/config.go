@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miracl/conflate"
+	"github.com/tidwall/gjson"
+)
+
+// settings are the values the server runs with. A published value is never
+// changed, a reload publishes a new one, so that a reader sees either all of
+// the old settings or all of the new ones.
+type settings struct {
+	values map[string]string // of every flag, as given
+
+	configPath     string
+	listenAddr     string
+	dataRoot       string
+	defaultMark    uint64
+	defaultRights  string
+	fileModeValue  string
+	auditSinksPath string
+	banner         string
+
+	keepAlive       time.Duration
+	idleTimeout     time.Duration
+	loginTimeout    time.Duration
+	loginPolicy     string
+	maxLogins       int
+	resumeTimeout   time.Duration
+	shutdownTimeout time.Duration
+
+	maxConns        int
+	maxConnsPerPeer int
+	maxLineLength   int
+	rateLimit       float64
+	rateBurst       int
+	writeTimeout    time.Duration
+
+	lockoutThreshold   int
+	ipLockoutThreshold int
+	lockoutDuration    time.Duration
+	loginBackoff       time.Duration
+
+	pswdMinLength   int
+	pswdClasses     int
+	pswdHistorySize int
+	pswdDictionary  string
+	pswdMaxAge      time.Duration
+
+	require2FAAdmins bool
+	require2FAMark   uint64
+	recordingKeyPath string
+	recordMark       uint64
+	maxUpload        int
+	maxTunnels       int
+
+	tunnelDialTimeout time.Duration
+
+	// Derived by validate.
+	fileMode      os.FileMode
+	newFileRights int64
+
+	// Loaded along with the settings.
+	dictionary   map[string]bool
+	forwardRules []*forwardRule
+	forwarding   string // the 'forwarding' section the rules are made of
+}
+
+var current atomic.Pointer[settings]
+
+// conf returns the settings in effect.
+func conf() *settings {
+	return current.Load()
+}
+
+// bindFlags defines the flags of the server on fs, to be parsed into st.
+func bindFlags(fs *flag.FlagSet, st *settings) {
+	fs.StringVar(&st.configPath, "config", "", "Configuration file (JSON, YAML or TOML), flags given on the command line override it")
+	fs.StringVar(&st.listenAddr, "listen", ":8888", "Comma separated addresses to listen on, 'unix:path' for a unix socket, unless the configuration file has 'listeners'")
+	fs.StringVar(&st.dataRoot, "data-root", "", "Directory with db/, users/, group/, files/, audits/ and file_audits/, other relative paths are resolved against it")
+	fs.Uint64Var(&st.defaultMark, "default-mark", 50, "Mark of new users without {cm}, of new files and of the group 'users'")
+	fs.StringVar(&st.defaultRights, "default-rights", "1110", "Rights of new files, as for chmod")
+	fs.StringVar(&st.fileModeValue, "file-mode", "0755", "Permission of the files the server writes, in octal")
+	fs.StringVar(&st.auditSinksPath, "audit-sinks", db_sinks, "Audit sinks file, used unless the configuration file has 'sinks'")
+	fs.StringVar(&st.banner, "banner", "", "Text shown to every new connection")
+
+	fs.DurationVar(&st.keepAlive, "keepalive", 30*time.Second, "TCP keepalive period, a negative value disables keepalives")
+	fs.DurationVar(&st.idleTimeout, "idle-timeout", 0, "Disconnect sessions idle for longer than this, 0 disables it")
+	fs.DurationVar(&st.loginTimeout, "login-timeout", time.Minute, "Disconnect connections NOT logged in within this, 0 disables it")
+	fs.StringVar(&st.loginPolicy, "login-policy", "deny", "Concurrent logins of one user: 'deny', 'allow' or 'kick'")
+	fs.IntVar(&st.maxLogins, "max-logins", 1, "Concurrent logins of one user for the 'allow' and 'kick' policies")
+	fs.DurationVar(&st.resumeTimeout, "resume-timeout", 2*time.Minute, "How long a session whose connection has dropped can be resumed, 0 disables resuming")
+	fs.DurationVar(&st.shutdownTimeout, "shutdown-timeout", 10*time.Second, "How long a shutdown waits for sessions and audit sinks")
+
+	fs.IntVar(&st.maxConns, "max-conns", 1000, "Connections the server accepts at once, 0 means no limit")
+	fs.IntVar(&st.maxConnsPerPeer, "max-conns-per-ip", 20, "Connections accepted at once from one IP or unix user, 0 means no limit")
+	fs.IntVar(&st.maxLineLength, "max-line", 4096, "Longest command line in bytes")
+	fs.Float64Var(&st.rateLimit, "rate-limit", 10, "Commands per second a session may run on average, 0 disables it")
+	fs.IntVar(&st.rateBurst, "rate-burst", 20, "Commands a session may run at once above the rate limit")
+	fs.DurationVar(&st.writeTimeout, "write-timeout", 10*time.Second, "Time a client gets to take a reply before it is disconnected, 0 disables it")
+
+	fs.IntVar(&st.lockoutThreshold, "lockout-threshold", 5, "Failed logins of an account before it is locked, 0 disables it")
+	fs.IntVar(&st.ipLockoutThreshold, "ip-lockout-threshold", 20, "Failed logins from an IP before it is locked, 0 disables it")
+	fs.DurationVar(&st.lockoutDuration, "lockout-duration", 15*time.Minute, "How long a lockout lasts, also the time after which failures are forgotten")
+	fs.DurationVar(&st.loginBackoff, "login-backoff", time.Second, "Delay after the first failed login, doubled on every next failure")
+
+	fs.IntVar(&st.pswdMinLength, "pswd-min-length", 8, "Minimal length of a password")
+	fs.IntVar(&st.pswdClasses, "pswd-classes", 2, "Character classes (lower, upper, digits, others) a password must contain")
+	fs.IntVar(&st.pswdHistorySize, "pswd-history", 5, "Previous passwords a new one must NOT repeat, 0 disables it")
+	fs.StringVar(&st.pswdDictionary, "pswd-dictionary", "", "File of forbidden words, one per line")
+	fs.DurationVar(&st.pswdMaxAge, "pswd-max-age", 0, "Passwords older than this must be changed at next login, 0 disables it")
+
+	fs.BoolVar(&st.require2FAAdmins, "require-2fa-admins", false, "Require two-factor authentication for admins")
+	fs.Uint64Var(&st.require2FAMark, "require-2fa-mark", 0, "Require two-factor authentication for users with a max mark above this, 0 disables it")
+	fs.StringVar(&st.recordingKeyPath, "recording-key", "", "File with the secret that seals finished recordings, none are sealed without it")
+	fs.Uint64Var(&st.recordMark, "record-mark", 80, "Users with a max mark of at least this are always recorded")
+	fs.IntVar(&st.maxUpload, "max-upload", 16<<20, "Largest file in bytes a session can upload with 'put'")
+	fs.IntVar(&st.maxTunnels, "max-tunnels", 8, "Tunnels and tunnel listeners a session may have open at once")
+	fs.DurationVar(&st.tunnelDialTimeout, "tunnel-dial-timeout", 10*time.Second, "Time a tunnel gets to connect to its destination")
+}
+
+// config holds what is read from the configuration file. Its settings are
+// named after the flags, e.g. {"listen": ":2222", "idle-timeout": "5m"}.
+type config struct {
+	path     string
+	settings map[string]string
+	sinks    string // raw JSON of the 'sinks' section, if any
+	listens  string // raw JSON of the 'listeners' section, if any
+
+	forwarding string // raw JSON of the 'forwarding' section, if any
+}
+
+func readConfig(path string) (*config, error) {
+	cfg := &config{path: path, settings: make(map[string]string)}
+	if path == "" {
+		return cfg, nil
+	}
+
+	c, err := conflate.FromFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %s", path, err.Error())
+	}
+	data, err := c.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %s", path, err.Error())
+	}
+
+	var unknown []string
+	gjson.ParseBytes(data).ForEach(func(key, value gjson.Result) bool {
+		name := key.String()
+		switch {
+		case name == "sinks":
+			cfg.sinks = value.Raw
+		case name == "listeners":
+			cfg.listens = value.Raw
+		case name == "forwarding":
+			cfg.forwarding = value.Raw
+		case name == "config" || flag.Lookup(name) == nil:
+			unknown = append(unknown, name)
+		case value.IsObject() || value.IsArray():
+			unknown = append(unknown, name+" (must be a single value)")
+		default:
+			cfg.settings[name] = value.String()
+		}
+		return true
+	})
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("'%s': unknown settings: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return cfg, nil
+}
+
+// cmdLine holds the flags parsed from the command line. Only the given ones
+// are taken, see explicitFlags.
+var cmdLine settings
+
+func init() {
+	bindFlags(flag.CommandLine, &cmdLine)
+}
+
+// explicitFlags returns the flags given on the command line, which override
+// the configuration file on every reload too.
+func explicitFlags() map[string]string {
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	return explicit
+}
+
+// values returns the settings of the file with the explicit flags over them.
+func (cfg *config) values(explicit map[string]string) map[string]string {
+	values := make(map[string]string)
+	for name, value := range cfg.settings {
+		values[name] = value
+	}
+	for name, value := range explicit {
+		values[name] = value
+	}
+	return values
+}
+
+// newSettings makes settings of values, the others keep their defaults.
+// The result is NOT validated yet.
+func newSettings(values map[string]string, source string) (*settings, error) {
+	st := &settings{values: make(map[string]string)}
+	fs := flag.NewFlagSet(source, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bindFlags(fs, st)
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := fs.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("'%s': setting '%s': %s", source, name, err.Error())
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		st.values[f.Name] = f.Value.String()
+	})
+	return st, nil
+}
+
+// validate checks all the settings together, so that every problem is
+// reported at once, and derives the values used at run time.
+func (st *settings) validate() error {
+	var problems []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(st.listenAddr != "", "listen must NOT be empty")
+	if st.dataRoot != "" {
+		root := st.dataRoot
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(startDir, root)
+		}
+		fi, err := os.Stat(root)
+		check(err == nil && fi.IsDir(), "data-root '%s' must be an existing directory", st.dataRoot)
+	}
+
+	rights, err := strconv.ParseInt(st.defaultRights, 2, 5)
+	check(err == nil && len(st.defaultRights) == 4, "default-rights must be 4 binary digits, e.g. '1110'")
+
+	mode, err := strconv.ParseUint(st.fileModeValue, 8, 32)
+	check(err == nil && mode <= 0777, "file-mode must be an octal permission, e.g. '0755'")
+	check(err != nil || mode&0600 == 0600, "file-mode must let the server read and write its files")
+
+	check(st.loginPolicy == "deny" || st.loginPolicy == "allow" || st.loginPolicy == "kick",
+		"login-policy must be either of 'deny', 'allow', 'kick'")
+	check(st.maxLogins >= 1, "max-logins must be >= 1")
+	check(st.idleTimeout >= 0, "idle-timeout must be >= 0")
+	check(st.loginTimeout >= 0, "login-timeout must be >= 0")
+	check(st.shutdownTimeout > 0, "shutdown-timeout must be > 0")
+	check(st.writeTimeout >= 0, "write-timeout must be >= 0")
+
+	check(st.maxConns >= 0, "max-conns must be >= 0")
+	check(st.maxConnsPerPeer >= 0, "max-conns-per-ip must be >= 0")
+	check(st.maxLineLength >= 64, "max-line must be >= 64")
+	check(st.rateLimit >= 0, "rate-limit must be >= 0")
+	check(st.rateBurst >= 1, "rate-burst must be >= 1")
+
+	check(st.lockoutThreshold >= 0, "lockout-threshold must be >= 0")
+	check(st.ipLockoutThreshold >= 0, "ip-lockout-threshold must be >= 0")
+	check(st.lockoutDuration > 0, "lockout-duration must be > 0")
+	check(st.loginBackoff >= 0, "login-backoff must be >= 0")
+
+	check(st.pswdMinLength >= 0, "pswd-min-length must be >= 0")
+	check(st.pswdClasses >= 0 && st.pswdClasses <= 4, "pswd-classes must be between 0 and 4")
+	check(st.pswdHistorySize >= 0, "pswd-history must be >= 0")
+	check(st.pswdMaxAge >= 0, "pswd-max-age must be >= 0")
+
+	check(st.maxTunnels >= 0, "max-tunnels must be >= 0")
+	check(st.tunnelDialTimeout > 0, "tunnel-dial-timeout must be > 0")
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	st.fileMode = os.FileMode(mode)
+	st.newFileRights = rights
+	return nil
+}
+
+// configuredListeners prefers the 'listeners' section of the configuration
+// file to the listen flag.
+func configuredListeners(cfg *config, st *settings) ([]*listener, error) {
+	if cfg.listens != "" {
+		return parseListeners(cfg.listens, cfg.path)
+	}
+
+	return listenersFromFlag(st.listenAddr)
+}
+
+// loadConfiguredSinks prefers the 'sinks' section of the configuration
+// file to the audit sinks file.
+func loadConfiguredSinks(cfg *config, st *settings) ([]*auditSink, string, error) {
+	if cfg.sinks != "" {
+		sinks, err := parseAuditSinks(cfg.sinks, cfg.path)
+		return sinks, cfg.sinks, err
+	}
+
+	return loadAuditSinks(st.auditSinksPath)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{"json", "c.json", `{"listen": ":2222", "idle-timeout": "5m", "max-logins": 3}`,
+			map[string]string{"listen": ":2222", "idle-timeout": "5m", "max-logins": "3"}, ""},
+		{"yaml", "c.yaml", "listen: \":2222\"\nrequire-2fa-admins: true\n",
+			map[string]string{"listen": ":2222", "require-2fa-admins": "true"}, ""},
+		{"toml", "c.toml", "listen = \":2222\"\nmax-conns = 10\n",
+			map[string]string{"listen": ":2222", "max-conns": "10"}, ""},
+		{"unknown settings", "c.json", `{"listen": ":2222", "colour": "red", "config": "x"}`, nil, "unknown settings: colour, config"},
+		{"object setting", "c.json", `{"listen": {"addr": ":2222"}}`, nil, "listen (must be a single value)"},
+		{"broken", "c.json", `{"listen": `, nil, "c.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := readConfig(writeConfig(t, tt.file, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := cfg.settings[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if len(cfg.settings) != len(tt.want) {
+				t.Errorf("settings = %v, want %v", cfg.settings, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigSections(t *testing.T) {
+	cfg, err := readConfig(writeConfig(t, "c.json", `{
+		"sinks": {"siem": {"format": "syslog", "network": "udp", "addr": "127.0.0.1:514"}},
+		"listeners": {"main": {"listen": ":2222"}},
+		"forwarding": {"lab": {"groups": ["lab"], "local": ["10.0.0.0/24:22"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(cfg.sinks, "siem") || !strings.Contains(cfg.listens, "main") || !strings.Contains(cfg.forwarding, "lab") {
+		t.Errorf("sections: sinks %q, listeners %q, forwarding %q", cfg.sinks, cfg.listens, cfg.forwarding)
+	}
+}
+
+func TestNewSettings(t *testing.T) {
+	cfg := &config{path: "c.json", settings: map[string]string{"idle-timeout": "5m", "max-logins": "3"}}
+	st, err := newSettings(cfg.values(map[string]string{"max-logins": "1"}), cfg.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.idleTimeout != 5*time.Minute {
+		t.Errorf("idle-timeout = %s, want 5m", st.idleTimeout)
+	}
+	if st.maxLogins != 1 {
+		t.Errorf("max-logins = %d, the command line must win", st.maxLogins)
+	}
+	if st.loginPolicy != "deny" || st.values["login-policy"] != "deny" {
+		t.Errorf("login-policy = %q, want the default", st.loginPolicy)
+	}
+
+	if _, err := newSettings(map[string]string{"max-logins": "many"}, "c.json"); err == nil || !strings.Contains(err.Error(), "'c.json': setting 'max-logins'") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		wantErr  []string
+	}{
+		{"defaults", nil, nil},
+		{"bad rights", map[string]string{"default-rights": "12"}, []string{"default-rights must be 4 binary digits"}},
+		{"bad file mode", map[string]string{"file-mode": "0999"}, []string{"file-mode must be an octal permission"}},
+		{"unreadable file mode", map[string]string{"file-mode": "0444"}, []string{"file-mode must let the server read and write"}},
+		{"every problem at once", map[string]string{"login-policy": "maybe", "max-logins": "0", "max-line": "10"},
+			[]string{"login-policy must be either of", "max-logins must be >= 1", "max-line must be >= 64"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := newSettings(tt.settings, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = st.validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if st.fileMode != 0755 || st.newFileRights != 0b1110 {
+					t.Errorf("derived file mode %o, rights %b", st.fileMode, st.newFileRights)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
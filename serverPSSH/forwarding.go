@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// forwardRule lets some users open tunnels to some destinations ("local",
+// as "ssh -L") and listen on some addresses of the server ("remote", as
+// "ssh -R").
+type forwardRule struct {
+	name   string
+	users  []string
+	groups []string
+	roles  []string // "admin" or "audit"
+	local  []addrPattern
+	remote []addrPattern
+}
+
+// addrPattern is "host:port" where host is a name, a shell pattern like
+// "*.lab", an IP address or a CIDR block like "10.0.0.0/8", and port is a
+// number, a range like "9000-9100" or "*".
+type addrPattern struct {
+	host      string
+	ip        net.IP
+	block     *net.IPNet
+	low, high int
+}
+
+// parseForwarding reads the 'forwarding' section of the configuration file,
+// e.g.
+//
+//	{"lab":    {"groups": ["lab"], "local": ["10.0.0.0/24:22", "db.lab:5432"]},
+//	 "admins": {"roles": ["admin"], "local": ["*:*"], "remote": ["127.0.0.1:9000-9100"]}}
+func parseForwarding(db string, source string) ([]*forwardRule, error) {
+	var rules []*forwardRule
+	var rErr error
+	gjson.Parse(db).ForEach(func(key, value gjson.Result) bool {
+		var r *forwardRule
+		r, rErr = parseForwardRule(key.String(), value)
+		if rErr != nil {
+			return false
+		}
+		rules = append(rules, r)
+		return true
+	})
+	if rErr != nil {
+		return nil, fmt.Errorf("'%s': %s", source, rErr.Error())
+	}
+
+	return rules, nil
+}
+
+func parseForwardRule(name string, v gjson.Result) (*forwardRule, error) {
+	if !v.IsObject() {
+		return nil, fmt.Errorf("forwarding '%s' must be an object", name)
+	}
+
+	r := &forwardRule{name: name}
+	for _, u := range v.Get("users").Array() {
+		r.users = append(r.users, u.String())
+	}
+	for _, g := range v.Get("groups").Array() {
+		r.groups = append(r.groups, g.String())
+	}
+	for _, role := range v.Get("roles").Array() {
+		if role.String() != "admin" && role.String() != "audit" {
+			return nil, fmt.Errorf("forwarding '%s': roles must be either of 'admin', 'audit'", name)
+		}
+		r.roles = append(r.roles, role.String())
+	}
+	if len(r.users)+len(r.groups)+len(r.roles) == 0 {
+		return nil, fmt.Errorf("forwarding '%s': users, groups or roles are required", name)
+	}
+
+	var err error
+	if r.local, err = parseAddrPatterns(v.Get("local")); err != nil {
+		return nil, fmt.Errorf("forwarding '%s': local: %s", name, err.Error())
+	}
+	if r.remote, err = parseAddrPatterns(v.Get("remote")); err != nil {
+		return nil, fmt.Errorf("forwarding '%s': remote: %s", name, err.Error())
+	}
+	if len(r.local)+len(r.remote) == 0 {
+		return nil, fmt.Errorf("forwarding '%s': local or remote addresses are required", name)
+	}
+
+	return r, nil
+}
+
+func parseAddrPatterns(v gjson.Result) ([]addrPattern, error) {
+	var patterns []addrPattern
+	for _, s := range v.Array() {
+		p, err := parseAddrPattern(s.String())
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func parseAddrPattern(s string) (addrPattern, error) {
+	var p addrPattern
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return p, fmt.Errorf("'%s' must be \"host:port\"", s)
+	}
+
+	switch {
+	case strings.Contains(host, "/"):
+		if _, p.block, err = net.ParseCIDR(host); err != nil {
+			return p, fmt.Errorf("'%s': %s", s, err.Error())
+		}
+	case net.ParseIP(host) != nil:
+		p.ip = net.ParseIP(host)
+	default:
+		p.host = strings.ToLower(host)
+		if _, err := path.Match(p.host, ""); err != nil {
+			return p, fmt.Errorf("'%s': %s", s, err.Error())
+		}
+	}
+
+	p.low, p.high = 1, 65535
+	if port != "*" {
+		low, high, isRange := strings.Cut(port, "-")
+		if !isRange {
+			high = low
+		}
+		p.low, err = strconv.Atoi(low)
+		if err == nil {
+			p.high, err = strconv.Atoi(high)
+		}
+		if err != nil || p.low < 1 || p.high > 65535 || p.low > p.high {
+			return p, fmt.Errorf("'%s': port must be a number, a range like '9000-9100' or '*'", s)
+		}
+	}
+
+	return p, nil
+}
+
+// matches reports whether host:port is allowed by the pattern. Names are
+// NOT resolved, a CIDR block matches only IP addresses.
+func (p addrPattern) matches(host string, port int) bool {
+	if port < p.low || port > p.high {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case p.block != nil:
+		return ip != nil && p.block.Contains(ip)
+	case p.ip != nil:
+		return ip != nil && p.ip.Equal(ip)
+	default:
+		ok, _ := path.Match(p.host, strings.ToLower(host))
+		return ok
+	}
+}
+
+// appliesTo reports whether the rule is of the user of c.
+func (r *forwardRule) appliesTo(c *client) bool {
+	for _, u := range r.users {
+		if u == c.nick {
+			return true
+		}
+	}
+	for _, g := range r.groups {
+		for _, cg := range c.groups {
+			if g == cg {
+				return true
+			}
+		}
+	}
+	for _, role := range r.roles {
+		if role == "admin" && c.isAdmin || role == "audit" && c.isAudit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardingRule returns the name of the first rule that lets c open a
+// tunnel of the kind ("local" or "remote") to addr, or "" if none does.
+// Without any rules, nobody may open tunnels.
+func forwardingRule(c *client, kind string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return ""
+	}
+
+	for _, r := range conf().forwardRules {
+		if !r.appliesTo(c) {
+			continue
+		}
+
+		patterns := r.local
+		if kind == "remote" {
+			patterns = r.remote
+		}
+		for _, p := range patterns {
+			if p.matches(host, n) {
+				return r.name
+			}
+		}
+	}
+
+	return ""
+}
+
+// loadConfiguredForwarding reads the 'forwarding' section of the
+// configuration file, if any.
+func loadConfiguredForwarding(cfg *config) ([]*forwardRule, error) {
+	if cfg.forwarding == "" {
+		return nil, nil
+	}
+
+	rules, err := parseForwarding(cfg.forwarding, cfg.path)
+	if err == nil && len(rules) == 0 {
+		err = fmt.Errorf("'%s': forwarding must NOT be empty, remove it to disable tunnels", cfg.path)
+	}
+	return rules, err
+}
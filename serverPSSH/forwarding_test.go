@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAddrPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		port    int
+		want    bool
+	}{
+		{"10.0.0.0/24:22", "10.0.0.7", 22, true},
+		{"10.0.0.0/24:22", "10.0.1.7", 22, false},
+		{"10.0.0.0/24:22", "10.0.0.7", 23, false},
+		{"10.0.0.0/24:22", "host.lab", 22, false},
+		{"db.lab:5432", "DB.lab", 5432, true},
+		{"*.lab:9000-9100", "web.lab", 9050, true},
+		{"*.lab:9000-9100", "web.lab", 9101, false},
+		{"*:*", "example.com", 1, true},
+		{"[::1]:80", "0:0::1", 80, true},
+	}
+
+	for _, tt := range tests {
+		p, err := parseAddrPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.pattern, err)
+		}
+		if got := p.matches(tt.host, tt.port); got != tt.want {
+			t.Errorf("%q matches %s:%d = %v, want %v", tt.pattern, tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"db.lab", ":22", "10.0.0.0/33:22", "db.lab:0", "db.lab:9100-9000", "db.lab:ssh", "[a:22"} {
+		if _, err := parseAddrPattern(bad); err == nil {
+			t.Errorf("%q is accepted", bad)
+		}
+	}
+}
+
+func TestParseForwarding(t *testing.T) {
+	tests := []struct {
+		name    string
+		db      string
+		wantErr string
+	}{
+		{"not an object", `{"lab": []}`, "forwarding 'lab' must be an object"},
+		{"nobody", `{"lab": {"local": ["*:22"]}}`, "users, groups or roles are required"},
+		{"unknown role", `{"lab": {"roles": ["root"], "local": ["*:22"]}}`, "roles must be either of 'admin', 'audit'"},
+		{"no addresses", `{"lab": {"users": ["dan"]}}`, "local or remote addresses are required"},
+		{"bad address", `{"lab": {"users": ["dan"], "remote": ["*:x"]}}`, "forwarding 'lab': remote: '*:x'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseForwarding(tt.db, "config.json")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForwardingRule(t *testing.T) {
+	rules, err := parseForwarding(`{
+		"lab":    {"groups": ["lab"], "local": ["10.0.0.0/24:22"]},
+		"dan":    {"users": ["dan"], "local": ["db.lab:5432"]},
+		"admins": {"roles": ["admin"], "local": ["*:*"], "remote": ["127.0.0.1:9000-9100"]}
+	}`, "config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.forwardRules = rules })
+
+	dan := &client{nick: "dan", groups: []string{"lab"}}
+	eve := &client{nick: "eve"}
+	root := &client{nick: "root", isAdmin: true}
+
+	tests := []struct {
+		name string
+		c    *client
+		kind string
+		addr string
+		want string
+	}{
+		{"by a group", dan, "local", "10.0.0.5:22", "lab"},
+		{"by the user", dan, "local", "db.lab:5432", "dan"},
+		{"NOT listed", dan, "local", "db.lab:22", ""},
+		{"remote of a user", dan, "remote", "127.0.0.1:9000", ""},
+		{"nobody's rule", eve, "local", "10.0.0.5:22", ""},
+		{"by a role", root, "local", "example.com:443", "admins"},
+		{"remote by a role", root, "remote", "127.0.0.1:9000", "admins"},
+		{"remote NOT listed", root, "remote", "0.0.0.0:9000", ""},
+		{"no port", root, "local", "example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardingRule(tt.c, tt.kind, tt.addr); got != tt.want {
+				t.Errorf("forwardingRule(%s, %s, %s) = %q, want %q", tt.c.nick, tt.kind, tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/miracl/conflate v1.3.1
 	github.com/tidwall/gjson v1.14.2
 	github.com/tidwall/sjson v1.2.5
+	golang.org/x/term v0.0.0-20220722155259-a9ba230a4035
 )
 
 require (
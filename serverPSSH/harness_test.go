@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+
+	st, err := newSettings(nil, "defaults")
+	if err == nil {
+		err = st.validate()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	current.Store(st)
+
+	os.Exit(m.Run())
+}
+
+// testConn is a connection that keeps whatever the server writes.
+type testConn struct {
+	mu     sync.Mutex
+	out    strings.Builder
+	closed chan struct{}
+	once   sync.Once
+	remote net.Addr
+}
+
+// newTestConn is a connection from peer, an IP address with or without a
+// port.
+func newTestConn(peer string) *testConn {
+	if _, _, err := net.SplitHostPort(peer); err != nil {
+		peer = net.JoinHostPort(peer, "0")
+	}
+	remote, _ := net.ResolveTCPAddr("tcp", peer)
+	return &testConn{closed: make(chan struct{}), remote: remote}
+}
+
+func (tc *testConn) Read(b []byte) (int, error) {
+	<-tc.closed
+	return 0, io.EOF
+}
+
+func (tc *testConn) Write(b []byte) (int, error) {
+	select {
+	case <-tc.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.out.Write(b)
+}
+
+func (tc *testConn) Close() error {
+	tc.once.Do(func() { close(tc.closed) })
+	return nil
+}
+
+func (tc *testConn) isClosed() bool {
+	select {
+	case <-tc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (tc *testConn) output() string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.out.String()
+}
+
+func (tc *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (tc *testConn) RemoteAddr() net.Addr               { return tc.remote }
+func (tc *testConn) SetDeadline(t time.Time) error      { return nil }
+func (tc *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (tc *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// harness is a server in a fresh data root with the admin "root". Commands
+// are handled by the test itself, in place of s.run.
+type harness struct {
+	t *testing.T
+	s *server
+	l *listener
+}
+
+const rootPswd = "Sup3rSecret"
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	inTempDir(t)
+
+	if err := bootstrap([]string{"root"}, strings.NewReader(rootPswd+"\n"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	return &harness{
+		t: t,
+		s: newServer(),
+		l: &listener{name: "test", network: "tcp", addr: ":0", admin: true},
+	}
+}
+
+// connect joins a new client from peer.
+func (h *harness) connect(peer string) (*client, *testConn) {
+	conn := newTestConn(peer)
+	c := h.s.newClient(conn, h.l, peerOf(conn, h.l))
+	h.s.join(c)
+	return c, conn
+}
+
+// do runs a command line of c and returns what it has written meanwhile.
+func (h *harness) do(c *client, line string) string {
+	conn := c.conn.(*testConn)
+	before := len(conn.output())
+
+	done := make(chan struct{})
+	go func() {
+		c.dispatch(line, false)
+		close(done)
+	}()
+
+	for {
+		select {
+		case cmd := <-h.s.commands:
+			cmd.client.inRequest = true
+			h.s.handle(cmd)
+			cmd.client.inRequest = false
+		case <-done:
+			return conn.output()[before:]
+		}
+	}
+}
+
+// login connects a new client from peer and logs it in.
+func (h *harness) login(peer string, nick string, pswd string) *client {
+	h.t.Helper()
+	c, _ := h.connect(peer)
+	if out := h.do(c, "login "+nick+" "+pswd); !strings.Contains(out, "You have successfully logged in.") {
+		h.t.Fatalf("login %s: %q", nick, out)
+	}
+	return c
+}
+
+// serve runs the server loop for the rest of the test, for sessions made by
+// dial. The harness can NOT do commands meanwhile.
+func (h *harness) serve() {
+	go h.s.run()
+	h.t.Cleanup(func() { close(h.s.commands) })
+}
+
+// wire is the client end of a session read by its own readInput.
+type wire struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+}
+
+// dial connects a new session from peer over a pipe.
+func (h *harness) dial(peer string) *wire {
+	server, conn := net.Pipe()
+	conns.acquire(peer)
+	c := h.s.newClient(server, h.l, peer)
+
+	done := make(chan struct{})
+	go func() {
+		c.readInput()
+		close(done)
+	}()
+	h.t.Cleanup(func() {
+		_ = conn.Close()
+		<-done
+	})
+
+	w := &wire{t: h.t, conn: conn, lines: make(chan string, 16)}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			w.lines <- scanner.Text()
+		}
+		close(w.lines)
+	}()
+	return w
+}
+
+// send writes a line and returns the first line written back.
+func (w *wire) send(line string) string {
+	w.t.Helper()
+	if _, err := w.conn.Write([]byte(line + "\n")); err != nil {
+		w.t.Fatal(err)
+	}
+	return w.next()
+}
+
+// next returns the next line written by the server.
+func (w *wire) next() string {
+	w.t.Helper()
+	select {
+	case line := <-w.lines:
+		return line
+	case <-time.After(time.Second):
+		w.t.Fatal("no reply")
+		return ""
+	}
+}
+
+// setFlag sets a flag for the rest of the test.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	old := conf()
+
+	values := make(map[string]string)
+	for n, v := range old.values {
+		values[n] = v
+	}
+	values[name] = value
+
+	st, err := newSettings(values, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.validate() // some tests are of invalid settings
+	st.dictionary = old.dictionary
+	st.forwardRules = old.forwardRules
+
+	current.Store(st)
+	t.Cleanup(func() { current.Store(old) })
+}
+
+// withSettings changes a copy of the settings for the rest of the test.
+func withSettings(t *testing.T, change func(st *settings)) {
+	t.Helper()
+	old := conf()
+	st := *old
+	change(&st)
+
+	current.Store(&st)
+	t.Cleanup(func() { current.Store(old) })
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// connCounter counts the open connections, as they are accepted by all the
+// listeners at once.
+type connCounter struct {
+	mu     sync.Mutex
+	total  int
+	byPeer map[string]int
+}
+
+var conns = &connCounter{byPeer: make(map[string]int)}
+
+// acquire returns a non-empty reason if a connection from peer can NOT be
+// accepted.
+func (cc *connCounter) acquire(peer string) string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if conf().maxConns > 0 && cc.total >= conf().maxConns {
+		return "the server has too many connections"
+	}
+	if conf().maxConnsPerPeer > 0 && cc.byPeer[peer] >= conf().maxConnsPerPeer {
+		return "there are too many connections from your address"
+	}
+
+	cc.total++
+	cc.byPeer[peer]++
+	return ""
+}
+
+func (cc *connCounter) release(peer string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.total--
+	if cc.byPeer[peer]--; cc.byPeer[peer] <= 0 {
+		delete(cc.byPeer, peer)
+	}
+}
+
+// refuse tells a client why it is NOT accepted, without waiting for it.
+func refuse(conn net.Conn, reason string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte(fmt.Sprintf("> Connection refused: %s.\n", reason)))
+	_ = conn.Close()
+}
+
+// rateLimiter is a token bucket of one session. It is used by the session's
+// own reading goroutine only.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (r *rateLimiter) allow(now time.Time) bool {
+	if conf().rateLimit <= 0 {
+		return true
+	}
+
+	burst := float64(conf().rateBurst)
+	if r.last.IsZero() {
+		r.tokens = burst
+	} else {
+		r.tokens += now.Sub(r.last).Seconds() * conf().rateLimit
+		if r.tokens > burst {
+			r.tokens = burst
+		}
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnCounter(t *testing.T) {
+	setFlag(t, "max-conns", "3")
+	setFlag(t, "max-conns-per-ip", "2")
+	cc := &connCounter{byPeer: make(map[string]int)}
+
+	steps := []struct {
+		peer string
+		want string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.1", ""},
+		{"10.0.0.1", "there are too many connections from your address"},
+		{"10.0.0.2", ""},
+		{"10.0.0.3", "the server has too many connections"},
+	}
+	for i, step := range steps {
+		if got := cc.acquire(step.peer); got != step.want {
+			t.Fatalf("#%d from %s: got %q, want %q", i, step.peer, got, step.want)
+		}
+	}
+
+	cc.release("10.0.0.1")
+	if got := cc.acquire("10.0.0.3"); got != "" {
+		t.Errorf("after a release: got %q", got)
+	}
+
+	cc.release("10.0.0.2")
+	if _, ok := cc.byPeer["10.0.0.2"]; ok {
+		t.Error("a peer without connections is still counted")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	setFlag(t, "rate-limit", "2")
+	setFlag(t, "rate-burst", "3")
+
+	var r rateLimiter
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !r.allow(now) {
+			t.Fatalf("command #%d of the burst is refused", i)
+		}
+	}
+	if r.allow(now) {
+		t.Error("a command above the burst is allowed")
+	}
+	if !r.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("a command is refused after the bucket has refilled")
+	}
+	if r.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("the bucket has refilled more than the rate")
+	}
+
+	setFlag(t, "rate-limit", "0")
+	for i := 0; i < 100; i++ {
+		if !r.allow(now) {
+			t.Fatal("a command is refused without a rate limit")
+		}
+	}
+}
+
+func TestReadInputLimits(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "max-line", "64")
+	setFlag(t, "rate-limit", "1")
+	setFlag(t, "rate-burst", "1")
+	h.serve()
+	w := h.dial("10.0.0.1")
+
+	if got := w.send(strings.Repeat("x", 100)); !strings.Contains(got, "The line is longer than 64 bytes. Ignored.") {
+		t.Errorf("long line: got %q", got)
+	}
+	if got := w.send("who"); !strings.Contains(got, "You must log in first.") {
+		t.Errorf("second command: got %q", got)
+	}
+	if got := w.send("who"); !strings.Contains(got, "Too many commands. Slow down.") {
+		t.Errorf("third command: got %q", got)
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-timeout", "200ms")
+	h.serve()
+
+	slow := h.dial("10.0.0.1")
+	slow.send("proto json")
+	fast := h.dial("10.0.0.2")
+	fast.send("proto json")
+	if f, _ := readFrameOf(t, fast, "1 login root "+rootPswd); f.Status != statusOK {
+		t.Fatalf("login: %+v", f)
+	}
+
+	if f, data := readFrame(t, slow); f.Type != "disconnect" || data["reason"] != "login-timeout" {
+		t.Errorf("NOT logged in: got %+v, want a disconnect of reason 'login-timeout'", f)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if f, _ := readFrameOf(t, fast, "2 pwd"); f.Status != statusOK {
+		t.Errorf("logged in, after the timeout: %+v", f)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// listener is an address the server accepts sessions on, with its own
+// policy for them.
+type listener struct {
+	name     string
+	network  string // tcp, tcp4, tcp6 or unix
+	addr     string
+	commands []string    // the commands allowed, all of them if empty
+	admin    bool        // whether admins may log in
+	cert     string      // TLS is required if both cert and key are set
+	key      string      //
+	mode     os.FileMode // permission of a unix socket
+
+	ln net.Listener
+}
+
+// listenersFromFlag makes listeners with the default policy out of a comma
+// separated list like ":8888,[::1]:8888,unix:/run/pssh.sock".
+func listenersFromFlag(list string) ([]*listener, error) {
+	var listeners []*listener
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		l := &listener{name: addr, network: "tcp", addr: addr, admin: true, mode: 0600}
+		if strings.HasPrefix(addr, "unix:") {
+			l.network = "unix"
+			l.addr = strings.TrimPrefix(addr, "unix:")
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("listen must NOT be empty")
+	}
+
+	return listeners, nil
+}
+
+// parseListeners reads the 'listeners' section of the configuration file,
+// which replaces the listen flag, e.g.
+//
+//	{"public": {"network": "tcp", "addr": ":8888", "admin": false,
+//	            "commands": ["login", "otp", "ls", "read", "quit"],
+//	            "cert": "tls/cert.pem", "key": "tls/key.pem"},
+//	 "local": {"network": "unix", "addr": "pssh.sock", "mode": "0600"}}
+func parseListeners(db string, source string) ([]*listener, error) {
+	var listeners []*listener
+	var lErr error
+	gjson.Parse(db).ForEach(func(key, value gjson.Result) bool {
+		var l *listener
+		l, lErr = parseListener(key.String(), value)
+		if lErr != nil {
+			return false
+		}
+		listeners = append(listeners, l)
+		return true
+	})
+	if lErr != nil {
+		return nil, fmt.Errorf("'%s': %s", source, lErr.Error())
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("'%s': listeners must NOT be empty", source)
+	}
+
+	return listeners, nil
+}
+
+func parseListener(name string, v gjson.Result) (*listener, error) {
+	l := &listener{
+		name:    name,
+		network: v.Get("network").String(),
+		addr:    v.Get("addr").String(),
+		admin:   true,
+		cert:    v.Get("cert").String(),
+		key:     v.Get("key").String(),
+		mode:    0600,
+	}
+
+	switch l.network {
+	case "":
+		l.network = "tcp"
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("listener '%s': network must be either of 'tcp', 'tcp4', 'tcp6', 'unix'", name)
+	}
+
+	if l.addr == "" {
+		return nil, fmt.Errorf("listener '%s': addr is required", name)
+	}
+
+	if admin := v.Get("admin"); admin.Exists() {
+		l.admin = admin.Bool()
+	}
+
+	for _, cmd := range v.Get("commands").Array() {
+		l.commands = append(l.commands, cmd.String())
+	}
+
+	if (l.cert == "") != (l.key == "") {
+		return nil, fmt.Errorf("listener '%s': TLS needs both cert and key", name)
+	}
+	if l.cert != "" && l.network == "unix" {
+		return nil, fmt.Errorf("listener '%s': TLS is only for TCP", name)
+	}
+
+	if mode := v.Get("mode"); mode.Exists() {
+		m, err := strconv.ParseUint(mode.String(), 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("listener '%s': mode must be an octal permission, e.g. '0600'", name)
+		}
+		l.mode = os.FileMode(m)
+	}
+
+	return l, nil
+}
+
+func (l *listener) isTLS() bool {
+	return l.cert != ""
+}
+
+func (l *listener) allows(cmd string) bool {
+	return len(l.commands) == 0 || cmd == "quit" || contains(l.commands, cmd)
+}
+
+func (l *listener) String() string {
+	s := fmt.Sprintf("'%s' (%s %s", l.name, l.network, l.addr)
+	if l.isTLS() {
+		s += ", TLS"
+	}
+	if !l.admin {
+		s += ", no admins"
+	}
+	if len(l.commands) > 0 {
+		s += fmt.Sprintf(", %d commands", len(l.commands))
+	}
+	return s + ")"
+}
+
+func (l *listener) listen() error {
+	if l.network == "unix" {
+		// A socket left by a crash would make Listen fail.
+		if fi, err := os.Stat(l.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(l.addr)
+		}
+	}
+
+	lc := net.ListenConfig{KeepAlive: conf().keepAlive}
+	ln, err := lc.Listen(context.Background(), l.network, l.addr)
+	if err != nil {
+		return err
+	}
+
+	if l.network == "unix" {
+		if err := os.Chmod(l.addr, l.mode); err != nil {
+			_ = ln.Close()
+			return err
+		}
+	}
+
+	if l.isTLS() {
+		cert, err := tls.LoadX509KeyPair(l.cert, l.key)
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	l.ln = ln
+	return nil
+}
+
+func (l *listener) serve(s *server, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] Failed to accept the connection on %s.", err.Error(), l.name)
+			continue
+		}
+
+		peer := peerOf(conn, l)
+		if reason := conns.acquire(peer); reason != "" {
+			log.Printf("Refused a connection from %s on %s: %s.", peer, l.name, reason)
+			refuse(conn, reason)
+			continue
+		}
+
+		c := s.newClient(conn, l, peer)
+		go c.readInput()
+	}
+}
+
+// peerOf tells who is on the other end of conn: the IP address for TCP,
+// the user id for a unix socket where the system tells it.
+func peerOf(conn net.Conn, l *listener) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+
+	if uc, ok := conn.(*net.UnixConn); ok {
+		if id := unixPeer(uc); id != "" {
+			return "unix:" + id
+		}
+	}
+
+	return "unix:" + l.name
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestListenersFromFlag(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string // network and addr of each listener
+		wantErr bool
+	}{
+		{":8888", []string{"tcp :8888"}, false},
+		{":8888, [::1]:8888", []string{"tcp :8888", "tcp [::1]:8888"}, false},
+		{"unix:pssh.sock,:8888", []string{"unix pssh.sock", "tcp :8888"}, false},
+		{"", nil, true},
+		{" , ", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			listeners, err := listenersFromFlag(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, l := range listeners {
+				if !l.admin || len(l.commands) > 0 || l.isTLS() {
+					t.Errorf("%s: NOT the default policy", l)
+				}
+				got = append(got, l.network+" "+l.addr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+		check   func(t *testing.T, l *listener)
+	}{
+		{
+			name:  "defaults",
+			value: `{"addr": ":8888"}`,
+			check: func(t *testing.T, l *listener) {
+				if l.network != "tcp" || !l.admin || l.mode != 0600 {
+					t.Errorf("got %s, mode %o", l, l.mode)
+				}
+			},
+		},
+		{
+			name:  "policy",
+			value: `{"network": "tcp6", "addr": "[::1]:8888", "admin": false, "commands": ["login", "ls"]}`,
+			check: func(t *testing.T, l *listener) {
+				if l.admin || !l.allows("ls") || l.allows("mkdir") || !l.allows("quit") {
+					t.Errorf("got %s", l)
+				}
+			},
+		},
+		{
+			name:  "unix mode",
+			value: `{"network": "unix", "addr": "pssh.sock", "mode": "0660"}`,
+			check: func(t *testing.T, l *listener) {
+				if l.mode != 0660 {
+					t.Errorf("mode %o", l.mode)
+				}
+			},
+		},
+		{name: "unknown network", value: `{"network": "udp", "addr": ":8888"}`, wantErr: "network must be"},
+		{name: "no addr", value: `{"network": "tcp"}`, wantErr: "addr is required"},
+		{name: "cert without key", value: `{"addr": ":8888", "cert": "cert.pem"}`, wantErr: "TLS needs both"},
+		{name: "TLS on unix", value: `{"network": "unix", "addr": "s", "cert": "c", "key": "k"}`, wantErr: "TLS is only for TCP"},
+		{name: "bad mode", value: `{"network": "unix", "addr": "s", "mode": "rw"}`, wantErr: "mode must be"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := parseListener(tt.name, gjson.Parse(tt.value))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, l)
+		})
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	newHarness(t)
+	l := &listener{name: "local", network: "unix", addr: "pssh.sock", admin: true, mode: 0660}
+
+	// A socket left by a crash is replaced.
+	stale, err := net.Listen("unix", l.addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	if err := l.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.ln.Close()
+
+	if fi, err := os.Stat(l.addr); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket %v, %v", fi, err)
+	}
+
+	go func() {
+		if conn, err := net.Dial("unix", l.addr); err == nil {
+			defer conn.Close()
+			buf := make([]byte, 1)
+			_, _ = conn.Read(buf)
+		}
+	}()
+
+	conn, err := l.ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if peer := peerOf(conn, l); !strings.HasPrefix(peer, "unix:") {
+		t.Errorf("peer %q", peer)
+	}
+}
+
+func TestListenerPolicy(t *testing.T) {
+	h := newHarness(t)
+	h.l.admin = false
+	h.l.commands = []string{"login", "ls"}
+
+	c, _ := h.connect("10.0.0.1")
+	if out := h.do(c, "login root "+rootPswd); !strings.Contains(out, "Admins can NOT log in on this connection.") {
+		t.Errorf("admin login: %q", out)
+	}
+	if c.isLoggedIn {
+		t.Error("the admin has logged in")
+	}
+
+	if out := h.do(c, "mkdir dir"); !strings.Contains(out, "'mkdir' is NOT allowed on this connection.") {
+		t.Errorf("mkdir: %q", out)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const db_ips = "lockout/ips.json"
+const lockouts_audit = audits_path + "lockouts"
+
+// Lockout timestamps are stored as unix milliseconds.
+const failedLogins = "failedLogins"
+const lastFailedLogin = "lastFailedLogin"
+const nextLoginAt = "nextLoginAt"
+const lockedUntil = "lockedUntil"
+
+// checkLockout returns a non-empty reason if the record db (an account or
+// an IP) may NOT attempt a login right now.
+func checkLockout(db string, now time.Time) string {
+	if until := gjson.Get(db, lockedUntil).Int(); until > now.UnixMilli() {
+		return fmt.Sprintf("locked for %s", roundUp(time.UnixMilli(until).Sub(now)))
+	}
+
+	if next := gjson.Get(db, nextLoginAt).Int(); next > now.UnixMilli() {
+		return fmt.Sprintf("next attempt allowed in %s", roundUp(time.UnixMilli(next).Sub(now)))
+	}
+
+	return ""
+}
+
+func roundUp(d time.Duration) time.Duration {
+	return (d + time.Second - 1).Truncate(time.Second)
+}
+
+// recordFailure counts a failed login in db and reports whether that has
+// just locked it.
+func recordFailure(db string, threshold int, now time.Time) (string, bool) {
+	failures := gjson.Get(db, failedLogins).Int()
+	if now.Sub(time.UnixMilli(gjson.Get(db, lastFailedLogin).Int())) > conf().lockoutDuration {
+		failures = 0
+	}
+	failures++
+
+	backoff := conf().loginBackoff
+	for i := int64(1); i < failures && backoff < conf().lockoutDuration; i++ {
+		backoff *= 2
+	}
+	if backoff > conf().lockoutDuration {
+		backoff = conf().lockoutDuration
+	}
+
+	db, _ = sjson.Set(db, failedLogins, failures)
+	db, _ = sjson.Set(db, lastFailedLogin, now.UnixMilli())
+	db, _ = sjson.Set(db, nextLoginAt, now.Add(backoff).UnixMilli())
+
+	isLocked := threshold > 0 && failures >= int64(threshold)
+	if isLocked {
+		db, _ = sjson.Set(db, lockedUntil, now.Add(conf().lockoutDuration).UnixMilli())
+		db, _ = sjson.Set(db, failedLogins, 0)
+	}
+
+	return db, isLocked
+}
+
+// recordLoginFailure counts a failed login of c.nick from the address of c.
+func recordLoginFailure(c *client, db string, pathToFile string, now time.Time) {
+	db, isLocked := recordFailure(db, conf().lockoutThreshold, now)
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+	if isLocked {
+		writeLockoutAudit(c, fmt.Sprintf("Account '%s' locked for %s after failed logins from '%s'", c.nick, conf().lockoutDuration, getPeer(c)))
+	}
+
+	recordIPFailure(c, getPeer(c), now)
+}
+
+func clearLockout(db string) string {
+	db, _ = sjson.Delete(db, failedLogins)
+	db, _ = sjson.Delete(db, lastFailedLogin)
+	db, _ = sjson.Delete(db, nextLoginAt)
+	db, _ = sjson.Delete(db, lockedUntil)
+	return db
+}
+
+func loadIPs() string {
+	content, _ := os.ReadFile(db_ips)
+	return string(content)
+}
+
+// saveIPs writes the records of the addresses, without those that have
+// expired: the records of every address ever failing would pile up.
+func saveIPs(db string, now time.Time) {
+	db = pruneIPs(db, now)
+	_ = os.MkdirAll("lockout", os.ModePerm)
+	_ = os.WriteFile(db_ips, []byte(db), conf().fileMode)
+}
+
+// pruneIPs drops the records that lock nothing and whose failures are
+// forgotten, see recordFailure.
+func pruneIPs(db string, now time.Time) string {
+	var expired []string
+	gjson.Parse(db).ForEach(func(ip, record gjson.Result) bool {
+		if isExpired(record.Raw, now) {
+			expired = append(expired, ip.String())
+		}
+		return true
+	})
+
+	for _, ip := range expired {
+		db, _ = sjson.Delete(db, dbKey(ip))
+	}
+	return db
+}
+
+func isExpired(db string, now time.Time) bool {
+	forgotten := now.Sub(time.UnixMilli(gjson.Get(db, lastFailedLogin).Int())) > conf().lockoutDuration
+	return forgotten && checkLockout(db, now) == ""
+}
+
+func checkIPLockout(ip string, now time.Time) string {
+	return checkLockout(gjson.Get(loadIPs(), dbKey(ip)).Raw, now)
+}
+
+func recordIPFailure(c *client, ip string, now time.Time) {
+	ips := loadIPs()
+	db, isLocked := recordFailure(gjson.Get(ips, dbKey(ip)).Raw, conf().ipLockoutThreshold, now)
+	ips, _ = sjson.SetRaw(ips, dbKey(ip), db)
+	saveIPs(ips, now)
+
+	if isLocked {
+		writeLockoutAudit(c, fmt.Sprintf("Address '%s' locked for %s", ip, conf().lockoutDuration))
+	}
+}
+
+// Lockout events are always written, whether the account is watched or not.
+func writeLockoutAudit(c *client, msg string) {
+	_ = os.MkdirAll(audits_path, os.ModePerm)
+	f, _ := os.OpenFile(lockouts_audit, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
+	_, _ = f.WriteString(fmt.Sprintf("%s: %s: %s.\n", time.Now(), c.nick, msg))
+	_ = f.Close()
+
+	emitAudit(newAuditEvent(c, "u", c.nick, msg, -1))
+}
+
+// isValidNick reports whether nick can name the files of a user, e.g.
+// db/{nick}.json, without leaving their directories.
+func isValidNick(nick string) bool {
+	return nick != "" && !strings.ContainsAny(nick, `/\. `)
+}
+
+func (s *server) unlock(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if !c.isAdmin {
+		c.status(statusForbidden)
+		c.msg("Only admin can unlock users.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "unlock [nick|ip|unix:uid=N]"`)
+		return
+	}
+
+	object := args[1]
+	if net.ParseIP(object) != nil || strings.HasPrefix(object, "unix:") {
+		ips := loadIPs()
+		if !gjson.Get(ips, dbKey(object)).Exists() {
+			c.status(statusNotFound)
+			c.msg(fmt.Sprintf("Address '%s' is NOT locked.", object))
+			return
+		}
+
+		ips, _ = sjson.Delete(ips, dbKey(object))
+		saveIPs(ips, time.Now())
+
+		writeLockoutAudit(c, fmt.Sprintf("Address '%s' unlocked", object))
+		c.msg(fmt.Sprintf("You have successfully unlocked address '%s'", object))
+		return
+	}
+
+	if !isValidNick(object) {
+		c.status(statusBadRequest)
+		c.msg(fmt.Sprintf("'%s' is neither a nick nor an address.", object))
+		return
+	}
+
+	pathToFile := db_path + object + ".json"
+	content, err := os.ReadFile(pathToFile)
+	if err != nil {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
+		return
+	}
+
+	db := clearLockout(string(content))
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+	writeLockoutAudit(c, fmt.Sprintf("Account '%s' unlocked", object))
+	c.msg(fmt.Sprintf("You have successfully unlocked '%s'", object))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRecordFailure(t *testing.T) {
+	setFlag(t, "lockout-duration", "15m")
+	setFlag(t, "login-backoff", "1s")
+
+	now := time.UnixMilli(1_700_000_000_000)
+	recent := now.Add(-time.Minute).UnixMilli()
+	long := now.Add(-time.Hour).UnixMilli()
+
+	tests := []struct {
+		name        string
+		db          string
+		threshold   int
+		wantLocked  bool
+		wantBackoff time.Duration
+		wantCount   int64
+	}{
+		{"first failure", `{}`, 5, false, time.Second, 1},
+		{"third failure doubles twice", `{"failedLogins": 2, "lastFailedLogin": ` + strconv.FormatInt(recent, 10) + `}`, 5, false, 4 * time.Second, 3},
+		{"failures are forgotten", `{"failedLogins": 4, "lastFailedLogin": ` + strconv.FormatInt(long, 10) + `}`, 5, false, time.Second, 1},
+		{"threshold locks", `{"failedLogins": 4, "lastFailedLogin": ` + strconv.FormatInt(recent, 10) + `}`, 5, true, 16 * time.Second, 0},
+		{"no threshold", `{"failedLogins": 40, "lastFailedLogin": ` + strconv.FormatInt(recent, 10) + `}`, 0, false, 15 * time.Minute, 41},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, isLocked := recordFailure(tt.db, tt.threshold, now)
+			if isLocked != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", isLocked, tt.wantLocked)
+			}
+			if got := time.UnixMilli(gjson.Get(db, nextLoginAt).Int()).Sub(now); got != tt.wantBackoff {
+				t.Errorf("backoff = %s, want %s", got, tt.wantBackoff)
+			}
+			if got := gjson.Get(db, failedLogins).Int(); got != tt.wantCount {
+				t.Errorf("failedLogins = %d, want %d", got, tt.wantCount)
+			}
+			if tt.wantLocked && checkLockout(db, now.Add(time.Minute)) == "" {
+				t.Error("checkLockout() allows a locked record")
+			}
+		})
+	}
+}
+
+func TestCheckLockout(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	at := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).UnixMilli(), 10) }
+
+	tests := []struct {
+		name string
+		db   string
+		want string
+	}{
+		{"never failed", `{}`, ""},
+		{"locked", `{"lockedUntil": ` + at(90*time.Second) + `}`, "locked for 1m30s"},
+		{"lock expired", `{"lockedUntil": ` + at(-time.Second) + `}`, ""},
+		{"backing off", `{"nextLoginAt": ` + at(1500*time.Millisecond) + `}`, "next attempt allowed in 2s"},
+	}
+
+	for _, tt := range tests {
+		if got := checkLockout(tt.db, now); got != tt.want {
+			t.Errorf("%s: checkLockout() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPruneIPs(t *testing.T) {
+	setFlag(t, "lockout-duration", "15m")
+
+	now := time.UnixMilli(1_700_000_000_000)
+	at := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).UnixMilli(), 10) }
+
+	ips := `{
+		"10.0.0.1": {"failedLogins": 1, "lastFailedLogin": ` + at(-time.Minute) + `},
+		"10.0.0.2": {"failedLogins": 3, "lastFailedLogin": ` + at(-time.Hour) + `, "nextLoginAt": ` + at(-time.Hour) + `},
+		"10.0.0.3": {"failedLogins": 0, "lastFailedLogin": ` + at(-time.Hour) + `, "lockedUntil": ` + at(time.Minute) + `},
+		"unix:uid=1000": {"failedLogins": 0, "lastFailedLogin": ` + at(-time.Hour) + `, "lockedUntil": ` + at(-time.Minute) + `}
+	}`
+
+	pruned := pruneIPs(ips, now)
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "10.0.0.3": true, "unix:uid=1000": false} {
+		if got := gjson.Get(pruned, dbKey(ip)).Exists(); got != want {
+			t.Errorf("%s kept = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-backoff", "0s")
+	setFlag(t, "lockout-threshold", "2")
+
+	root := h.login("10.0.0.1:1000", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+
+	dan, _ := h.connect("10.0.0.2:1000")
+	for i := 0; i < 3; i++ {
+		h.do(dan, "login dan wrong")
+	}
+	if out := h.do(dan, "login dan Pw4Tests_x9"); !strings.Contains(out, "Too many failed logins of this user") {
+		t.Fatalf("dan is NOT locked: %q", out)
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"no argument", "unlock", "Wrong usage."},
+		{"path out of db", "unlock ../db/dan", "'../db/dan' is neither a nick nor an address."},
+		{"dotted nick", "unlock dan.json", "is neither a nick nor an address."},
+		{"unknown user", "unlock nobody", "User 'nobody' does NOT exists."},
+		{"address NOT locked", "unlock 10.9.9.9", "Address '10.9.9.9' is NOT locked."},
+		{"address", "unlock 10.0.0.2", "You have successfully unlocked address '10.0.0.2'"},
+		{"user", "unlock dan", "You have successfully unlocked 'dan'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(root, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	if out := h.do(dan, "login dan Pw4Tests_x9"); !strings.Contains(out, "You have successfully logged in.") {
+		t.Errorf("dan is still locked: %q", out)
+	}
+
+	content, _ := os.ReadFile(lockouts_audit)
+	for _, want := range []string{"Account 'dan' locked", "Account 'dan' unlocked", "Address '10.0.0.2' unlocked"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("lockout audit lacks %q:\n%s", want, content)
+		}
+	}
+}
+
+func TestLoginTraversalNick(t *testing.T) {
+	h := newHarness(t)
+	before := []byte(`{"users/root/home/a%2Etxt": {"owner": "root"}}`)
+	_ = os.MkdirAll("files", os.ModePerm)
+	if err := os.WriteFile(db_files, before, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := h.connect("10.0.0.1:1000")
+	if out := h.do(c, "login ../files/files wrong"); !strings.Contains(out, "User ../files/files does NOT exists.") {
+		t.Errorf("got %q", out)
+	}
+
+	if after, _ := os.ReadFile(db_files); string(after) != string(before) {
+		t.Errorf("%s has been changed:\n%s", db_files, after)
+	}
+}
+
+func TestIsValidNick(t *testing.T) {
+	tests := []struct {
+		nick string
+		want bool
+	}{
+		{"dan", true},
+		{"dan_2", true},
+		{"", false},
+		{"..", false},
+		{"../etc/passwd", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a b", false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidNick(tt.nick); got != tt.want {
+			t.Errorf("isValidNick(%q) = %v, want %v", tt.nick, got, tt.want)
+		}
+	}
+}
@@ -1,21 +1,91 @@
 package main
 
 import (
+	"flag"
 	"github.com/tidwall/sjson"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		playRecording(os.Args[2:])
+		return
+	}
+
+	flag.Parse()
+
+	startDir, _ = os.Getwd()
+	cmdLineValues = explicitFlags()
+	if cmdLine.configPath != "" {
+		// It is read again on reloads, from inside the data root.
+		path, _ := filepath.Abs(cmdLine.configPath)
+		cmdLineValues["config"] = path
+	}
+
+	cfg, err := readConfig(cmdLineValues["config"])
+	if err != nil {
+		log.Fatalf("[%s] Unable to load the configuration.", err.Error())
+	}
+	st, err := newSettings(cfg.values(cmdLineValues), cfg.path)
+	if err != nil {
+		log.Fatalf("[%s] Unable to load the configuration.", err.Error())
+	}
+	if err := st.validate(); err != nil {
+		log.Fatalf("[%s] Invalid configuration.", err.Error())
+	}
+	if st.forwardRules, err = loadConfiguredForwarding(cfg); err != nil {
+		log.Fatalf("[%s] Invalid configuration.", err.Error())
+	}
+	st.forwarding = cfg.forwarding
+
+	if st.dataRoot != "" {
+		if err := os.Chdir(st.dataRoot); err != nil {
+			log.Fatalf("[%s] Unable to enter the data root.", err.Error())
+		}
+	}
+
+	if st.dictionary, err = loadDictionary(st.pswdDictionary); err != nil {
+		log.Fatalf("[%s] Unable to load the password dictionary.", err.Error())
+	}
+
+	key, err := loadRecordingKey(st.recordingKeyPath)
+	if err != nil {
+		log.Fatalf("[%s] Unable to load the recording key.", err.Error())
+	}
+	recordingKey = key
+
+	current.Store(st)
+
+	if flag.Arg(0) == "init" {
+		if err := bootstrap(flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("[%s] Unable to initialize the server.", err.Error())
+		}
+		return
+	}
+
+	if !isInitialized() {
+		if !isTerminal(os.Stdin) {
+			log.Fatalf("[no users in '%s'] Run \"serverPSSH init\" first.", db_path)
+		}
+
+		log.Printf("There are no users yet. Creating the first admin.")
+		if err := bootstrap(nil, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("[%s] Unable to initialize the server.", err.Error())
+		}
+	}
+
 	matches, _ := filepath.Glob(filepath.Join(db_path, "*.json"))
 	for _, file := range matches {
 		content, _ := os.ReadFile(file)
 		db := string(content)
 		db, _ = sjson.Set(db, "isActive", false)
 		db, _ = sjson.Set(db, "isBeingAudited", false) // lab4
-		err := os.WriteFile(file, []byte(db), 0755)
+		err := os.WriteFile(file, []byte(db), conf().fileMode)
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -23,26 +93,54 @@ func main() {
 
 	_ = os.MkdirAll("files", os.ModePerm)
 
+	sinks, source, err := loadConfiguredSinks(cfg, st)
+	if err != nil {
+		log.Fatalf("[%s] Unable to load audit sinks.", err.Error())
+	}
+	startAuditSinks(sinks)
+	sinksSource = source
+
 	// The server itself
 	s := newServer()
 	go s.run()
 
-	listener, err := net.Listen("tcp", ":8888")
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received, reloading the configuration.")
+			s.commands <- command{id: CmdReload}
+		}
+	}()
+
+	listeners, err := configuredListeners(cfg, st)
 	if err != nil {
-		log.Fatalf("[%s] Unable to start the server.", err.Error())
+		log.Fatalf("[%s] Invalid configuration.", err.Error())
 	}
+	listenersSource = cfg.listens
 
-	defer listener.Close()
-	log.Printf("Server has been started on :8888")
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("[%s] Failed to accept the connection.", err.Error())
-			continue
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		if err := l.listen(); err != nil {
+			log.Fatalf("[%s] Unable to start the server on %s.", err.Error(), l)
 		}
+		log.Printf("Server has been started on %s", l)
 
-		c := s.newClient(conn)
-		go c.readInput()
+		wg.Add(1)
+		go l.serve(s, &wg)
 	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		log.Printf("%s received, shutting down the server.", sig)
+		for _, l := range listeners {
+			_ = l.ln.Close()
+		}
+	}()
+
+	wg.Wait()
+	s.shutdown(conf().shutdownTimeout)
+	log.Printf("Server has been stopped.")
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const pswdHistory = "pswdHistory"
+const pswdChanged = "pswdChanged" // unix seconds
+
+func hashPassword(pswd string) string {
+	h := sha1.New()
+	h.Write([]byte(pswd))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadDictionary(path string) (map[string]bool, error) {
+	words := make(map[string]bool)
+	if path == "" {
+		return words, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileScanner := bufio.NewScanner(file)
+	for fileScanner.Scan() {
+		if word := strings.ToLower(strings.TrimSpace(fileScanner.Text())); word != "" {
+			words[word] = true
+		}
+	}
+
+	return words, fileScanner.Err()
+}
+
+// checkPassword applies the password policy to a new password of nick,
+// whose db may be empty for a new user.
+func checkPassword(nick string, pswd string, db string) error {
+	if len([]rune(pswd)) < conf().pswdMinLength {
+		return fmt.Errorf("password must be at least %d characters long", conf().pswdMinLength)
+	}
+
+	var lower, upper, digit, other int
+	for _, r := range pswd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if lower+upper+digit+other < conf().pswdClasses {
+		return fmt.Errorf("password must contain at least %d of: lower case, upper case, digits, other characters", conf().pswdClasses)
+	}
+
+	lowered := strings.ToLower(pswd)
+	if nick != "" && strings.Contains(lowered, strings.ToLower(nick)) {
+		return errors.New("password must NOT contain the nick")
+	}
+
+	letters := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, lowered)
+	if conf().dictionary[lowered] || conf().dictionary[letters] {
+		return errors.New("password is a dictionary word")
+	}
+
+	hash := hashPassword(pswd)
+	if gjson.Get(db, "pswd").String() == hash {
+		return errors.New("password must differ from the current one")
+	}
+	if conf().pswdHistorySize > 0 {
+		for _, old := range gjson.Get(db, pswdHistory).Array() {
+			if old.String() == hash {
+				return fmt.Errorf("password must differ from the last %d ones", conf().pswdHistorySize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setPassword stores a new password hash and keeps the old one in history.
+func setPassword(db string, pswd string) string {
+	old := gjson.Get(db, "pswd").String()
+
+	var history []string
+	if old != "" && conf().pswdHistorySize > 0 {
+		history = append(history, old)
+		for _, h := range gjson.Get(db, pswdHistory).Array() {
+			if len(history) >= conf().pswdHistorySize {
+				break
+			}
+			history = append(history, h.String())
+		}
+	}
+
+	db, _ = sjson.Set(db, "pswd", hashPassword(pswd))
+	db, _ = sjson.Set(db, pswdChanged, time.Now().Unix())
+	if len(history) > 0 {
+		db, _ = sjson.Set(db, pswdHistory, history)
+	} else {
+		db, _ = sjson.Delete(db, pswdHistory)
+	}
+
+	return db
+}
+
+func isPasswordExpired(db string) bool {
+	if conf().pswdMaxAge <= 0 {
+		return false
+	}
+
+	// A password of unknown age counts as expired.
+	changed := time.Unix(gjson.Get(db, pswdChanged).Int(), 0)
+	return time.Since(changed) > conf().pswdMaxAge
+}
+
+// passwd lets a user change their own password: "passwd [old] [new]".
+func (s *server) passwd(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 3 {
+		c.status(statusBadRequest)
+		c.msg(`The old and the new passwords are required. Example: "passwd [old] [new]"`)
+		return
+	}
+
+	pathToFile := db_path + c.nick + ".json"
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
+	// The old password is guessed as on a login, so it is locked out alike.
+	now := time.Now()
+	if reason := checkLockout(db, now); reason != "" {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins of this user: %s.", reason))
+		writeAudit(c, db, fmt.Sprintf("Refused password change from '%s': %s", getPeer(c), reason), -1, "")
+		return
+	}
+
+	if gjson.Get(db, "pswd").String() != hashPassword(args[1]) {
+		c.status(statusUnauthorized)
+		c.msg("Wrong password.")
+		writeAudit(c, db, fmt.Sprintf("Failed password change from '%s': wrong old password", getPeer(c)), -1, "")
+		recordLoginFailure(c, db, pathToFile, now)
+		return
+	}
+
+	if err := checkPassword(c.nick, args[2], db); err != nil {
+		c.err(err)
+		return
+	}
+
+	db = setPassword(db, args[2])
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+	c.unrestrict(CmdPasswd)
+	c.msg("You have successfully changed your password.")
+	writeAudit(c, db, fmt.Sprintf("Changed password from '%s'", getPeer(c)), -1, "")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+func TestCheckPassword(t *testing.T) {
+	setFlag(t, "pswd-min-length", "8")
+	setFlag(t, "pswd-classes", "2")
+	setFlag(t, "pswd-history", "2")
+	withSettings(t, func(st *settings) { st.dictionary = map[string]bool{"password": true} })
+
+	db := ""
+	for _, pswd := range []string{"Oldest_p0", "Older_pw1", "Old_pw_22", "Current_3"} {
+		db = setPassword(db, pswd)
+	}
+
+	tests := []struct {
+		name    string
+		nick    string
+		pswd    string
+		db      string
+		wantErr string
+	}{
+		{"good", "dan", "Pw4Tests_x9", "", ""},
+		{"too short", "dan", "Pw4_x9", "", "at least 8 characters"},
+		{"one class", "dan", "abcdefghij", "", "at least 2 of"},
+		{"two classes", "dan", "abcdefgh12", "", ""},
+		{"has the nick", "dan", "my-DAN-pw-1", "", "must NOT contain the nick"},
+		{"dictionary word", "dan", "PassWord", "", "dictionary word"},
+		{"dictionary word with digits", "dan", "Password123", "", "dictionary word"},
+		{"current one", "dan", "Current_3", db, "differ from the current one"},
+		{"in history", "dan", "Old_pw_22", db, "differ from the last 2 ones"},
+		{"last in history", "dan", "Older_pw1", db, "differ from the last 2 ones"},
+		{"out of history", "dan", "Oldest_p0", db, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPassword(tt.nick, tt.pswd, tt.db)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPasswordExpired(t *testing.T) {
+	setFlag(t, "pswd-max-age", "720h")
+
+	at := func(d time.Duration) string {
+		db, _ := sjson.Set("", pswdChanged, time.Now().Add(d).Unix())
+		return db
+	}
+
+	tests := []struct {
+		name string
+		db   string
+		want bool
+	}{
+		{"fresh", at(-time.Hour), false},
+		{"old", at(-800 * time.Hour), true},
+		{"unknown age", `{}`, true},
+	}
+
+	for _, tt := range tests {
+		if got := isPasswordExpired(tt.db); got != tt.want {
+			t.Errorf("%s: isPasswordExpired() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPasswd(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "pswd-max-age", "720h")
+	setFlag(t, "login-backoff", "0s")
+
+	// An expired password lets the session run nothing but passwd.
+	content, _ := os.ReadFile(db_path + "root.json")
+	db, _ := sjson.Delete(string(content), pswdChanged)
+	_ = os.WriteFile(db_path+"root.json", []byte(db), conf().fileMode)
+
+	c, _ := h.connect("10.0.0.1")
+	if out := h.do(c, "login root "+rootPswd); !strings.Contains(out, "Your password has expired.") {
+		t.Fatalf("login: %q", out)
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"restricted", "ls", "Your password has expired."},
+		{"wrong old password", "passwd wrong New_pw_123", "Wrong password."},
+		{"weak new password", "passwd " + rootPswd + " short", "at least 8 characters"},
+		{"same password", "passwd " + rootPswd + " " + rootPswd, "differ from the current one"},
+		{"changed", "passwd " + rootPswd + " New_pw_123", "You have successfully changed your password."},
+		{"unrestricted", "pwd", "/home"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(c, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	content, _ = os.ReadFile(db_path + "root.json")
+	if got := gjson.GetBytes(content, pswdHistory+".0").String(); got != hashPassword(rootPswd) {
+		t.Errorf("history starts with %q, want the old password", got)
+	}
+}
+
+func TestPasswdLockout(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-backoff", "0s")
+	setFlag(t, "lockout-threshold", "2")
+	c := h.login("10.0.0.1", "root", rootPswd)
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"first guess", "passwd wrong1 New_pw_123", "Wrong password."},
+		{"second guess locks", "passwd wrong2 New_pw_123", "Wrong password."},
+		{"locked", "passwd " + rootPswd + " New_pw_123", "Too many failed logins of this user: locked for"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(c, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	other, _ := h.connect("10.0.0.2")
+	if out := h.do(other, "login root "+rootPswd); !strings.Contains(out, "Too many failed logins of this user") {
+		t.Errorf("login of the locked account: %q", out)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// unixPeer is NOT supported here, so unix sessions are told apart by their
+// listener only.
+func unixPeer(conn *net.UnixConn) string {
+	return ""
+}
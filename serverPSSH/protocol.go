@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// In the json protocol, asked for with "proto json" as the first line of a
+// connection, every following line starts with a request id chosen by the
+// client: "{id} {command} {args}". The server answers each line with exactly
+// one response frame, a JSON object on one line:
+//
+//	{"id":"7","type":"response","status":200,"message":"...","data":...}
+//
+// JSON text can NOT contain a raw newline, so the newline ends the frame.
+// Messages that are NOT an answer to a request come as frames of type
+// "event" without an id, the data of tunnels as frames of type "tunnel" (see
+// tunnel.go). The end of a session by the server, e.g. a kill, comes as a
+// frame of type "disconnect" with the reason in its data.
+
+// Status codes of the frames, after the HTTP ones.
+const (
+	statusOK           = 200
+	statusBadRequest   = 400
+	statusUnauthorized = 401
+	statusForbidden    = 403
+	statusNotFound     = 404
+	statusConflict     = 409
+	statusTooMany      = 429
+	statusError        = 500
+	statusUnavailable  = 503
+)
+
+const protocolVersion = 1
+
+// response gathers the replies to one request of the json protocol.
+type response struct {
+	status int
+	lines  []string
+	data   interface{}
+}
+
+type frame struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"` // "response", "event", "disconnect" or "tunnel"
+	Status  int         `json:"status"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// splitRequestID takes the request id off a line of the json protocol.
+func splitRequestID(line string) (string, string) {
+	line = strings.TrimLeft(line, " ")
+	if i := strings.Index(line, " "); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+// proto switches the protocol of the session: "proto (text|json)".
+func (s *server) proto(c *client, args []string) {
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "proto (text|json)"`)
+		return
+	}
+
+	switch args[1] {
+	case "text":
+		c.msg("Protocol 'text' is on.")
+
+	case "json":
+		c.structured = true
+		c.beginRequest("")
+		c.msg("Protocol 'json' is on.")
+		c.setData(map[string]int{"version": protocolVersion})
+		c.endRequest()
+
+	default:
+		c.status(statusBadRequest)
+		c.msg("First option must be either of 'text', 'json'")
+	}
+}
+
+func (c *client) beginRequest(id string) {
+	c.reqID = id
+	c.reqOpen = true
+	c.resp = nil
+}
+
+// endRequest sends the response to the open request, even if it is empty.
+func (c *client) endRequest() {
+	if !c.structured || !c.reqOpen {
+		return
+	}
+
+	resp := c.resp
+	if resp == nil {
+		resp = &response{status: statusOK}
+	}
+	c.reqOpen = false
+	c.resp = nil
+
+	c.writeFrame(frame{
+		ID:      c.reqID,
+		Type:    "response",
+		Status:  resp.status,
+		Message: strings.Join(resp.lines, "\n"),
+		Data:    resp.data,
+	})
+}
+
+// status sets the status of the response to the open request. A handler
+// sets it before its reply, the highest one set during a request is sent.
+// Events, and the text protocol, have none.
+func (c *client) status(code int) {
+	if !c.structured || !c.inRequest || !c.reqOpen {
+		return
+	}
+
+	if c.resp == nil {
+		c.resp = &response{status: statusOK}
+	}
+	if code > c.resp.status {
+		c.resp.status = code
+	}
+}
+
+// collect adds a reply to the open request, or sends it as an event. An
+// error without a status of its own is a bad request.
+func (c *client) collect(text string, isErr bool) {
+	if !c.inRequest || !c.reqOpen {
+		status := statusOK
+		if isErr {
+			status = statusBadRequest
+		}
+		c.writeFrame(frame{Type: "event", Status: status, Message: text})
+		return
+	}
+
+	if c.resp == nil {
+		c.resp = &response{status: statusOK}
+	}
+	if isErr && c.resp.status == statusOK {
+		c.resp.status = statusBadRequest
+	}
+	c.resp.lines = append(c.resp.lines, text)
+}
+
+// setData attaches the structured result of a command to its response.
+// In the text protocol it does nothing.
+func (c *client) setData(data interface{}) {
+	if !c.structured || !c.inRequest || !c.reqOpen {
+		return
+	}
+
+	if c.resp == nil {
+		c.resp = &response{status: statusOK}
+	}
+	c.resp.data = data
+}
+
+// disconnect tells the client that the server ends its session, and why:
+// "killed", "replaced", "resumed", "idle" or "shutdown".
+func (c *client) disconnect(reason string, msg string) {
+	if !c.structured || c.isConnErr.Load() {
+		c.msg(msg)
+		return
+	}
+
+	c.recording().event("o", "> "+msg+"\n")
+	c.writeFrame(disconnectFrame(reason, msg))
+}
+
+func disconnectFrame(reason string, msg string) frame {
+	return frame{Type: "disconnect", Status: statusOK, Message: msg, Data: map[string]string{"reason": reason}}
+}
+
+func (c *client) writeFrame(f frame) {
+	out, err := json.Marshal(f)
+	if err != nil {
+		out, _ = json.Marshal(frame{ID: f.ID, Type: f.Type, Status: statusError, Message: fmt.Sprintf("Couldn't encode the response: %s", err.Error())})
+	}
+
+	c.write(string(out)+"\n", "c.writeFrame()")
+}
+
+// Payloads of the responses.
+
+type fileEntry struct {
+	Name  string `json:"name"`
+	IsDir bool   `json:"isDir"`
+}
+
+type markInfo struct {
+	Kind   string `json:"kind"` // "f", "u" or "g"
+	Object string `json:"object"`
+	Mark   uint64 `json:"mark"`
+}
+
+type sessionInfo struct {
+	ID        string `json:"id"`
+	Nick      string `json:"nick,omitempty"`
+	Peer      string `json:"peer"`
+	Listener  string `json:"listener"`
+	Dir       string `json:"dir,omitempty"`
+	Connected int64  `json:"connected"`
+	LoggedIn  int64  `json:"loggedIn,omitempty"`
+	Idle      int64  `json:"idle"` // seconds
+	Detached  bool   `json:"detached,omitempty"`
+}
+
+func infoOf(c *client) sessionInfo {
+	info := sessionInfo{
+		ID:        c.sessionID,
+		Peer:      getPeer(c),
+		Listener:  c.listener.name,
+		Connected: c.connTime.Unix(),
+		Idle:      int64(idleTime(c).Seconds()),
+		Detached:  c.detached,
+	}
+	if c.isLoggedIn {
+		info.Nick = c.nick
+		info.Dir = c.currDir
+		info.LoggedIn = c.loginTime.Unix()
+	}
+
+	return info
+}
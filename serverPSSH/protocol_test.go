@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSplitRequestID(t *testing.T) {
+	tests := []struct {
+		line   string
+		wantID string
+		want   string
+	}{
+		{"7 ls .", "7", "ls ."},
+		{"  a1 pwd", "a1", "pwd"},
+		{"8", "8", ""},
+	}
+
+	for _, tt := range tests {
+		if id, line := splitRequestID(tt.line); id != tt.wantID || line != tt.want {
+			t.Errorf("splitRequestID(%q) = %q, %q, want %q, %q", tt.line, id, line, tt.wantID, tt.want)
+		}
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	h := newHarness(t)
+	h.serve()
+	w := h.dial("10.0.0.1")
+
+	decode := func(line string) frame {
+		t.Helper()
+		var f frame
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		return f
+	}
+
+	if f := decode(w.send("proto json")); f.Type != "response" || f.Status != statusOK {
+		t.Fatalf("proto json: %+v", f)
+	}
+
+	tests := []struct {
+		name       string
+		line       string
+		wantID     string
+		wantStatus int
+		wantData   bool
+	}{
+		{"unauthorized", "1 ls .", "1", statusUnauthorized, false},
+		{"bad request", "2 login", "2", statusBadRequest, false},
+		{"login", "3 login root " + rootPswd, "3", statusOK, false},
+		{"payload", "4 ls .", "4", statusOK, true},
+		{"proto again", "5 proto json", "5", statusBadRequest, false},
+		{"empty command", "6 ", "6", statusBadRequest, false},
+		{"group", "7 addgroup devs", "7", statusOK, false},
+		{"conflict", "8 addgroup devs", "8", statusConflict, false},
+		{"not found", "9 rmuser nobody", "9", statusNotFound, false},
+		{"unknown command", "10 nope", "10", statusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := decode(w.send(tt.line))
+			if f.ID != tt.wantID || f.Type != "response" || f.Status != tt.wantStatus {
+				t.Errorf("%q: got %+v", tt.line, f)
+			}
+			if (f.Data != nil) != tt.wantData {
+				t.Errorf("%q: data %v", tt.line, f.Data)
+			}
+		})
+	}
+}
+
+func TestDisconnectFrame(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-policy", "kick")
+	setFlag(t, "max-logins", "1")
+	h.serve()
+
+	old := h.dial("10.0.0.1")
+	old.send("proto json")
+	old.send("1 login root " + rootPswd)
+
+	h.dial("10.0.0.2").send("login root " + rootPswd)
+
+	var f frame
+	if err := json.Unmarshal([]byte(old.next()), &f); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := f.Data.(map[string]interface{}); f.Type != "disconnect" || data["reason"] != "replaced" {
+		t.Errorf("got %+v, want a disconnect of reason 'replaced'", f)
+	}
+}
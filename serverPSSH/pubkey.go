@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// A client proves the possession of a key by signing
+// keyauth_prefix + the decoded challenge.
+const keyauth_prefix = "pssh-keyauth:"
+const challengeTTL = time.Minute
+
+type keyChallenge struct {
+	nonce   []byte
+	nick    string
+	args    []string
+	expires time.Time
+}
+
+// parsePublicKey accepts a base64 PKIX (DER) key, e.g. the output of
+// "openssl pkey -in key.pem -pubout -outform DER | base64 -w0".
+func parsePublicKey(b64 string) (crypto.PublicKey, string, error) {
+	der, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, "", errors.New("key must be a base64 encoded PKIX key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		return key, "ed25519", nil
+
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, "", errors.New("RSA keys must be at least 2048 bits")
+		}
+		return key, "rsa", nil
+
+	default:
+		return nil, "", errors.New("only Ed25519 and RSA keys are supported")
+	}
+}
+
+func verifySignature(pub crypto.PublicKey, msg []byte, sig []byte) bool {
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, msg, sig)
+
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+
+	default:
+		return false
+	}
+}
+
+func (s *server) addkey(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 3 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "addkey [name] [base64 PKIX key]"`)
+		return
+	}
+
+	name := args[1]
+	_, kind, err := parsePublicKey(args[2])
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	pathToFile := db_path + c.nick + ".json"
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
+	key := "keys." + dbKey(name)
+	if gjson.Get(db, key).Exists() {
+		c.status(statusConflict)
+		c.msg(fmt.Sprintf("Key '%s' already exists. Use 'rmkey' first.", name))
+		return
+	}
+
+	db, _ = sjson.Set(db, key+".type", kind)
+	db, _ = sjson.Set(db, key+".key", args[2])
+	db, _ = sjson.Set(db, key+".added", time.Now().Unix())
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+	c.msg(fmt.Sprintf("You have successfully added %s key '%s'.", kind, name))
+	writeAudit(c, db, fmt.Sprintf("Added %s key '%s'", kind, name), -1, "")
+}
+
+func (s *server) lskey(c *client) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	db := string(content)
+
+	var listOfKeys string
+	gjson.Get(db, "keys").ForEach(func(name, v gjson.Result) bool {
+		der, _ := base64.StdEncoding.DecodeString(v.Get("key").String())
+		sum := sha256.Sum256(der)
+		listOfKeys += fmt.Sprintf("\n%s\t%s\tSHA256:%s\tadded %s", name.String(), v.Get("type").String(),
+			base64.RawStdEncoding.EncodeToString(sum[:]), time.Unix(v.Get("added").Int(), 0).Format("2006-01-02 15:04:05"))
+		return true
+	})
+
+	c.msg(fmt.Sprintf("Keys of '%s':%s", c.nick, listOfKeys))
+}
+
+func (s *server) rmkey(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "rmkey [name]"`)
+		return
+	}
+
+	name := args[1]
+	pathToFile := db_path + c.nick + ".json"
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
+	key := "keys." + dbKey(name)
+	if !gjson.Get(db, key).Exists() {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("Key '%s' does NOT exists.", name))
+		return
+	}
+
+	db, _ = sjson.Delete(db, key)
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+	c.msg(fmt.Sprintf("You have successfully removed key '%s'.", name))
+	writeAudit(c, db, fmt.Sprintf("Removed key '%s'", name), -1, "")
+}
+
+// keylogin starts a public key login: "keylogin [nick] {cm}".
+func (s *server) keylogin(c *client, args []string) {
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`A nick is required. Example: "keylogin [nick] {cm}"`)
+		return
+	}
+
+	if c.isLoggedIn {
+		c.status(statusConflict)
+		c.msg(`You are already logged in. Use "logout" first.`)
+		return
+	}
+
+	// The nick names a file, it must NOT lead out of db/.
+	if !isValidNick(args[1]) {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("User %s does NOT exists.", args[1]))
+		return
+	}
+
+	if reason := checkIPLockout(getPeer(c), time.Now()); reason != "" {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins from your address: %s.", reason))
+		return
+	}
+
+	nonce := make([]byte, 32)
+	_, _ = rand.Read(nonce)
+
+	// The challenge is issued for unknown users too, so that it does NOT
+	// tell which accounts exist.
+	c.challenge = &keyChallenge{
+		nonce:   nonce,
+		nick:    args[1],
+		args:    append([]string{"login", args[1], ""}, args[2:]...),
+		expires: time.Now().Add(challengeTTL),
+	}
+
+	c.msg("Challenge: " + base64.StdEncoding.EncodeToString(nonce))
+}
+
+// keyauth answers the challenge: "keyauth [base64 signature]".
+func (s *server) keyauth(c *client, args []string) {
+	ch := c.challenge
+	c.challenge = nil
+
+	if ch == nil || time.Now().After(ch.expires) {
+		c.status(statusNotFound)
+		c.msg(`There is no pending challenge. Use "keylogin [nick]" first.`)
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "keyauth [base64 signature]"`)
+		return
+	}
+
+	// A session switching to the user of the challenge would act as them.
+	if c.isLoggedIn {
+		c.status(statusConflict)
+		c.msg(`You are already logged in. Use "logout" first.`)
+		return
+	}
+
+	now := time.Now()
+	nick := ch.nick
+	pathToFile := db_path + nick + ".json"
+	content, err := os.ReadFile(pathToFile)
+	if err != nil {
+		c.status(statusUnauthorized)
+		c.msg("Key authentication failed.")
+		recordIPFailure(c, getPeer(c), now)
+		return
+	}
+
+	db := string(content)
+
+	// Nobody is logged in: the failures below are audited as those of nick,
+	// as for a password login.
+	attempted := func() {
+		c.nick = nick
+		c.isBeingAudited = gjson.Get(db, iba).Bool()
+	}
+
+	if reason := checkLockout(db, now); reason != "" {
+		attempted()
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins of this user: %s.", reason))
+		writeAudit(c, db, fmt.Sprintf("Refused key login from '%s': %s", getPeer(c), reason), -1, "")
+		return
+	}
+
+	sig, _ := base64.StdEncoding.DecodeString(args[1])
+	msg := append([]byte(keyauth_prefix), ch.nonce...)
+
+	var matched string
+	gjson.Get(db, "keys").ForEach(func(name, v gjson.Result) bool {
+		pub, _, err := parsePublicKey(v.Get("key").String())
+		if err == nil && verifySignature(pub, msg, sig) {
+			matched = name.String()
+			return false
+		}
+		return true
+	})
+
+	attempted()
+	if matched == "" {
+		c.status(statusUnauthorized)
+		c.msg("Key authentication failed.")
+
+		c.loginAttempts++
+		writeAudit(c, db, fmt.Sprintf("Failed key login from '%s'. Attempt #%d", getPeer(c), c.loginAttempts), -1, "")
+
+		recordLoginFailure(c, db, pathToFile, now)
+		return
+	}
+
+	writeAudit(c, db, fmt.Sprintf("Key '%s' accepted from '%s'", matched, getPeer(c)), -1, "")
+	s.secondFactor(c, ch.args, db, pathToFile)
+}
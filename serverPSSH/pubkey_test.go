@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func pkixKey(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	weakKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name     string
+		key      string
+		wantKind string
+		wantErr  string
+	}{
+		{"ed25519", pkixKey(t, edPub), "ed25519", ""},
+		{"rsa 2048", pkixKey(t, &rsaKey.PublicKey), "rsa", ""},
+		{"rsa 1024", pkixKey(t, &weakKey.PublicKey), "", "at least 2048 bits"},
+		{"ecdsa", pkixKey(t, &ecKey.PublicKey), "", "only Ed25519 and RSA"},
+		{"not base64", "!!!", "", "base64 encoded PKIX"},
+		{"not a key", base64.StdEncoding.EncodeToString([]byte("key")), "", "asn1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, kind, err := parsePublicKey(tt.key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || kind != tt.wantKind {
+				t.Fatalf("parsePublicKey() = %q, %v, want %q", kind, err, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	msg := []byte(keyauth_prefix + "nonce")
+	digest := sha256.Sum256(msg)
+	rsaSig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	edSig := ed25519.Sign(edPriv, msg)
+
+	tests := []struct {
+		name string
+		pub  crypto.PublicKey
+		msg  []byte
+		sig  []byte
+		want bool
+	}{
+		{"ed25519", edPub, msg, edSig, true},
+		{"ed25519, other message", edPub, []byte("nonce"), edSig, false},
+		{"rsa", &rsaKey.PublicKey, msg, rsaSig, true},
+		{"rsa, other message", &rsaKey.PublicKey, []byte("nonce"), rsaSig, false},
+		{"rsa signature, ed25519 key", edPub, msg, rsaSig, false},
+		{"unsupported key", "key", msg, edSig, false},
+	}
+
+	for _, tt := range tests {
+		if got := verifySignature(tt.pub, tt.msg, tt.sig); got != tt.want {
+			t.Errorf("%s: verifySignature() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeyLogin(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-backoff", "0s")
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	root := h.login("10.0.0.1", "root", rootPswd)
+	if out := h.do(root, "addkey laptop "+pkixKey(t, pub)); !strings.Contains(out, "You have successfully added ed25519 key 'laptop'.") {
+		t.Fatalf("addkey: %q", out)
+	}
+	h.do(root, "reg dan Pw4Tests_x9")
+	h.do(root, "logout")
+
+	// A record of the user's own, reachable by a path out of db/.
+	forged := `{"isAdmin": true, "keys": {"laptop": {"key": "` + pkixKey(t, pub) + `"}}}`
+	if err := os.WriteFile(users_path+"root/home/x.json", []byte(forged), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(priv ed25519.PrivateKey, withPrefix bool) func(string) string {
+		return func(challenge string) string {
+			nonce, _ := base64.StdEncoding.DecodeString(challenge)
+			msg := nonce
+			if withPrefix {
+				msg = append([]byte(keyauth_prefix), nonce...)
+			}
+			return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, msg))
+		}
+	}
+
+	tests := []struct {
+		name string
+		nick string
+		sign func(string) string
+		want string
+	}{
+		{"other key", "root", sign(otherPriv, true), "Key authentication failed."},
+		{"without the prefix", "root", sign(priv, false), "Key authentication failed."},
+		{"unknown user", "nobody", sign(priv, true), "Key authentication failed."},
+		{"path out of db", "../users/root/home/x", sign(priv, true), "There is no pending challenge."},
+		{"right key", "root", sign(priv, true), "You have successfully logged in."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := h.connect("10.0.0.2")
+			out := h.do(c, "keylogin "+tt.nick)
+			_, challenge, _ := strings.Cut(out, "> Challenge: ")
+			challenge, _, _ = strings.Cut(challenge, "\n")
+
+			signature := tt.sign(challenge)
+			if out := h.do(c, "keyauth "+signature); !strings.Contains(out, tt.want) {
+				t.Errorf("keyauth: got %q, want %q", out, tt.want)
+			}
+
+			// A challenge is answered once.
+			if out := h.do(c, "keyauth "+signature); !strings.Contains(out, "There is no pending challenge.") {
+				t.Errorf("second keyauth: %q", out)
+			}
+		})
+	}
+
+	// A session does NOT turn into another user by a failed key login.
+	dan := h.login("10.0.0.3", "dan", "Pw4Tests_x9")
+	if out := h.do(dan, "keylogin root"); !strings.Contains(out, "You are already logged in.") {
+		t.Errorf("keylogin while logged in: %q", out)
+	}
+	if out := h.do(dan, "keyauth junk"); !strings.Contains(out, "There is no pending challenge.") {
+		t.Errorf("keyauth while logged in: %q", out)
+	}
+	if dan.nick != "dan" || !dan.isLoggedIn {
+		t.Errorf("nick %q, logged in %v, want dan still logged in", dan.nick, dan.isLoggedIn)
+	}
+}
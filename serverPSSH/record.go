@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const sessions_path = audits_path + "sessions/"
+
+// recordingKey is read from the recording-key file at start.
+var recordingKey []byte
+
+// A recording is an asciinema v2 file: a JSON header followed by
+// [elapsed, "i"|"o", data] events. With a recording key, a finished
+// recording gets a .hmac sidecar, so that tampering can be noticed on replay
+// by whoever has the key.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	path  string
+	start time.Time
+}
+
+type recordHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isRecorded(db string) bool {
+	return gjson.Get(db, "cm").Uint() >= conf().recordMark || gjson.Get(db, "isRecorded").Bool()
+}
+
+func startRecording(c *client, db string) {
+	dir := sessions_path + c.nick + "/"
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("Could NOT create recording directory for '%s': %s", c.nick, err.Error())
+		return
+	}
+
+	trimRecordings(dir, gjson.Get(db, aoa).Int())
+
+	path := dir + c.sessionID + ".cast"
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_EXCL, conf().fileMode)
+	if err != nil {
+		log.Printf("Could NOT start recording of '%s': %s", c.nick, err.Error())
+		return
+	}
+
+	r := &recorder{f: f, path: path, start: time.Now()}
+	header, _ := json.Marshal(recordHeader{
+		Version:   2,
+		Width:     80,
+		Height:    24,
+		Timestamp: r.start.Unix(),
+		Title:     fmt.Sprintf("Session %s of '%s' from '%s'", c.sessionID, c.nick, getPeer(c)),
+		Env:       map[string]string{"USER": c.nick, "SESSION": c.sessionID},
+	})
+	_, _ = f.Write(append(header, '\n'))
+
+	c.setRecording(r)
+}
+
+func stopRecording(c *client) {
+	r := c.setRecording(nil)
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_ = r.f.Close()
+	r.f = nil
+
+	if recordingKey == nil {
+		return
+	}
+
+	sum, err := fileHMAC(r.path, recordingKey)
+	if err != nil {
+		log.Printf("Could NOT seal recording '%s': %s", r.path, err.Error())
+		return
+	}
+	_ = os.WriteFile(r.path+".hmac", []byte(sum+"\n"), conf().fileMode)
+}
+
+func (r *recorder) event(kind string, data string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return
+	}
+
+	line, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, data})
+	_, _ = r.f.Write(append(line, '\n'))
+}
+
+// Passwords never make it into a recording.
+func redactInput(msg string) string {
+	args := strings.Split(msg, " ")
+	switch args[0] {
+	case "login", "reg", "chpswd":
+		if len(args) > 2 {
+			args[2] = "****"
+		}
+
+	case "resume", "otp":
+		if len(args) > 1 {
+			args[1] = "****"
+		}
+
+	case "2fa":
+		if len(args) > 2 && args[1] != "reset" {
+			args[2] = "****"
+		}
+
+	case "passwd":
+		for i := 1; i < len(args) && i < 3; i++ {
+			args[i] = "****"
+		}
+	}
+
+	return strings.Join(args, " ")
+}
+
+// Only the newest amount recordings of a user are kept, like audit lines.
+func trimRecordings(dir string, amount int64) {
+	if amount <= 0 {
+		return
+	}
+
+	type recording struct {
+		path    string
+		modTime time.Time
+	}
+
+	var recordings []recording
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // removed meanwhile
+		}
+		recordings = append(recordings, recording{path, fi.ModTime()})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+
+	for len(recordings) >= int(amount) {
+		_ = os.Remove(recordings[0].path)
+		_ = os.Remove(recordings[0].path + ".hmac")
+		recordings = recordings[1:]
+	}
+}
+
+// loadRecordingKey reads the secret of recordingKeyPath, if any.
+func loadRecordingKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < 16 {
+		return nil, fmt.Errorf("'%s': a recording key must be at least 16 bytes", path)
+	}
+
+	return key, nil
+}
+
+func fileHMAC(path string, key []byte) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hmac.New(sha256.New, key)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func findRecording(sessionID string) (string, error) {
+	if sessionID == "" || strings.ContainsAny(sessionID, `/\.`) {
+		return "", errors.New("invalid session id")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(sessions_path, "*", sessionID+".cast"))
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no recording of session '%s'", sessionID)
+	}
+
+	return matches[0], nil
+}
+
+// verifyRecording compares a recording against its sidecar HMAC. With a key,
+// only the recording of a live session may have none: any other could have
+// been altered and its sidecar removed.
+func verifyRecording(path string, key []byte, live bool) (string, error) {
+	want, err := os.ReadFile(path + ".hmac")
+	switch {
+	case errors.Is(err, os.ErrNotExist) && live:
+		return "not sealed (session in progress)", nil
+	case errors.Is(err, os.ErrNotExist) && key == nil:
+		return "not sealed (interrupted or recorded without a key)", nil
+	case errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("integrity check FAILED for '%s': it has NOT been sealed", path)
+	case err != nil:
+		return "", err
+	case key == nil:
+		return "not verified (no recording key)", nil
+	}
+
+	got, err := fileHMAC(path, key)
+	if err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal([]byte(strings.TrimSpace(string(want))), []byte(got)) {
+		return "", fmt.Errorf("integrity check FAILED for '%s'", path)
+	}
+
+	return "verified", nil
+}
+
+type recordEvent struct {
+	at   float64
+	kind string
+	data string
+}
+
+func readRecording(path string) (recordHeader, []recordEvent, error) {
+	var header recordHeader
+	var events []recordEvent
+
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+
+	fileScanner := bufio.NewScanner(f)
+	fileScanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !fileScanner.Scan() {
+		return header, nil, errors.New("empty recording")
+	}
+	if err := json.Unmarshal(fileScanner.Bytes(), &header); err != nil {
+		return header, nil, err
+	}
+
+	for fileScanner.Scan() {
+		e := gjson.ParseBytes(fileScanner.Bytes()).Array()
+		if len(e) != 3 {
+			continue
+		}
+		events = append(events, recordEvent{at: e[0].Float(), kind: e[1].String(), data: e[2].String()})
+	}
+
+	return header, events, fileScanner.Err()
+}
+
+func (s *server) replay(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if !c.isAudit {
+		c.status(statusForbidden)
+		c.msg("Only audit can replay sessions.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "replay [session-id]"`)
+		return
+	}
+
+	path, err := findRecording(args[1])
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	session, ok := s.sessions[args[1]]
+	status, err := verifyRecording(path, recordingKey, ok && session.recording() != nil)
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	header, events, err := readRecording(path)
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	var sb strings.Builder
+	for _, e := range events {
+		arrow := "<"
+		if e.kind == "o" {
+			arrow = ">"
+		}
+		sb.WriteString(fmt.Sprintf("\n+%.3fs %s %s", e.at, arrow, strings.TrimRight(e.data, "\n")))
+	}
+
+	c.msg(fmt.Sprintf("%s (%s, %s):%s", header.Title, time.Unix(header.Timestamp, 0), status, sb.String()))
+}
+
+// playRecording is the offline player: "serverPSSH replay [-speed x] [-key file] [file]".
+func playRecording(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed multiplier")
+	maxWait := fs.Float64("maxwait", 2, "Max pause between events in seconds")
+	keyPath := fs.String("key", "", "Recording key file, to verify the recording")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Println("Usage: ./serverPSSH replay [-speed x] [-maxwait s] [-key file] [file.cast]")
+		os.Exit(2)
+	}
+
+	key, err := loadRecordingKey(*keyPath)
+	if err != nil {
+		log.Fatalf("[%s] Unable to replay.", err.Error())
+	}
+
+	path := fs.Arg(0)
+	status, err := verifyRecording(path, key, false)
+	if err != nil {
+		log.Fatalf("[%s] Unable to replay.", err.Error())
+	}
+
+	header, events, err := readRecording(path)
+	if err != nil {
+		log.Fatalf("[%s] Unable to replay.", err.Error())
+	}
+
+	fmt.Printf("%s (%s, %s)\n", header.Title, time.Unix(header.Timestamp, 0), status)
+
+	var last float64 = 0
+	for _, e := range events {
+		wait := (e.at - last) / *speed
+		if wait > *maxWait {
+			wait = *maxWait
+		}
+		time.Sleep(time.Duration(wait * float64(time.Second)))
+		last = e.at
+
+		if e.kind == "i" {
+			fmt.Print("$ " + e.data)
+		} else {
+			fmt.Print(e.data)
+		}
+	}
+}
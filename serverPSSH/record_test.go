@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactInput(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"login dan Pw4Tests_x9", "login dan ****"},
+		{"reg dan Pw4Tests_x9 50", "reg dan **** 50"},
+		{"chpswd dan Pw4Tests_x9", "chpswd dan ****"},
+		{"resume 0123abcd", "resume ****"},
+		{"otp 01234-56789", "otp ****"},
+		{"2fa disable 123456", "2fa disable ****"},
+		{"2fa reset dan", "2fa reset dan"},
+		{"passwd old new", "passwd **** ****"},
+		{"login dan", "login dan"},
+		{"ls -l", "ls -l"},
+	}
+
+	for _, tt := range tests {
+		if got := redactInput(tt.msg); got != tt.want {
+			t.Errorf("redactInput(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestTrimRecordings(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int64
+		want   []string
+	}{
+		{"no limit", 0, []string{"a.cast", "b.cast", "c.cast"}},
+		{"room for one more", 2, []string{"c.cast"}},
+		{"room for the newest", 3, []string{"b.cast", "c.cast"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i, name := range []string{"a.cast", "b.cast", "c.cast"} {
+				path := filepath.Join(dir, name)
+				_ = os.WriteFile(path, nil, 0600)
+				_ = os.WriteFile(path+".hmac", nil, 0600)
+				at := time.Now().Add(time.Duration(i-3) * time.Minute)
+				_ = os.Chtimes(path, at, at)
+			}
+			// A dangling link can NOT be stat'ed, it must NOT stop trimming.
+			_ = os.Symlink(filepath.Join(dir, "gone"), filepath.Join(dir, "broken.cast"))
+
+			trimRecordings(dir, tt.amount)
+
+			matches, _ := filepath.Glob(filepath.Join(dir, "[abc].cast"))
+			var got []string
+			for _, m := range matches {
+				got = append(got, filepath.Base(m))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("left %v, want %v", got, tt.want)
+			}
+			sidecars, _ := filepath.Glob(filepath.Join(dir, "*.hmac"))
+			if len(sidecars) != len(tt.want) {
+				t.Errorf("left %d sidecars, want %d", len(sidecars), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestIsRecorded(t *testing.T) {
+	setFlag(t, "record-mark", "60")
+
+	tests := []struct {
+		db   string
+		want bool
+	}{
+		{`{"cm": 50}`, false},
+		{`{"cm": 60}`, true},
+		{`{"cm": 50, "isRecorded": true}`, true},
+	}
+
+	for _, tt := range tests {
+		if got := isRecorded(tt.db); got != tt.want {
+			t.Errorf("isRecorded(%s) = %v, want %v", tt.db, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyRecording(t *testing.T) {
+	key := []byte("0123456789abcdef")
+
+	tests := []struct {
+		name    string
+		seal    []byte
+		verify  []byte
+		tamper  bool
+		live    bool
+		want    string
+		wantErr bool
+	}{
+		{name: "intact", seal: key, verify: key, want: "verified"},
+		{name: "tampered", seal: key, verify: key, tamper: true, wantErr: true},
+		{name: "other key", seal: key, verify: []byte("fedcba9876543210"), wantErr: true},
+		{name: "no key to verify", seal: key, verify: nil, want: "not verified (no recording key)"},
+		{name: "in progress", seal: nil, verify: key, live: true, want: "not sealed (session in progress)"},
+		{name: "sidecar removed", seal: nil, verify: key, wantErr: true},
+		{name: "not sealed, no key", seal: nil, verify: nil, want: "not sealed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "s.cast")
+			_ = os.WriteFile(path, []byte("{\"version\": 2}\n[0.1, \"i\", \"ls\\n\"]\n"), 0600)
+			if tt.seal != nil {
+				sum, err := fileHMAC(path, tt.seal)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = os.WriteFile(path+".hmac", []byte(sum+"\n"), 0600)
+			}
+			if tt.tamper {
+				_ = os.WriteFile(path, []byte("{\"version\": 2}\n[0.1, \"i\", \"id\\n\"]\n"), 0600)
+			}
+
+			got, err := verifyRecording(path, tt.verify, tt.live)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyRecording() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("verifyRecording() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRecordingKey(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	good := filepath.Join(dir, "good")
+	_ = os.WriteFile(short, []byte("secret\n"), 0600)
+	_ = os.WriteFile(good, []byte("0123456789abcdef\n"), 0600)
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{short, "", true},
+		{good, "0123456789abcdef", false},
+		{filepath.Join(dir, "missing"), "", true},
+	}
+
+	for _, tt := range tests {
+		key, err := loadRecordingKey(tt.path)
+		if (err != nil) != tt.wantErr || string(key) != tt.want {
+			t.Errorf("loadRecordingKey(%q) = %q, %v", tt.path, key, err)
+		}
+	}
+}
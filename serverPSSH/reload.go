@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Settings taken only at startup, a reload keeps their old values.
+var restartOnly = []string{"listen", "data-root", "keepalive", "recording-key"}
+
+// cmdLineValues are the flags given on the command line, which override
+// the configuration file on every reload too.
+var cmdLineValues map[string]string
+
+// startDir is the working directory before entering the data root.
+var startDir string
+
+// sinksSource is the definition of the running audit sinks.
+var sinksSource string
+
+// listenersSource is the 'listeners' section the server was started with.
+var listenersSource string
+
+// reloadConfig re-reads the configuration file into new settings. Either
+// all of it is taken or, if anything is wrong, none of it. It returns notes
+// for the caller.
+func reloadConfig() ([]string, error) {
+	old := conf()
+	cfg, err := readConfig(old.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Settings removed from the file fall back to their defaults.
+	values := cfg.values(cmdLineValues)
+	st, err := newSettings(values, cfg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []string
+	for _, name := range restartOnly {
+		if st.values[name] != old.values[name] {
+			values[name] = old.values[name]
+			notes = append(notes, fmt.Sprintf("'%s' stays '%s' until restart", name, old.values[name]))
+		}
+	}
+	if len(notes) > 0 {
+		if st, err = newSettings(values, cfg.path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := st.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.listens != listenersSource {
+		if _, err := configuredListeners(cfg, st); err != nil {
+			return nil, err
+		}
+		notes = append(notes, "'listeners' and their policies stay as they are until restart")
+	}
+
+	if st.dictionary, err = loadDictionary(st.pswdDictionary); err != nil {
+		return nil, fmt.Errorf("pswd-dictionary: %s", err.Error())
+	}
+
+	sinks, source, err := loadConfiguredSinks(cfg, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.forwardRules, err = loadConfiguredForwarding(cfg); err != nil {
+		return nil, err
+	}
+	st.forwarding = cfg.forwarding
+
+	current.Store(st)
+
+	if source != sinksSource {
+		stopAuditSinks()
+		startAuditSinks(sinks)
+		sinksSource = source
+		notes = append(notes, fmt.Sprintf("%d audit sinks restarted", len(sinks)))
+	}
+
+	if st.forwarding != old.forwarding {
+		notes = append(notes, fmt.Sprintf("%d forwarding rules taken for new tunnels, open ones stay until closed", len(st.forwardRules)))
+	}
+
+	return notes, nil
+}
+
+// reload is run by "reload" of an admin or by SIGHUP, then c is nil.
+func (s *server) reload(c *client) {
+	if c != nil {
+		if !c.isLoggedIn {
+			c.status(statusUnauthorized)
+			c.msg("You must log in first.")
+			return
+		}
+
+		if !c.isAdmin {
+			c.status(statusForbidden)
+			c.msg("Only admin can reload the configuration.")
+			return
+		}
+	}
+
+	notes, err := reloadConfig()
+	if err != nil {
+		log.Printf("[%s] Configuration has NOT been reloaded.", err.Error())
+		if c != nil {
+			c.status(statusError)
+			c.msg(fmt.Sprintf("Configuration has NOT been reloaded: %s", err.Error()))
+		}
+		return
+	}
+
+	msg := "Configuration has been reloaded."
+	if len(notes) > 0 {
+		msg = fmt.Sprintf("Configuration has been reloaded: %s.", strings.Join(notes, "; "))
+	}
+	log.Printf(msg)
+
+	if c != nil {
+		c.msg(msg)
+
+		content, _ := os.ReadFile(db_path + c.nick + ".json")
+		writeAudit(c, string(content), "Reloaded the configuration", -1, "")
+	}
+}
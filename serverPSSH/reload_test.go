@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	newHarness(t)
+	path, _ := filepath.Abs("pssh.json")
+	setFlag(t, "config", path)
+
+	tests := []struct {
+		name      string
+		content   string
+		wantErr   string
+		wantNotes []string
+		check     func(t *testing.T, old *settings, st *settings)
+	}{
+		{
+			name:    "new values",
+			content: `{"idle-timeout": "5m", "max-logins": 3}`,
+			check: func(t *testing.T, old *settings, st *settings) {
+				if st.idleTimeout != 5*time.Minute || st.maxLogins != 3 {
+					t.Errorf("idle-timeout %s, max-logins %d", st.idleTimeout, st.maxLogins)
+				}
+				if old.idleTimeout == st.idleTimeout {
+					t.Error("the old settings have been changed in place")
+				}
+			},
+		},
+		{
+			name:      "restart only",
+			content:   `{"listen": ":9999", "keepalive": "1m"}`,
+			wantNotes: []string{"'listen' stays ':8888' until restart", "'keepalive' stays '30s' until restart"},
+			check: func(t *testing.T, old *settings, st *settings) {
+				if st.listenAddr != ":8888" || st.keepAlive != 30*time.Second {
+					t.Errorf("listen %q, keepalive %s", st.listenAddr, st.keepAlive)
+				}
+			},
+		},
+		{
+			name:      "forwarding",
+			content:   `{"forwarding": {"lab": {"groups": ["lab"], "local": ["10.0.0.0/24:22"]}}}`,
+			wantNotes: []string{"1 forwarding rules taken for new tunnels"},
+			check: func(t *testing.T, old *settings, st *settings) {
+				if len(st.forwardRules) != 1 || len(old.forwardRules) != 0 {
+					t.Errorf("rules %d, old rules %d", len(st.forwardRules), len(old.forwardRules))
+				}
+			},
+		},
+		{
+			name:      "listeners",
+			content:   `{"listeners": {"local": {"network": "tcp", "addr": "127.0.0.1:0"}}}`,
+			wantNotes: []string{"'listeners' and their policies stay as they are until restart"},
+		},
+		{
+			name:    "invalid",
+			content: `{"idle-timeout": "5m", "max-logins": 0}`,
+			wantErr: "max-logins must be >= 1",
+		},
+		{
+			name:    "unknown",
+			content: `{"max-loggins": 3}`,
+			wantErr: "unknown settings: max-loggins",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			old := conf()
+			t.Cleanup(func() { current.Store(old) })
+
+			notes, err := reloadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if conf() != old {
+					t.Error("the settings have been swapped despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			joined := strings.Join(notes, "; ")
+			for _, want := range tt.wantNotes {
+				if !strings.Contains(joined, want) {
+					t.Errorf("notes = %q, want %q", joined, want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, old, conf())
+			}
+		})
+	}
+}
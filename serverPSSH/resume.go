@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// A logged in session asks for a token with "resume". If its connection
+// drops, the session is kept detached for resumeTimeout: still logged in,
+// with its id, directory and recording. A new connection takes it over with
+// "resume [token]", so the user is NOT logged in again and the audit goes
+// on in the same session.
+//
+// A token is "{session}.{secret}", only the hash of the secret is kept. It
+// is replaced on every resume.
+
+func hashResumeSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *server) resume(c *client, args []string) {
+	if len(args) < 2 {
+		if !c.isLoggedIn {
+			c.status(statusUnauthorized)
+			c.msg("You must log in first.")
+			return
+		}
+		s.issueResumeToken(c)
+		return
+	}
+
+	now := time.Now()
+	if reason := checkIPLockout(getPeer(c), now); reason != "" {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins from your address: %s.", reason))
+		return
+	}
+
+	id, secret, _ := strings.Cut(args[1], ".")
+	old, ok := s.sessions[id]
+	if !ok || old == c || !old.isLoggedIn || old.resumeHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hashResumeSecret(secret)), []byte(old.resumeHash)) != 1 {
+		c.status(statusUnauthorized)
+		c.msg("The resume token is NOT valid.")
+		recordIPFailure(c, getPeer(c), now)
+		return
+	}
+
+	content, err := os.ReadFile(db_path + old.nick + ".json")
+	if err != nil {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("User %s does NOT exists.", old.nick))
+		return
+	}
+	db := string(content)
+
+	if old.isAdmin && !c.listener.admin {
+		c.status(statusForbidden)
+		c.msg("Admins can NOT log in on this connection.")
+		writeAudit(old, db, fmt.Sprintf("Refused resume of session %s from '%s' on '%s'", id, getPeer(c), c.listener.name), -1, "")
+		return
+	}
+
+	// The old connection may be gone without the server knowing it yet.
+	if !old.detached {
+		old.disconnect("resumed", fmt.Sprintf("Your session has been resumed from '%s'.", getPeer(c)))
+		_ = old.conn.Close()
+	}
+	s.takeOver(c, old)
+
+	writeAudit(c, db, fmt.Sprintf("Resumed session %s from '%s' on '%s'", c.sessionID, getPeer(c), c.listener.name), -1, "")
+	log.Printf("A user '%s' has resumed session %s from %s.", c.nick, c.sessionID, c.peer)
+
+	c.msg(fmt.Sprintf("You have successfully resumed session %s.", c.sessionID))
+	if c.restriction != "" {
+		c.status(statusForbidden)
+		c.msg(c.restriction)
+	}
+	s.issueResumeToken(c)
+}
+
+func (s *server) issueResumeToken(c *client) {
+	if conf().resumeTimeout <= 0 {
+		c.msg("Resume token: -")
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	secret := hex.EncodeToString(b)
+	c.resumeHash = hashResumeSecret(secret)
+
+	token := c.sessionID + "." + secret
+	c.secretMsg("Resume token: "+token, "Resume token: ****")
+	c.setData(map[string]string{"session": c.sessionID, "token": token})
+}
+
+// takeOver moves the session of old to c, which has just connected.
+func (s *server) takeOver(c *client, old *client) {
+	s.closeTunnels(old, "the session has been resumed")
+	if old.expiry != nil {
+		old.expiry.Stop()
+		old.expiry = nil
+	}
+
+	delete(s.sessions, c.sessionID)
+	c.sessionID = old.sessionID
+	s.sessions[c.sessionID] = c
+
+	c.isLoggedIn = true
+	c.hasLoggedIn.Store(true)
+	c.isAdmin = old.isAdmin
+	c.isAudit = old.isAudit
+	c.isBeingAudited = old.isBeingAudited
+	c.nick = old.nick
+	c.pswd = old.pswd
+	c.actDir = old.actDir
+	c.homeDir = old.homeDir
+	c.currDir = old.currDir
+	c.groups = old.groups
+	c.cm = old.cm
+	c.loginTime = old.loginTime
+	c.setRecording(old.setRecording(nil))
+	c.restrictions = old.restrictions
+	c.restriction = old.restriction
+
+	// Whatever still comes from the old connection finds nobody logged in.
+	old.isLoggedIn = false
+	old.detached = false
+	old.resumeHash = ""
+	old.groups = nil
+	old.restrictions = nil
+}
+
+// detach is run when the connection of c has dropped. A session without a
+// resume token is logged out as before.
+func (s *server) detach(c *client) {
+	if !c.isLoggedIn || c.resumeHash == "" || conf().resumeTimeout <= 0 || s.isClosing {
+		s.logout(c)
+		return
+	}
+
+	s.closeTunnels(c, "the connection has dropped")
+	c.detached = true
+	c.challenge = nil
+	c.pending2FA = nil
+	c.expiry = time.AfterFunc(conf().resumeTimeout, func() {
+		s.commands <- command{
+			id:     CmdExpire,
+			client: c,
+		}
+	})
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	writeAudit(c, string(content), fmt.Sprintf("Session %s has been detached, it can be resumed for %s", c.sessionID, conf().resumeTimeout), -1, "")
+	log.Printf("Session %s of '%s' has been detached.", c.sessionID, c.nick)
+}
+
+// expire ends a detached session nobody has resumed.
+func (s *server) expire(c *client) {
+	if !c.detached {
+		return
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	writeAudit(c, string(content), fmt.Sprintf("Session %s has NOT been resumed in %s", c.sessionID, conf().resumeTimeout), -1, "")
+
+	s.logout(c)
+	s.release(c)
+}
+
+// release removes a detached session from the registry.
+func (s *server) release(c *client) {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	c.detached = false
+
+	s.disconnect(c)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// resumeToken asks for a token of c.
+func (h *harness) resumeToken(c *client) string {
+	h.t.Helper()
+	out := h.do(c, "resume")
+	i := strings.Index(out, "Resume token: ")
+	if i < 0 {
+		h.t.Fatalf("resume: %q", out)
+	}
+	return strings.Fields(out[i+len("Resume token: "):])[0]
+}
+
+func TestResume(t *testing.T) {
+	h := newHarness(t)
+
+	old := h.login("10.0.0.1", "root", rootPswd)
+	token := h.resumeToken(old)
+	id, dir := old.sessionID, old.currDir
+
+	h.s.detach(old)
+	if !old.detached || h.s.sessions[id] != old {
+		t.Fatal("the session has NOT been detached")
+	}
+
+	wrong, _ := h.connect("10.0.0.9")
+	if out := h.do(wrong, "resume "+id+".0000"); !strings.Contains(out, "The resume token is NOT valid.") {
+		t.Errorf("wrong secret: %q", out)
+	}
+
+	c, _ := h.connect("10.0.0.2")
+	out := h.do(c, "resume "+token)
+	if !strings.Contains(out, "You have successfully resumed session "+id+".") {
+		t.Fatalf("resume: %q", out)
+	}
+	if c.sessionID != id || c.currDir != dir || !c.isLoggedIn || h.s.sessions[id] != c {
+		t.Errorf("session %s in %s, logged in %v", c.sessionID, c.currDir, c.isLoggedIn)
+	}
+	if old.isLoggedIn || old.detached {
+		t.Error("the old connection still holds the session")
+	}
+
+	if out := h.do(c, "pwd"); !strings.Contains(out, dir) {
+		t.Errorf("pwd: %q", out)
+	}
+
+	// A token is good for one resume only.
+	other, _ := h.connect("10.0.0.3")
+	if out := h.do(other, "resume "+token); !strings.Contains(out, "The resume token is NOT valid.") {
+		t.Errorf("reused token: %q", out)
+	}
+}
+
+// A session logged in elsewhere is logged out first, as on "login".
+func TestResumeWhileLoggedIn(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-policy", "allow")
+	setFlag(t, "max-logins", "2")
+
+	old := h.login("10.0.0.1", "root", rootPswd)
+	token := h.resumeToken(old)
+	h.s.detach(old)
+
+	c := h.login("10.0.0.2", "root", rootPswd)
+	loginID := c.sessionID
+	out := h.do(c, "resume "+token)
+	if !strings.Contains(out, "You have successfully logged out.") || !strings.Contains(out, "You have successfully resumed session") {
+		t.Errorf("got %q", out)
+	}
+	if _, ok := h.s.sessions[loginID]; ok {
+		t.Error("the session of the login is still registered")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	h := newHarness(t)
+
+	c := h.login("10.0.0.1", "root", rootPswd)
+	h.resumeToken(c)
+	h.s.detach(c)
+	h.s.expire(c)
+
+	if _, ok := h.s.sessions[c.sessionID]; ok || c.isLoggedIn {
+		t.Error("the expired session is still there")
+	}
+
+	content, _ := os.ReadFile(db_path + "root.json")
+	if gjson.GetBytes(content, "isActive").Bool() {
+		t.Error("isActive is true after the session has expired")
+	}
+}
+
+func TestDetachWithoutToken(t *testing.T) {
+	h := newHarness(t)
+
+	c := h.login("10.0.0.1", "root", rootPswd)
+	h.s.detach(c)
+
+	if c.detached || c.isLoggedIn {
+		t.Error("a session without a token has NOT been logged out")
+	}
+}
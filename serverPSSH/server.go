@@ -3,8 +3,8 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/miracl/conflate"
@@ -26,140 +26,300 @@ const group_path = "group/"
 const db_files = "files/files.json"
 const audits_path = "audits/"
 
+// Audit streams of watched files. They are NOT under audits_path, where
+// "files" is the stream of all files of older servers or of a user named so.
+const file_audits_path = "file_audits/"
+
 const iba = "isBeingAudited"
 const aoa = "amountOfAudits"
 const arw = "auditReadWriteRights"
 
-const std_mark uint64 = 50
-
 type server struct {
 	commands chan command
+	sessions map[string]*client
+
+	isClosing bool
+	closed    chan struct{} // closed once all sessions are gone on shutdown
 }
 
 func newServer() *server {
 	return &server{
 		commands: make(chan command),
+		sessions: make(map[string]*client),
+		closed:   make(chan struct{}),
 	}
 }
 
 func (s *server) run() {
 	for cmd := range s.commands {
-		switch cmd.id {
-		case CmdReg:
-			s.reg(cmd.client, cmd.args)
+		if cmd.client == nil { // sent by the server itself
+			switch cmd.id {
+			case CmdReload:
+				s.reload(nil)
+			case CmdShutdown:
+				s.closeSessions()
+			}
+			continue
+		}
 
-		case CmdChPswd:
-			s.chpswd(cmd.client, cmd.args)
+		// Replies written meanwhile are of the client's current request.
+		cmd.client.inRequest = true
+		s.handle(cmd)
+		cmd.client.inRequest = false
+	}
+}
 
-		case CmdLogin:
-			s.login(cmd.client, cmd.args)
+func (s *server) handle(cmd command) {
+	switch cmd.id {
+	case CmdReply:
+		cmd.client.status(cmd.status)
+		if cmd.err != nil {
+			cmd.client.err(cmd.err)
+		} else {
+			cmd.client.msg(cmd.args[0])
+		}
+		return
 
-		case CmdPwd:
-			s.pwd(cmd.client)
+	case CmdProto:
+		s.proto(cmd.client, cmd.args)
+		return
 
-		case CmdWrite:
-			s.write(cmd.client, cmd.args)
+	case CmdBegin:
+		cmd.client.beginRequest(cmd.args[0])
+		return
 
-		case CmdRead:
-			s.read(cmd.client, cmd.args)
+	case CmdEnd:
+		cmd.client.endRequest()
+		return
 
-		case CmdLs:
-			s.ls(cmd.client, cmd.args)
+	case CmdTunnelUp:
+		s.tunnelUp(cmd.client, cmd.args[0], cmd.args[1])
+		return
 
-		case CmdLogout:
-			s.logout(cmd.client)
+	case CmdTunnelAccept:
+		s.tunnelAccept(cmd.client, cmd.args[0])
+		return
 
-		case CmdHelp:
-			s.help(cmd.client, cmd.args)
+	case CmdTunnelEnd:
+		s.tunnelEnd(cmd.client, cmd.args[0], cmd.args[1], cmd.args[2])
+		return
+	}
 
-		case CmdRmUser:
-			s.rmuser(cmd.client, cmd.args)
+	cmd.client.lastActive = time.Now()
 
-		case CmdLsUsers:
-			s.lsusers(cmd.client)
+	if s.isClosing && cmd.id != CmdLogout && cmd.id != CmdDisconnect && cmd.id != CmdDetach && cmd.id != CmdExpire {
+		cmd.client.status(statusUnavailable)
+		cmd.client.msg("The server is shutting down.")
+		cmd.client.endRequest()
+		_ = cmd.client.conn.Close()
+		return
+	}
 
-		case CmdQuit:
-			s.quit(cmd.client)
+	if !cmd.client.isAllowed(cmd.id) {
+		cmd.client.status(statusForbidden)
+		cmd.client.msg(cmd.client.restriction)
+		return
+	}
 
-		// lab2
-		case CmdAddGroup:
-			s.addgroup(cmd.client, cmd.args)
+	switch cmd.id {
+	case CmdReg:
+		s.reg(cmd.client, cmd.args)
 
-		case CmdU2G:
-			s.u2g(cmd.client, cmd.args)
+	case CmdChPswd:
+		s.chpswd(cmd.client, cmd.args)
 
-		case CmdTrimGroup:
-			s.trimgroup(cmd.client, cmd.args)
+	case CmdLogin:
+		s.login(cmd.client, cmd.args)
 
-		case CmdRmGroup:
-			s.rmgroup(cmd.client, cmd.args)
+	case CmdPwd:
+		s.pwd(cmd.client)
 
-		case CmdRR:
-			s.rr(cmd.client, cmd.args)
+	case CmdWrite:
+		s.write(cmd.client, cmd.args)
 
-		case CmdChMod:
-			s.chmod(cmd.client, cmd.args)
+	case CmdRead:
+		s.read(cmd.client, cmd.args)
 
-		// lab3
-		case CmdAppend:
-			s.append(cmd.client, cmd.args)
+	case CmdLs:
+		s.ls(cmd.client, cmd.args)
 
-		case CmdChMark:
-			s.chmark(cmd.client, cmd.args)
+	case CmdLogout:
+		s.logout(cmd.client)
 
-		case CmdGM:
-			s.gm(cmd.client, cmd.args)
+	case CmdHelp:
+		s.help(cmd.client, cmd.args)
 
-		// lab4
-		case CmdWatch:
-			s.watch(cmd.client, cmd.args)
-		}
+	case CmdRmUser:
+		s.rmuser(cmd.client, cmd.args)
+
+	case CmdLsUsers:
+		s.lsusers(cmd.client)
+
+	case CmdQuit:
+		s.quit(cmd.client)
+
+	// lab2
+	case CmdAddGroup:
+		s.addgroup(cmd.client, cmd.args)
+
+	case CmdU2G:
+		s.u2g(cmd.client, cmd.args)
+
+	case CmdTrimGroup:
+		s.trimgroup(cmd.client, cmd.args)
+
+	case CmdRmGroup:
+		s.rmgroup(cmd.client, cmd.args)
+
+	case CmdRR:
+		s.rr(cmd.client, cmd.args)
+
+	case CmdChMod:
+		s.chmod(cmd.client, cmd.args)
+
+	// lab3
+	case CmdAppend:
+		s.append(cmd.client, cmd.args)
+
+	case CmdChMark:
+		s.chmark(cmd.client, cmd.args)
+
+	case CmdGM:
+		s.gm(cmd.client, cmd.args)
+
+	// lab4
+	case CmdWatch:
+		s.watch(cmd.client, cmd.args)
+
+	case CmdReplay:
+		s.replay(cmd.client, cmd.args)
+
+	case CmdJoin:
+		s.join(cmd.client)
+
+	case CmdDisconnect:
+		s.disconnect(cmd.client)
+
+	case CmdWho:
+		s.who(cmd.client)
+
+	case CmdSessions:
+		s.lssessions(cmd.client)
+
+	case CmdKill:
+		s.kill(cmd.client, cmd.args)
+
+	case CmdUnlock:
+		s.unlock(cmd.client, cmd.args)
+
+	case CmdKeyLogin:
+		s.keylogin(cmd.client, cmd.args)
+
+	case CmdKeyAuth:
+		s.keyauth(cmd.client, cmd.args)
+
+	case CmdAddKey:
+		s.addkey(cmd.client, cmd.args)
+
+	case CmdLsKey:
+		s.lskey(cmd.client)
+
+	case CmdRmKey:
+		s.rmkey(cmd.client, cmd.args)
+
+	case CmdOTP:
+		s.otp(cmd.client, cmd.args)
+
+	case CmdTwoFA:
+		s.twofa(cmd.client, cmd.args)
+
+	case CmdPasswd:
+		s.passwd(cmd.client, cmd.args)
+
+	case CmdReload:
+		s.reload(cmd.client)
+
+	case CmdComplete:
+		s.complete(cmd.client, cmd.args)
+
+	case CmdResume:
+		s.resume(cmd.client, cmd.args)
+
+	case CmdDetach:
+		s.detach(cmd.client)
+
+	case CmdExpire:
+		s.expire(cmd.client)
+
+	case CmdChGrp:
+		s.chgrp(cmd.client, cmd.args)
+
+	case CmdMkdir:
+		s.mkdir(cmd.client, cmd.args)
+
+	case CmdPut:
+		s.put(cmd.client, cmd.args)
+
+	case CmdRm:
+		s.rm(cmd.client, cmd.args)
+
+	case CmdTunnel:
+		s.tunnel(cmd.client, cmd.args)
 	}
 }
 
-func (s *server) newClient(conn net.Conn) *client {
-	log.Printf(`A new client has joined from %s`, conn.RemoteAddr().String())
+func (s *server) newClient(conn net.Conn, l *listener, peer string) *client {
+	log.Printf(`A new client has joined from %s on %s`, peer, l.name)
 
 	return &client{
-		conn:     conn,
-		nick:     "anonymous",
-		commands: s.commands,
+		conn:      conn,
+		nick:      "anonymous",
+		commands:  s.commands,
+		sessionID: newSessionID(),
+		peer:      peer,
+		listener:  l,
+		tunnels:   newTunnelSet(),
 	}
 }
 
 func (s *server) reg(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can register users.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`A nick and a password are required. Example: "reg [nick] [pswd] {cm}"`)
 		return
 	}
 
 	nick := args[1]
 	if _, err := os.Stat(db_path + nick + ".json"); err == nil {
+		c.status(statusConflict)
 		c.msg(fmt.Sprintf("User %s already exists. Use 'chpswd' to change password for a user.", nick))
 		return
 	}
 
-	h := sha1.New()
-	h.Write([]byte(args[2]))
-	pswd := hex.EncodeToString(h.Sum(nil))
+	if err := checkPassword(nick, args[2], ""); err != nil {
+		c.err(err)
+		return
+	}
 
 	c.cm, _ = getMark(args, "")
 
 	db, _ := sjson.Set("", "nick", nick)
-	db, _ = sjson.Set(db, "pswd", pswd)
+	db = setPassword(db, args[2])
 	db, _ = sjson.Set(db, "cm", c.cm)
 
-	_ = os.WriteFile(db_path+nick+".json", []byte(db), 0755)
+	_ = os.WriteFile(db_path+nick+".json", []byte(db), conf().fileMode)
 	_ = os.MkdirAll(users_path+nick+"/home", os.ModePerm)
 
 	c.msg(fmt.Sprintf("You have successfully registered '%s'.", nick))
@@ -167,42 +327,47 @@ func (s *server) reg(c *client, args []string) {
 
 func (s *server) chpswd(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
-		c.msg("Only admin can register users.")
+		c.status(statusForbidden)
+		c.msg(`Only admin can change passwords of users. Use "passwd [old] [new]" to change your own.`)
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`A nick and a password are required. Example: "chpswd [nick] [pswd]"`)
 		return
 	}
 
 	nick := args[1]
 	if _, err := os.Stat(db_path + nick + ".json"); errors.Is(err, os.ErrNotExist) {
-		c.msg(fmt.Sprintf("User %s does NOT exists.", c.nick))
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("User %s does NOT exists.", nick))
 		return
 	}
 
-	h := sha1.New()
-	h.Write([]byte(args[2]))
-	new_pswd := hex.EncodeToString(h.Sum(nil))
-
 	pathToFile := db_path + nick + ".json"
 	content, _ := os.ReadFile(pathToFile)
 	db := string(content)
 
-	old_pswd := gjson.Get(db, "pswd").String()
-	if old_pswd == new_pswd {
+	if gjson.Get(db, "pswd").String() == hashPassword(args[2]) {
+		c.status(statusConflict)
 		c.msg("Current password and new passwords are the same. Proceeding nothing.")
 		return
 	}
 
-	db, _ = sjson.Set(db, "pswd", new_pswd)
-	_ = os.WriteFile(db_path+nick+".json", []byte(db), 0755)
+	if err := checkPassword(nick, args[2], db); err != nil {
+		c.err(err)
+		return
+	}
+
+	db = setPassword(db, args[2])
+	_ = os.WriteFile(db_path+nick+".json", []byte(db), conf().fileMode)
 
 	c.msg(fmt.Sprintf("You have successfully changed password for '%s'.", nick))
 }
@@ -221,75 +386,127 @@ func appendGroups(c *client) {
 
 func (s *server) login(c *client, args []string) {
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`A nick and a password are required. Example: "login [nick] [pswd] {cm}"`)
 		return
 	}
 
+	// The nick names a file, it must NOT lead out of db/.
+	if !isValidNick(args[1]) {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("User %s does NOT exists.", args[1]))
+		return
+	}
+
+	now := time.Now()
+	if reason := checkIPLockout(getPeer(c), now); reason != "" {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins from your address: %s.", reason))
+		return
+	}
+
 	c.nick = args[1]
 	if _, err := os.Stat(db_path + c.nick + ".json"); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("User %s does NOT exists.", c.nick))
+		recordIPFailure(c, getPeer(c), now)
 		return
 	}
 
-	h := sha1.New()
-	h.Write([]byte(args[2]))
-	c.pswd = hex.EncodeToString(h.Sum(nil))
+	c.pswd = hashPassword(args[2])
 
 	pathToFile := db_path + c.nick + ".json"
 	content, _ := os.ReadFile(pathToFile)
 	db := string(content)
 	c.isBeingAudited = gjson.Get(db, iba).Bool()
 
-	isActive := gjson.Get(db, "isActive")
-	if isActive.Bool() {
-		c.msg("This user is already logged in.")
-
-		c.loginAttempts++
-		writeAudit(c, db, fmt.Sprintf("Failed relogin from '%s'. Attempt #%d", getIP(c), c.loginAttempts), -1, "")
-
+	if reason := checkLockout(db, now); reason != "" {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many failed logins of this user: %s.", reason))
+		writeAudit(c, db, fmt.Sprintf("Refused login from '%s': %s", getPeer(c), reason), -1, "")
 		return
 	}
 
 	pswd := gjson.Get(db, "pswd")
 	if pswd.String() != c.pswd {
+		c.status(statusUnauthorized)
 		c.msg("Wrong password.")
 
 		c.loginAttempts++
-		writeAudit(c, db, fmt.Sprintf("Failed login from '%s'. Attempt #%d", getIP(c), c.loginAttempts), -1, "")
+		writeAudit(c, db, fmt.Sprintf("Failed login from '%s'. Attempt #%d", getPeer(c), c.loginAttempts), -1, "")
+
+		recordLoginFailure(c, db, pathToFile, now)
 
 		return
 	} else {
-		c.isLoggedIn = true
-		c.isAdmin = gjson.Get(db, "isAdmin").Bool()
-		c.isAudit = gjson.Get(db, "isAudit").Bool()
+		s.secondFactor(c, args, db, pathToFile)
+	}
+}
 
-		mark, mErr := getMark(args, db)
-		if mErr != nil {
-			c.err(mErr)
-			return
-		}
-		c.cm = mark
+func (s *server) completeLogin(c *client, args []string, db string, pathToFile string) {
+	if gjson.Get(db, "isAdmin").Bool() && !c.listener.admin {
+		c.status(statusForbidden)
+		c.msg("Admins can NOT log in on this connection.")
 
-		db, _ = sjson.Set(db, "isActive", true)
+		c.loginAttempts++
+		writeAudit(c, db, fmt.Sprintf("Refused admin login from '%s' on '%s'. Attempt #%d", getPeer(c), c.listener.name, c.loginAttempts), -1, "")
 
-		err := os.WriteFile(pathToFile, []byte(db), 0755)
-		if err != nil {
-			log.Printf("Could NOU open file '%s'", db_path+c.nick+".json")
-		}
+		return
+	}
+
+	if !s.admitLogin(c) {
+		c.status(statusConflict)
+		c.msg("This user is already logged in.")
 
-		c.actDir = users_path + c.nick + "/home"
-		c.homeDir = "/home"
-		c.currDir = c.homeDir
+		c.loginAttempts++
+		writeAudit(c, db, fmt.Sprintf("Failed relogin from '%s'. Attempt #%d", getPeer(c), c.loginAttempts), -1, "")
 
-		appendGroups(c)
+		return
+	}
 
-		c.msg("You have successfully logged in.")
-		log.Printf("A user '%s' has connected.", c.nick)
+	c.isLoggedIn = true
+	c.hasLoggedIn.Store(true)
+	c.loginTime = time.Now()
+	c.isAdmin = gjson.Get(db, "isAdmin").Bool()
+	c.isAudit = gjson.Get(db, "isAudit").Bool()
 
-		c.loginAttempts++
-		writeAudit(c, db, fmt.Sprintf("Success login from '%s'. Attempt #%d", getIP(c), c.loginAttempts), -1, "")
+	mark, mErr := getMark(args, db)
+	if mErr != nil {
+		c.err(mErr)
+		return
+	}
+	c.cm = mark
 
-		c.loginAttempts = 0 // success login
+	db = clearLockout(db)
+	db, _ = sjson.Set(db, "isActive", true)
+
+	err := os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+	if err != nil {
+		log.Printf("Could NOU open file '%s'", db_path+c.nick+".json")
+	}
+
+	c.actDir = users_path + c.nick + "/home"
+	c.homeDir = "/home"
+	c.currDir = c.homeDir
+
+	appendGroups(c)
+
+	if isRecorded(db) {
+		startRecording(c, db)
+	}
+
+	c.msg("You have successfully logged in.")
+	log.Printf("A user '%s' has connected.", c.nick)
+
+	c.loginAttempts++
+	writeAudit(c, db, fmt.Sprintf("Success login from '%s' (session %s on '%s'). Attempt #%d", getPeer(c), c.sessionID, c.listener.name, c.loginAttempts), -1, "")
+
+	c.loginAttempts = 0 // success login
+
+	if isPasswordExpired(db) {
+		c.restrict(`Your password has expired. Use "passwd [old] [new]" to change it.`, CmdPasswd)
+		c.status(statusForbidden)
+		c.msg(c.restriction)
 	}
 }
 
@@ -358,53 +575,83 @@ func writeAudit(c *client, db string, msg string, rw int64, define string) {
 		}
 
 		auditFile := audits_path + gjson.Get(db, "name").String()
-		f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
+		f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
 
 		trimFile(db, auditFile)
 
 		_, _ = f.WriteString(fmt.Sprintf("%s: %s: %s.\n", time.Now(), c.nick, msg))
 		_ = f.Close()
 
-	case "f": // file
-		content, _ := os.ReadFile(db_files)
-		db = string(content)
-
-		files := gjson.Parse(db)
-
-		for _, v := range files.Map() {
-			if gjson.Get(v.Raw, iba).Bool() == true {
-				auditFile := audits_path + "files"
-				f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
-
-				/*arw := gjson.Get(db, arw).Int()
-				if (arw != -1) && (rw != -1) && (arw&rw != rw) {
-					c.msg("Here2")
-					return
-				}*/
-
-				trimFile(db, auditFile)
-
-				_, _ = f.WriteString(fmt.Sprintf("%s: %s: %s.\n", time.Now(), c.nick, msg))
-				_ = f.Close()
-			}
-		}
+		emitAudit(newAuditEvent(c, "g", gjson.Get(db, "name").String(), msg, rw))
 
 	default: // user
 		if c.isBeingAudited {
-			auditFile := audits_path + c.nick
-			f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
-
-			arw := gjson.Get(db, arw).Int()
-			if (arw != -1) && (rw != -1) && (arw&rw != rw) {
+			if !isAuditedRW(db, rw) {
 				return
 			}
 
+			auditFile := audits_path + c.nick
 			trimFile(db, auditFile)
 
+			f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
+
 			_, _ = f.WriteString(fmt.Sprintf("%s: %s: %s.\n", time.Now(), c.nick, msg))
 			_ = f.Close()
+
+			emitAudit(newAuditEvent(c, "u", c.nick, msg, rw))
+		}
+	}
+}
+
+// Every watched file has its own audit stream under file_audits/.
+func writeFileAudit(c *client, fdb string, pathToFile string, msg string, rw int64) {
+	if pathToFile == "" {
+		return
+	}
+
+	db := gjson.Get(fdb, dbKey(pathToFile)).Raw
+	if gjson.Get(db, iba).Bool() == false {
+		return
+	}
+
+	if !isAuditedRW(db, rw) {
+		return
+	}
+
+	auditFile := file_audits_path + pathToFile
+	if err := os.MkdirAll(filepath.Dir(auditFile), os.ModePerm); err != nil {
+		log.Printf("Could NOT create audit directory for '%s': %s", pathToFile, err.Error())
+		return
+	}
+
+	trimFile(db, auditFile)
+
+	f, _ := os.OpenFile(auditFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
+	_, _ = f.WriteString(fmt.Sprintf("%s: %s: %s.\n", time.Now(), c.nick, msg))
+	_ = f.Close()
+
+	emitAudit(newAuditEvent(c, "f", pathToFile, msg, rw))
+}
+
+// rw: 0b10 read, 0b01 write, -1 any. Without auditReadWriteRights only the
+// events of neither kind are audited, as before it existed.
+func isAuditedRW(db string, rw int64) bool {
+	r := gjson.Get(db, arw).Int()
+	return (r == -1) || (rw == -1) || (r&rw == rw)
+}
+
+// dbKey escapes a file name for a gjson or sjson path, whose metacharacters
+// may be part of it.
+func dbKey(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		switch r {
+		case '\\', '.', '*', '?', '|', '#', '@', ':':
+			b.WriteByte('\\')
 		}
+		b.WriteRune(r)
 	}
+	return b.String()
 }
 
 func trimFile(db string, auditFile string) {
@@ -426,12 +673,8 @@ func trimFile(db string, auditFile string) {
 	}
 }
 
-func getIP(c *client) string {
-	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
-		return addr.IP.String()
-	} else {
-		return "invalid_ip"
-	}
+func getPeer(c *client) string {
+	return c.peer
 }
 
 func getMark(args []string, db string) (uint64, error) {
@@ -446,7 +689,7 @@ func getMark(args []string, db string) (uint64, error) {
 		}
 
 		/* default */
-		return std_mark, nil
+		return conf().defaultMark, nil
 	}
 
 	var mark uint64 = gjson.Get(db, "cm").Uint()
@@ -467,35 +710,45 @@ func getMark(args []string, db string) (uint64, error) {
 
 func (s *server) pwd(c *client) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	c.msg(c.currDir)
+	c.setData(map[string]string{"dir": c.currDir})
 }
 
 func (s *server) write(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "write [filename] [text]"`)
 		return
 	}
 
+	s.writeText(c, args[1], strings.Join(args[2:], " "), false)
+}
+
+// writeText writes text to file for write and put. The record of the file
+// gets the group and the mark of the writer, unless keep, when an existing
+// file keeps its own: put replaces the content only.
+func (s *server) writeText(c *client, file string, text string, keep bool) {
 	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
 	udb := string(ucontent)
 
 	fcontent, _ := os.ReadFile(db_files)
 	fdb := string(fcontent)
 
-	pathToFile, err := getPathToFile(c, args[1])
+	pathToFile, err := getPathToFile(c, file)
 	if err != nil {
 		c.err(err)
-		writeAudit(c, udb, fmt.Sprintf("Tried to write out-of-tree file '%s'", args[1]), 0b01, "")
-		writeAudit(c, fdb, fmt.Sprintf("Tried to write out-of-tree file '%s'", args[1]), 0b01, "f")
+		writeAudit(c, udb, fmt.Sprintf("Tried to write out-of-tree file '%s'", file), 0b01, "")
 		return
 	}
 
@@ -511,21 +764,21 @@ func (s *server) write(c *client, args []string) {
 	}
 
 	if !isExists {
-		err := os.WriteFile(pathToFile, []byte(strings.Join(args[2:], " ")), 0755)
+		err := os.WriteFile(pathToFile, []byte(text), conf().fileMode)
 		writeAudit(c, udb, fmt.Sprintf("Wrote new file '%s'", pathToFile), 0b01, "")
-		writeAudit(c, fdb, fmt.Sprintf("Wrote new file '%s'", pathToFile), 0b01, "f")
+		writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("Wrote new file '%s'", pathToFile), 0b01)
 		if err != nil {
 			c.err(err)
 			writeAudit(c, udb, fmt.Sprintf("Couldn't write file '%s'", pathToFile), 0b01, "")
-			writeAudit(c, fdb, fmt.Sprintf("Couldn't write file '%s'", pathToFile), 0b01, "f")
+			writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("Couldn't write file '%s'", pathToFile), 0b01)
 			return
 		}
 	} else {
-		fileRights := gjson.Get(old_db, pathToFile+".rights").Int()
+		fileRights := gjson.Get(old_db, dbKey(pathToFile)+".rights").Int()
 		switch fileRights & 0b0101 {
 		case 0b0101:
 			isAllowedToWrite := false
-			fileGroup := gjson.Get(old_db, pathToFile+".group").String()
+			fileGroup := gjson.Get(old_db, dbKey(pathToFile)+".group").String()
 			for _, group := range c.groups {
 				if group == fileGroup {
 					isAllowedToWrite = true
@@ -533,83 +786,96 @@ func (s *server) write(c *client, args []string) {
 			}
 
 			if isAllowedToWrite == false {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("DS: You are NOT in the group '%s'", fileGroup))
 				writeAudit(c, udb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01)
 				return
 			}
 
-			markOfFile := gjson.Get(old_db, pathToFile+".cm").Uint()
+			markOfFile := gjson.Get(old_db, dbKey(pathToFile)+".cm").Uint()
 			contentOfGroup, _ := os.ReadFile(group_path + fileGroup + ".json")
 			db_group := string(contentOfGroup)
 			markOfGroup := gjson.Get(db_group, "cm").Uint()
 
 			if !(markOfGroup == markOfFile) {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("MS: '%s':'%d' must be == '%d' of the file.", fileGroup, markOfGroup, markOfFile))
 				writeAudit(c, udb, fmt.Sprintf("MS: '%s':'%d' must be == '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("MS: '%s':'%d' must be == '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: '%s':'%d' must be == '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01)
 				return
 			}
 
 			if !(c.cm == markOfFile) {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("MS: Your mark '%d' must equal to the file's mark '%d'", c.cm, markOfFile))
 				writeAudit(c, udb, fmt.Sprintf("MS: mark '%d' must equal to the file's mark '%d'", c.cm, markOfFile), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("MS: mark '%d' must equal to the file's mark '%d'", c.cm, markOfFile), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: mark '%d' must equal to the file's mark '%d'", c.cm, markOfFile), 0b01)
 				return
 			}
 
 			/* Success */
-			err := os.WriteFile(pathToFile, []byte(strings.Join(args[2:], " ")), 0755)
+			err := os.WriteFile(pathToFile, []byte(text), conf().fileMode)
 			if err != nil {
 				c.err(err)
 				writeAudit(c, udb, err.Error(), 0b01, "")
-				writeAudit(c, fdb, err.Error(), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, err.Error(), 0b01)
 				return
 			}
 
 		default:
+			c.status(statusForbidden)
 			c.msg("DS: NOT allowed to write to this file due to the rights.")
 			writeAudit(c, udb, "DS: NOT allowed to write to this file due to the rights.", 0b01, "")
-			writeAudit(c, fdb, "DS: NOT allowed to write to this file due to the rights.", 0b01, "f")
+			writeFileAudit(c, fdb, pathToFile, "DS: NOT allowed to write to this file due to the rights.", 0b01)
 			return
 		}
 	}
 
-	if strings.Contains(pathToFile, ".") {
-		pathToFile = strings.ReplaceAll(pathToFile, ".", "\\.")
-	}
+	key := dbKey(pathToFile)
 
-	new_db, _ := sjson.Set("", pathToFile+".owner", c.nick)
+	group, mark := "users", conf().defaultMark
 	if c.isAdmin {
-		new_db, _ = sjson.Set(new_db, pathToFile+".group", "admins")
-	} else {
-		new_db, _ = sjson.Set(new_db, pathToFile+".group", "users")
+		group = "admins"
 	}
+	if keep && isExists {
+		if g := gjson.Get(old_db, key+".group"); g.Exists() {
+			group = g.String()
+		}
+		if m := gjson.Get(old_db, key+".cm"); m.Exists() {
+			mark = m.Uint()
+		}
+	}
+
+	new_db, _ := sjson.Set("", key+".owner", c.nick)
+	new_db, _ = sjson.Set(new_db, key+".group", group)
 	if !isExists {
-		new_db, _ = sjson.Set(new_db, pathToFile+".rights", 0b1110) // rwr_
+		new_db, _ = sjson.Set(new_db, key+".rights", conf().newFileRights)
 	}
-	new_db, _ = sjson.Set(new_db, pathToFile+".cm", std_mark)
+	new_db, _ = sjson.Set(new_db, key+".cm", mark)
 
 	if old_db != "" { // files.json is NOT empty
 		result, _ := conflate.FromData([]byte(old_db), []byte(new_db))
 		merged, _ := result.MarshalJSON()
-		_ = os.WriteFile(db_files, []byte(merged), 0755)
+		_ = os.WriteFile(db_files, []byte(merged), conf().fileMode)
 	} else {
-		_ = os.WriteFile(db_files, []byte(new_db), 0755)
+		_ = os.WriteFile(db_files, []byte(new_db), conf().fileMode)
 	}
 
-	c.msg(fmt.Sprintf("You have successfully written text to '%s'", args[1]))
-	writeAudit(c, udb, fmt.Sprintf("successfully wrote text to '%s'", args[1]), 0b01, "")
-	writeAudit(c, fdb, fmt.Sprintf("successfully wrote text to '%s'", args[1]), 0b01, "f")
+	c.msg(fmt.Sprintf("You have successfully written text to '%s'", file))
+	writeAudit(c, udb, fmt.Sprintf("successfully wrote text to '%s'", file), 0b01, "")
+	writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("successfully wrote text to '%s'", file), 0b01)
 }
 
 func (s *server) read(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "read [filename]"`)
 		return
 	}
@@ -627,7 +893,6 @@ func (s *server) read(c *client, args []string) {
 	if fErr != nil {
 		c.err(fErr)
 		writeAudit(c, udb, fmt.Sprintf("Tried to read out-of-tree file '%s'", args[1]), 0b10, "")
-		writeAudit(c, fdb, fmt.Sprintf("Tried to read out-of-tree file '%s'", args[1]), 0b10, "f")
 		return
 	}
 
@@ -637,18 +902,19 @@ func (s *server) read(c *client, args []string) {
 	content, _ := os.ReadFile(db_files)
 	db := string(content)
 
-	if !gjson.Get(db, pathToFile).Exists() {
+	if !gjson.Get(db, dbKey(pathToFile)).Exists() {
+		c.status(statusNotFound)
 		c.msg("DB: There is no such file in the database.")
 		writeAudit(c, udb, fmt.Sprintf("Tried to read non-data-based file '%s'", pathToFile), 0b10, "")
-		writeAudit(c, fdb, fmt.Sprintf("Tried to read non-data-based file '%s'", pathToFile), 0b10, "f")
+		writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("Tried to read non-data-based file '%s'", pathToFile), 0b10)
 		return
 	}
 
-	fileRights := gjson.Get(db, pathToFile+".rights").Int()
+	fileRights := gjson.Get(db, dbKey(pathToFile)+".rights").Int()
 	switch fileRights & 0b1010 {
 	case 0b1010:
 		isAllowedToRead := false
-		fileGroup := gjson.Get(db, pathToFile+".group").String()
+		fileGroup := gjson.Get(db, dbKey(pathToFile)+".group").String()
 		for _, group := range c.groups {
 			if group == fileGroup {
 				isAllowedToRead = true
@@ -656,28 +922,31 @@ func (s *server) read(c *client, args []string) {
 		}
 
 		if isAllowedToRead == false {
+			c.status(statusForbidden)
 			c.msg(fmt.Sprintf("DS: You are NOT in the group '%s'", fileGroup))
 			writeAudit(c, udb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b10, "")
-			writeAudit(c, fdb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b10, "f")
+			writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b10)
 			return
 		}
 
-		markOfFile := gjson.Get(db, pathToFile+".cm").Uint()
+		markOfFile := gjson.Get(db, dbKey(pathToFile)+".cm").Uint()
 		contentOfGroup, _ := os.ReadFile(group_path + fileGroup + ".json")
 		db_group := string(contentOfGroup)
 		markOfGroup := gjson.Get(db_group, "cm").Uint()
 
 		if !(markOfGroup >= markOfFile) {
+			c.status(statusForbidden)
 			c.msg(fmt.Sprintf("MS: '%s':'%d' must be >= '%d' of the file.", fileGroup, markOfGroup, markOfFile))
 			writeAudit(c, udb, fmt.Sprintf("MS: '%s':'%d' must be >= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b10, "")
-			writeAudit(c, fdb, fmt.Sprintf("MS: '%s':'%d' must be >= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b10, "f")
+			writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: '%s':'%d' must be >= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b10)
 			return
 		}
 
 		if !(c.cm >= markOfFile) {
+			c.status(statusForbidden)
 			c.msg(fmt.Sprintf("MS: Your mark '%d' must be >= the mark '%d' of the file.", c.cm, markOfFile))
 			writeAudit(c, udb, fmt.Sprintf("MS: mark '%d' must be >= the mark '%d' of the file.", c.cm, markOfFile), 0b10, "")
-			writeAudit(c, fdb, fmt.Sprintf("MS: mark '%d' must be >= the mark '%d' of the file.", c.cm, markOfFile), 0b10, "f")
+			writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: mark '%d' must be >= the mark '%d' of the file.", c.cm, markOfFile), 0b10)
 			return
 		}
 
@@ -686,29 +955,39 @@ func (s *server) read(c *client, args []string) {
 		if err != nil { // Couldn't read from file
 			c.err(err)
 			writeAudit(c, udb, err.Error(), 0b10, "")
-			writeAudit(c, fdb, err.Error(), 0b10, "f")
+			writeFileAudit(c, fdb, pathToFile, err.Error(), 0b10)
 			return
 		}
 
-		c.msg(fmt.Sprintf("Text from file '%s':\n%s", args[1], text))
+		if args[0] == "get" { // see transfer.go
+			encoded := base64.StdEncoding.EncodeToString(text)
+			c.msg(fmt.Sprintf("Data of file '%s': %s", args[1], encoded))
+			c.setData(map[string]string{"file": args[1], "data": encoded})
+		} else {
+			c.msg(fmt.Sprintf("Text from file '%s':\n%s", args[1], text))
+			c.setData(map[string]string{"file": args[1], "text": string(text)})
+		}
 		writeAudit(c, udb, fmt.Sprintf("Successfully read '%s'", args[1]), 0b10, "")
-		writeAudit(c, fdb, fmt.Sprintf("Successfully read '%s'", args[1]), 0b10, "f")
+		writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("Successfully read '%s'", args[1]), 0b10)
 
 	default:
+		c.status(statusForbidden)
 		c.msg("DS: NOT allowed to read this file due to the rights.")
 		writeAudit(c, udb, "DS: NOT allowed to read this file due to the rights.", 0b10, "")
-		writeAudit(c, fdb, "DS: NOT allowed to read this file due to the rights.", 0b10, "f")
+		writeFileAudit(c, fdb, pathToFile, "DS: NOT allowed to read this file due to the rights.", 0b10)
 		return
 	}
 }
 
 func (s *server) ls(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "ls [dir]". Use "ls ." for the current directory.`)
 		return
 	}
@@ -726,15 +1005,21 @@ func (s *server) ls(c *client, args []string) {
 	}
 
 	var listOfFiles string
+	entries := []fileEntry{}
 	for _, file := range files {
 		listOfFiles += file.Name()
 		listOfFiles += " "
+		entries = append(entries, fileEntry{Name: file.Name(), IsDir: file.IsDir()})
 	}
 
 	c.msg(fmt.Sprintf("Files from directory '%s':\n%s", args[1], listOfFiles))
+	c.setData(map[string]interface{}{"dir": args[1], "entries": entries})
 }
 
 func (s *server) logout(c *client) {
+	c.challenge = nil
+	c.pending2FA = nil
+
 	if !c.isLoggedIn {
 		c.msg("Checking if you're logged in. Proceeding nothing.")
 		return
@@ -743,15 +1028,19 @@ func (s *server) logout(c *client) {
 	pathToFile := db_path + c.nick + ".json"
 	content, _ := os.ReadFile(pathToFile)
 	db := string(content)
-	db, _ = sjson.Set(db, "isActive", false)
-	err := os.WriteFile(pathToFile, []byte(db), 0755)
-	if err != nil {
-		log.Printf(err.Error())
+	if len(s.liveSessions(c.nick, c)) == 0 {
+		db, _ = sjson.Set(db, "isActive", false)
+		err := os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+		if err != nil {
+			log.Printf(err.Error())
+		}
 	}
 
-	writeAudit(c, db, fmt.Sprintf("Success logout from '%s'", getIP(c)), -1, "")
+	s.closeTunnels(c, "the session has ended")
+	writeAudit(c, db, fmt.Sprintf("Success logout from '%s'", getPeer(c)), -1, "")
+	stopRecording(c)
 
-	if c.isConnErr {
+	if c.isConnErr.Load() {
 		log.Printf("A user '%s' has UNEXPECTEDLY disconnected.", c.nick)
 	} else {
 		log.Printf("A user '%s' has disconnected.", c.nick)
@@ -765,17 +1054,23 @@ func (s *server) logout(c *client) {
 	c.isLoggedIn = false
 	c.isAdmin = false
 	c.groups = c.groups[:0]
+	c.restrictions = nil
+	c.restriction = ""
+	c.resumeHash = ""
+	c.upload = nil
 
 	c.msg("You have successfully logged out.")
 }
 
 func (s *server) help(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "help [cmd]"`)
 		return
 	}
@@ -809,16 +1104,19 @@ func (s *server) help(c *client, args []string) {
 
 func (s *server) rmuser(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can remove users.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "rmuser [nick]"`)
 		return
 	}
@@ -826,18 +1124,20 @@ func (s *server) rmuser(c *client, args []string) {
 	nick := args[1]
 	pathToFile := db_path + nick + ".json"
 	if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("User '%s' does NOT exists.", nick))
 		return
 	}
 
-	content, _ := os.ReadFile(pathToFile)
-	db := string(content)
-	isActive := gjson.Get(db, "isActive").Bool()
-	if isActive {
-		c.msg("The user '%s' is logged in. Proceeding nothing.")
+	if len(s.liveSessions(nick, nil)) > 0 {
+		c.status(statusConflict)
+		c.msg(fmt.Sprintf("The user '%s' is logged in. Proceeding nothing.", nick))
 		return
 	}
 
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
 	err := os.Remove(pathToFile)
 	if err != nil {
 		log.Printf(err.Error())
@@ -853,11 +1153,11 @@ func (s *server) rmuser(c *client, args []string) {
 	for k, v := range files.Map() {
 		r := gjson.Get(v.Raw, "owner").String()
 		if r == nick {
-			db, _ = sjson.Delete(db, k)
+			db, _ = sjson.Delete(db, dbKey(k))
 		}
 	}
 
-	_ = os.WriteFile(db_files, []byte(db), 0755)
+	_ = os.WriteFile(db_files, []byte(db), conf().fileMode)
 
 	if _, err := os.Stat(users_path + nick); err == nil {
 		err := os.RemoveAll(users_path + nick)
@@ -873,32 +1173,40 @@ func (s *server) rmuser(c *client, args []string) {
 
 func (s *server) lsusers(c *client) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can list users.")
 		return
 	}
 
 	var total_info string
+	users := []json.RawMessage{}
 	matches, _ := filepath.Glob(filepath.Join(db_path, "*.json"))
 	for _, file := range matches {
 		content, _ := os.ReadFile(file)
 		db := string(content)
 		total_info += "\n"
 		total_info += db
+		if gjson.Valid(db) {
+			users = append(users, json.RawMessage(strings.TrimSpace(db)))
+		}
 	}
 
 	total_info = strings.ReplaceAll(total_info, "\n\n", "\n") // Might delete later?
 	c.msg(fmt.Sprintf("Users info: %s", total_info))
+	c.setData(users)
 }
 
 func (s *server) quit(c *client) {
-	leftClient := c.conn.RemoteAddr().String()
+	leftClient := c.peer
 
 	c.msg("You have successfully quited.")
+	c.endRequest()
 	err := c.conn.Close()
 	if err != nil {
 		log.Printf("The client could NOT left the chat: %s", leftClient)
@@ -912,16 +1220,19 @@ func (s *server) quit(c *client) {
 
 func (s *server) addgroup(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can create new groups.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "addgroup [group] "mark" {mark}"`)
 		return
 	}
@@ -929,6 +1240,7 @@ func (s *server) addgroup(c *client, args []string) {
 	group := args[1]
 	pathToFile := group_path + group + ".json"
 	if _, err := os.Stat(pathToFile); err == nil {
+		c.status(statusConflict)
 		c.msg(fmt.Sprintf("Group '%s' already exists.", group))
 		return
 	}
@@ -942,7 +1254,7 @@ func (s *server) addgroup(c *client, args []string) {
 	db, _ := sjson.Set("", "name", group)
 	db, _ = sjson.Set(db, "cm", mark)
 	_ = os.MkdirAll(group_path, os.ModePerm)
-	_ = os.WriteFile(pathToFile, []byte(db), 0755)
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 	c.msg(fmt.Sprintf("You have successfully created group '%s'", group))
 }
@@ -965,16 +1277,19 @@ func inGroup(db string, user string) (bool, int) {
 
 func (s *server) u2g(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can create new groups.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "u2g [group] [user]"`)
 		return
 	}
@@ -982,6 +1297,7 @@ func (s *server) u2g(c *client, args []string) {
 	group := args[1]
 	pathToFile := group_path + group + ".json"
 	if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("Group '%s' does NOT exists.", group))
 		return
 	}
@@ -989,6 +1305,7 @@ func (s *server) u2g(c *client, args []string) {
 	user := args[2]
 	pathToUser := db_path + user + ".json"
 	if _, err := os.Stat(pathToUser); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("User '%s' does NOT exists.", user))
 		return
 	}
@@ -998,13 +1315,14 @@ func (s *server) u2g(c *client, args []string) {
 
 	isInGroup, _ := inGroup(db, user)
 	if isInGroup {
+		c.status(statusConflict)
 		c.msg(fmt.Sprintf("User '%s' is already in '%s'. Proceeding nothing", user, group))
 		writeAudit(c, db, fmt.Sprintf("User '%s' is already in '%s'", user, group), -1, "g")
 		return
 	}
 
 	db, _ = sjson.Set(db, "users.-1", user)
-	_ = os.WriteFile(pathToFile, []byte(db), 0755)
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 	c.msg(fmt.Sprintf("You have successfully added '%s' to group '%s'", user, group))
 	writeAudit(c, db, fmt.Sprintf("Successfully added '%s' to group '%s'", user, group), -1, "g")
@@ -1013,16 +1331,19 @@ func (s *server) u2g(c *client, args []string) {
 
 func (s *server) trimgroup(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can create new groups.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "trimgroup [group] [user]"`)
 		return
 	}
@@ -1030,6 +1351,7 @@ func (s *server) trimgroup(c *client, args []string) {
 	group := args[1]
 	pathToFile := group_path + group + ".json"
 	if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("Group '%s' does NOT exists.", group))
 		return
 	}
@@ -1037,6 +1359,7 @@ func (s *server) trimgroup(c *client, args []string) {
 	user := args[2]
 	pathToUser := db_path + user + ".json"
 	if _, err := os.Stat(pathToUser); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("User '%s' does NOT exists.", user))
 		return
 	}
@@ -1046,6 +1369,7 @@ func (s *server) trimgroup(c *client, args []string) {
 
 	isInGroup, index := inGroup(db, user)
 	if !isInGroup {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("There's no '%s' in group '%s'. Proceeding nothing", user, group))
 		writeAudit(c, db, fmt.Sprintf("No '%s' in group '%s'", user, group), -1, "g")
 
@@ -1053,7 +1377,7 @@ func (s *server) trimgroup(c *client, args []string) {
 	}
 
 	db, _ = sjson.Delete(db, fmt.Sprintf("users.%d", index))
-	_ = os.WriteFile(pathToFile, []byte(db), 0755)
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 	c.msg(fmt.Sprintf("You have successfully removed '%s' from group '%s'", user, group))
 	writeAudit(c, db, fmt.Sprintf("Successfully removed '%s' from group '%s'", user, group), -1, "g")
@@ -1062,16 +1386,19 @@ func (s *server) trimgroup(c *client, args []string) {
 
 func (s *server) rmgroup(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAdmin {
+		c.status(statusForbidden)
 		c.msg("Only admin can remove users.")
 		return
 	}
 
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "rmgroup [group]"`)
 		return
 	}
@@ -1079,6 +1406,7 @@ func (s *server) rmgroup(c *client, args []string) {
 	group := args[1]
 	pathToFile := group_path + group + ".json"
 	if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("Group '%s' does NOT exists.", group))
 		return
 	}
@@ -1100,6 +1428,7 @@ func (s *server) rmgroup(c *client, args []string) {
 
 func (s *server) rr(c *client, args []string) {
 	if len(args) < 2 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "rr [file]"`)
 		return
 	}
@@ -1112,28 +1441,33 @@ func (s *server) rr(c *client, args []string) {
 
 	content, err := os.ReadFile(db_files)
 	if err != nil {
+		c.status(statusError)
 		c.msg("Couldn't load database of files.")
 		log.Printf(err.Error())
 		return
 	}
 	db := string(content)
-	info := gjson.Get(db, pathToFile).String()
+	info := gjson.Get(db, dbKey(pathToFile)).String()
 
 	if info == "" {
+		c.status(statusNotFound)
 		c.msg("No such file in the database")
 		return
 	}
 
 	c.msg(fmt.Sprintf("File info of '%s':\n%s", pathToFile, info))
+	c.setData(json.RawMessage(info))
 }
 
 func (s *server) chmod(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "chmod [file] [rwrw]" for user and group.`)
 		return
 	}
@@ -1147,7 +1481,8 @@ func (s *server) chmod(c *client, args []string) {
 
 	content, _ := os.ReadFile(db_files)
 	db := string(content)
-	if !gjson.Get(db, pathToFile).Exists() {
+	if !gjson.Get(db, dbKey(pathToFile)).Exists() {
+		c.status(statusNotFound)
 		c.msg("DB: There is no such file in the database.")
 		return
 	}
@@ -1155,29 +1490,33 @@ func (s *server) chmod(c *client, args []string) {
 	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
 	udb := string(ucontent)
 
-	owner := gjson.Get(db, pathToFile+".owner").String()
+	owner := gjson.Get(db, dbKey(pathToFile)+".owner").String()
 	if c.nick != owner {
+		c.status(statusForbidden)
 		c.msg("You are not the owner of this file.")
 		writeAudit(c, udb, "not the owner of this file.", -1, "")
 		return
 	}
 
 	irights, _ := strconv.ParseInt(rights, 2, 5)
-	db, _ = sjson.Set(db, pathToFile+".rights", irights)
+	db, _ = sjson.Set(db, dbKey(pathToFile)+".rights", irights)
 
-	_ = os.WriteFile(db_files, []byte(db), 0755)
+	_ = os.WriteFile(db_files, []byte(db), conf().fileMode)
 
 	c.msg(fmt.Sprintf("You have successfully changed rights for '%s'", pathToFile))
 	writeAudit(c, udb, fmt.Sprintf("successfully changed rights for '%s'", pathToFile), -1, "")
 }
 
+// errAboveRoot is of a path that leaves the root directory.
+var errAboveRoot = errors.New("cannot go higher than the root directory")
+
 func getPathToFile(c *client, arg string) (string, error) {
 	isFullPath := strings.HasPrefix(arg, users_path)
 	if isFullPath {
 		return arg, nil
 	} else {
 		if strings.HasPrefix(arg, "../../..") {
-			return "", errors.New("cannot go higher than the root directory")
+			return "", errAboveRoot
 		}
 		return filepath.Join(c.actDir, arg), nil
 	}
@@ -1186,11 +1525,13 @@ func getPathToFile(c *client, arg string) (string, error) {
 // lab3
 func (s *server) append(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "append [filename] [text]"`)
 		return
 	}
@@ -1205,7 +1546,6 @@ func (s *server) append(c *client, args []string) {
 	if err != nil {
 		c.err(err)
 		writeAudit(c, udb, err.Error(), 0b01, "")
-		writeAudit(c, udb, err.Error(), 0b01, "f")
 		return
 	}
 
@@ -1220,26 +1560,27 @@ func (s *server) append(c *client, args []string) {
 		isExists = true
 	}
 
-	f, err := os.OpenFile(pathToFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
+	f, err := os.OpenFile(pathToFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
 	if err != nil {
 		c.err(err)
 		writeAudit(c, udb, err.Error(), 0b01, "")
-		writeAudit(c, fdb, err.Error(), 0b01, "f")
+		writeFileAudit(c, fdb, pathToFile, err.Error(), 0b01)
 		return
 	}
 	defer f.Close()
 
 	if !isExists {
+		c.status(statusNotFound)
 		c.msg(fmt.Sprintf("File '%s' does NOT exists.", pathToFile))
 		writeAudit(c, udb, fmt.Sprintf("File '%s' does NOT exists.", pathToFile), 0b01, "")
-		writeAudit(c, fdb, fmt.Sprintf("File '%s' does NOT exists.", pathToFile), 0b01, "f")
+		writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("File '%s' does NOT exists.", pathToFile), 0b01)
 		return
 	} else {
-		fileRights := gjson.Get(old_db, pathToFile+".rights").Int()
+		fileRights := gjson.Get(old_db, dbKey(pathToFile)+".rights").Int()
 		switch fileRights & 0b0101 {
 		case 0b0101:
 			isAllowedToWrite := false
-			fileGroup := gjson.Get(old_db, pathToFile+".group").String()
+			fileGroup := gjson.Get(old_db, dbKey(pathToFile)+".group").String()
 			for _, group := range c.groups {
 				if group == fileGroup {
 					isAllowedToWrite = true
@@ -1247,28 +1588,31 @@ func (s *server) append(c *client, args []string) {
 			}
 
 			if isAllowedToWrite == false {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("DS: You are NOT in the group '%s'", fileGroup))
 				writeAudit(c, udb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("DS: not in the group '%s'", fileGroup), 0b01)
 				return
 			}
 
-			markOfFile := gjson.Get(old_db, pathToFile+".cm").Uint()
+			markOfFile := gjson.Get(old_db, dbKey(pathToFile)+".cm").Uint()
 			contentOfGroup, _ := os.ReadFile(group_path + fileGroup + ".json")
 			db_group := string(contentOfGroup)
 			markOfGroup := gjson.Get(db_group, "cm").Uint()
 
 			if !(markOfGroup <= markOfFile) {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("MS: '%s':'%d' must be <= '%d' of the file.", fileGroup, markOfGroup, markOfFile))
 				writeAudit(c, udb, fmt.Sprintf("MS: '%s':'%d' must be <= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("MS: '%s':'%d' must be <= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: '%s':'%d' must be <= '%d' of the file.", fileGroup, markOfGroup, markOfFile), 0b01)
 				return
 			}
 
 			if !(c.cm <= markOfFile) {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("MS: Your mark '%d' must be <= the mark '%d' of the file.", c.cm, markOfFile))
 				writeAudit(c, udb, fmt.Sprintf("MS: mark '%d' must be <= the mark '%d' of the file.", c.cm, markOfFile), 0b01, "")
-				writeAudit(c, fdb, fmt.Sprintf("MS: mark '%d' must be <= the mark '%d' of the file.", c.cm, markOfFile), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("MS: mark '%d' must be <= the mark '%d' of the file.", c.cm, markOfFile), 0b01)
 				return
 			}
 
@@ -1277,30 +1621,33 @@ func (s *server) append(c *client, args []string) {
 			if err != nil {
 				c.err(err)
 				writeAudit(c, udb, err.Error(), 0b01, "")
-				writeAudit(c, fdb, err.Error(), 0b01, "f")
+				writeFileAudit(c, fdb, pathToFile, err.Error(), 0b01)
 				return
 			}
 
 		default:
+			c.status(statusForbidden)
 			c.msg("DS: NOT allowed to read this file due to the rights.")
 			writeAudit(c, udb, "DS: NOT allowed to read this file due to the rights.", 0b01, "")
-			writeAudit(c, fdb, "DS: NOT allowed to read this file due to the rights.", 0b01, "f")
+			writeFileAudit(c, fdb, pathToFile, "DS: NOT allowed to read this file due to the rights.", 0b01)
 			return
 		}
 	}
 
 	c.msg(fmt.Sprintf("You have successfully appended text to '%s'", pathToFile))
 	writeAudit(c, udb, fmt.Sprintf("You have successfully appended text to '%s'", pathToFile), 0b01, "")
-	writeAudit(c, fdb, fmt.Sprintf("You have successfully appended text to '%s'", pathToFile), 0b01, "f")
+	writeFileAudit(c, fdb, pathToFile, fmt.Sprintf("You have successfully appended text to '%s'", pathToFile), 0b01)
 }
 
 func (s *server) chmark(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 4 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "chmark (f|u|g) [object] [mark]"`)
 		return
 	}
@@ -1316,6 +1663,7 @@ func (s *server) chmark(c *client, args []string) {
 	switch mod {
 	case "f":
 		if mark > c.cm {
+			c.status(statusForbidden)
 			c.msg(fmt.Sprintf("New mark '%d' can't be higher than your current mark: '%d'", mark, c.cm))
 			return
 		}
@@ -1330,20 +1678,22 @@ func (s *server) chmark(c *client, args []string) {
 		}
 
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("File '%s' does NOT exists.", pathToFile))
 			return
 		}
 
-		owner := gjson.Get(old_db, pathToFile+".owner").String()
+		owner := gjson.Get(old_db, dbKey(pathToFile)+".owner").String()
 		if c.nick != owner {
+			c.status(statusForbidden)
 			c.msg("You are not the owner of this file.")
 			return
 		}
 
-		new_db, _ := sjson.Set("", pathToFile+".cm", mark)
+		new_db, _ := sjson.Set("", dbKey(pathToFile)+".cm", mark)
 		result, _ := conflate.FromData([]byte(old_db), []byte(new_db))
 		merged, _ := result.MarshalJSON()
-		_ = os.WriteFile(db_files, []byte(merged), 0755)
+		_ = os.WriteFile(db_files, []byte(merged), conf().fileMode)
 
 	case "u":
 		if c.isAdmin {
@@ -1360,6 +1710,7 @@ func (s *server) chmark(c *client, args []string) {
 			} else {
 				pathToFile := db_path + object + ".json"
 				if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+					c.status(statusNotFound)
 					c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
 					return
 				}
@@ -1368,16 +1719,18 @@ func (s *server) chmark(c *client, args []string) {
 				db := string(content)
 
 				db, _ = sjson.Set(db, "cm", mark)
-				_ = os.WriteFile(pathToFile, []byte(db), 0755)
+				_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 			}
 		} else {
 			if c.nick != object {
+				c.status(statusForbidden)
 				c.msg(fmt.Sprintf("You are NOT '%s'", object))
 				return
 			}
 
 			pathToFile := db_path + c.nick + ".json"
 			if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+				c.status(statusNotFound)
 				c.msg(fmt.Sprintf("User '%s' does NOT exists.", c.nick))
 				return
 			}
@@ -1394,12 +1747,14 @@ func (s *server) chmark(c *client, args []string) {
 
 	case "g":
 		if !c.isAdmin {
+			c.status(statusForbidden)
 			c.msg("Only admin can change mark for groups.")
 			return
 		}
 
 		pathToFile := group_path + object + ".json"
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("Group '%s' does NOT exists.", object))
 			return
 		}
@@ -1408,9 +1763,10 @@ func (s *server) chmark(c *client, args []string) {
 		db := string(content)
 
 		db, _ = sjson.Set(db, "cm", mark)
-		_ = os.WriteFile(pathToFile, []byte(db), 0755)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 	default:
+		c.status(statusBadRequest)
 		c.msg("First option must be either of 'f', 'u', 'g'")
 		return
 	}
@@ -1420,11 +1776,13 @@ func (s *server) chmark(c *client, args []string) {
 
 func (s *server) gm(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "gm (f|u|g) {object}"`)
 		return
 	}
@@ -1444,6 +1802,7 @@ func (s *server) gm(c *client, args []string) {
 		}
 
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("File '%s' does NOT exists.", pathToFile))
 			return
 		}
@@ -1454,22 +1813,26 @@ func (s *server) gm(c *client, args []string) {
 			return
 		}*/
 
-		markOfFile := gjson.Get(db, pathToFile+".cm").Uint()
+		markOfFile := gjson.Get(db, dbKey(pathToFile)+".cm").Uint()
 		c.msg(fmt.Sprintf("Mark of file '%s' is '%d'", pathToFile, markOfFile))
+		c.setData(markInfo{Kind: mod, Object: pathToFile, Mark: markOfFile})
 
 	case "u":
 		if c.nick == object {
 			c.msg(fmt.Sprintf("Your current mark is '%d'", c.cm))
+			c.setData(markInfo{Kind: mod, Object: object, Mark: c.cm})
 			return
 		}
 
 		if !c.isAdmin {
+			c.status(statusForbidden)
 			c.msg("Only admin can see other's max mark")
 			return
 		}
 
 		pathToFile := db_path + object + ".json"
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
 			return
 		}
@@ -1479,10 +1842,12 @@ func (s *server) gm(c *client, args []string) {
 
 		markOfUser := gjson.Get(db, "cm").Uint()
 		c.msg(fmt.Sprintf("Max mark of user '%s' is '%d'", object, markOfUser))
+		c.setData(markInfo{Kind: mod, Object: object, Mark: markOfUser})
 
 	case "g":
 		pathToFile := group_path + object + ".json"
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("Group '%s' does NOT exists.", object))
 			return
 		}
@@ -1492,8 +1857,10 @@ func (s *server) gm(c *client, args []string) {
 
 		markOfGroup := gjson.Get(db, "cm").Uint()
 		c.msg(fmt.Sprintf("Mark of group '%s' is '%d'", object, markOfGroup))
+		c.setData(markInfo{Kind: mod, Object: object, Mark: markOfGroup})
 
 	default:
+		c.status(statusBadRequest)
 		c.msg("First option must be either of 'f', 'u', 'g'")
 		return
 	}
@@ -1502,16 +1869,19 @@ func (s *server) gm(c *client, args []string) {
 // lab4
 func (s *server) watch(c *client, args []string) {
 	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
 		c.msg("You must log in first.")
 		return
 	}
 
 	if !c.isAudit {
+		c.status(statusForbidden)
 		c.msg("Only audit can watch.")
 		return
 	}
 
 	if len(args) < 3 {
+		c.status(statusBadRequest)
 		c.msg(`Wrong usage. Example: "audit (f|u|g) {object} [amount] [rw]"`)
 		return
 	}
@@ -1523,6 +1893,7 @@ func (s *server) watch(c *client, args []string) {
 	if len(args) > 3 {
 		amount, err = strconv.ParseUint(args[3], 10, 32)
 		if err != nil {
+			c.status(statusBadRequest)
 			c.msg("(amount) must be >= 0")
 			return
 		}
@@ -1543,6 +1914,7 @@ func (s *server) watch(c *client, args []string) {
 	case "u":
 		pathToFile := db_path + object + ".json"
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
 			return
 		}
@@ -1554,13 +1926,14 @@ func (s *server) watch(c *client, args []string) {
 		db, _ = sjson.Set(db, iba, boolAudit)
 		db, _ = sjson.Set(db, aoa, amount)
 		db, _ = sjson.Set(db, arw, rw)
-		_ = os.WriteFile(pathToFile, []byte(db), 0755)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 		c.msg(fmt.Sprintf("Changed audit to '%t' for user '%s'", boolAudit, object))
 
 	case "g":
 		pathToFile := group_path + object + ".json"
 		if _, err := os.Stat(pathToFile); errors.Is(err, os.ErrNotExist) {
+			c.status(statusNotFound)
 			c.msg(fmt.Sprintf("Group '%s' does NOT exists.", object))
 			return
 		}
@@ -1571,7 +1944,7 @@ func (s *server) watch(c *client, args []string) {
 		boolAudit := !gjson.Get(db, iba).Bool()
 		db, _ = sjson.Set(db, iba, boolAudit)
 		db, _ = sjson.Set(db, aoa, amount)
-		_ = os.WriteFile(pathToFile, []byte(db), 0755)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
 
 		c.msg(fmt.Sprintf("Changed audit to '%t' for group '%s'", boolAudit, object))
 
@@ -1579,24 +1952,36 @@ func (s *server) watch(c *client, args []string) {
 		content, _ := os.ReadFile(db_files)
 		old_db := string(content)
 
-		file, _ := getPathToFile(c, object)
+		file, err := getPathToFile(c, object)
+		if err != nil {
+			c.err(err)
+			return
+		}
+
+		key := dbKey(file)
+		if !gjson.Get(old_db, key).Exists() {
+			c.status(statusNotFound)
+			c.msg("DB: There is no such file in the database.")
+			return
+		}
 
-		boolAudit := !gjson.Get(old_db, file+"."+iba).Bool()
-		new_db, _ := sjson.Set("", file+"."+iba, boolAudit)
-		new_db, _ = sjson.Set(new_db, file+"."+aoa, amount)
-		new_db, _ = sjson.Set(new_db, file+"."+arw, rw)
+		boolAudit := !gjson.Get(old_db, key+"."+iba).Bool()
+		new_db, _ := sjson.Set("", key+"."+iba, boolAudit)
+		new_db, _ = sjson.Set(new_db, key+"."+aoa, amount)
+		new_db, _ = sjson.Set(new_db, key+"."+arw, rw)
 
 		if old_db != "" { // files.json is NOT empty
 			result, _ := conflate.FromData([]byte(old_db), []byte(new_db))
 			merged, _ := result.MarshalJSON()
-			_ = os.WriteFile(db_files, []byte(merged), 0755)
+			_ = os.WriteFile(db_files, []byte(merged), conf().fileMode)
 		} else {
-			_ = os.WriteFile(db_files, []byte(new_db), 0755)
+			_ = os.WriteFile(db_files, []byte(new_db), conf().fileMode)
 		}
 
 		c.msg(fmt.Sprintf("Changed audit to '%t' for file '%s'", boolAudit, object))
 
 	default:
+		c.status(statusBadRequest)
 		c.msg("First option must be either of 'f', 'u', 'g'")
 		return
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIsAuditedRW(t *testing.T) {
+	tests := []struct {
+		name string
+		db   string
+		rw   int64
+		want bool
+	}{
+		{"missing, read", `{}`, 0b10, false},
+		{"missing, write", `{}`, 0b01, false},
+		{"missing, any", `{}`, -1, true},
+		{"all, read", `{"auditReadWriteRights": -1}`, 0b10, true},
+		{"read only, read", `{"auditReadWriteRights": 2}`, 0b10, true},
+		{"read only, write", `{"auditReadWriteRights": 2}`, 0b01, false},
+		{"write only, write", `{"auditReadWriteRights": 1}`, 0b01, true},
+		{"write only, read", `{"auditReadWriteRights": 1}`, 0b10, false},
+		{"both, read and write", `{"auditReadWriteRights": 3}`, 0b11, true},
+		{"none, read", `{"auditReadWriteRights": 0}`, 0b10, false},
+		{"none, any", `{"auditReadWriteRights": 0}`, -1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuditedRW(tt.db, tt.rw); got != tt.want {
+				t.Errorf("isAuditedRW(%s, %d) = %v, want %v", tt.db, tt.rw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"notes", "notes"},
+		{"users/dan/home/a.txt", `users/dan/home/a\.txt`},
+		{"a.b.c", `a\.b\.c`},
+		{"a*b", `a\*b`},
+		{"a?b", `a\?b`},
+		{"a|b", `a\|b`},
+		{`a\b#@:`, `a\\b\#\@\:`},
+	}
+
+	for _, tt := range tests {
+		if got := dbKey(tt.key); got != tt.want {
+			t.Errorf("dbKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+// inTempDir runs the test inside an empty directory, as the server runs
+// inside its data root.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	dir, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(dir) })
+}
+
+func TestWriteFileAudit(t *testing.T) {
+	inTempDir(t)
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { _ = conn.Close(); _ = peer.Close() })
+	c := &client{nick: "dan", conn: conn}
+	fdb := `{"users/dan/home/a.txt": {"isBeingAudited": true, "auditReadWriteRights": 1}}`
+
+	writeFileAudit(c, fdb, "users/dan/home/a.txt", "Read the file", 0b10)
+	writeFileAudit(c, fdb, "users/dan/home/a.txt", "Wrote the file", 0b01)
+	writeFileAudit(c, fdb, "users/dan/home/b.txt", "Wrote the file", 0b01)
+
+	content, err := os.ReadFile(file_audits_path + "users/dan/home/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(content); !strings.Contains(got, "dan: Wrote the file.") || strings.Contains(got, "Read") {
+		t.Errorf("stream of a.txt: %q", got)
+	}
+	if _, err := os.Stat(file_audits_path + "users/dan/home/b.txt"); err == nil {
+		t.Error("a file that is NOT watched has a stream")
+	}
+	if _, err := os.Stat(audits_path + "files"); err == nil {
+		t.Errorf("'%sfiles' has been created", audits_path)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The registry is owned by s.run, so it is only touched by commands.
+
+func (s *server) join(c *client) {
+	c.connTime = time.Now()
+	c.lastActive = c.connTime
+	s.sessions[c.sessionID] = c
+
+	if conf().banner != "" {
+		c.msg(conf().banner)
+	}
+}
+
+func (s *server) disconnect(c *client) {
+	if c.detached {
+		return // kept until it is resumed or expires
+	}
+
+	// A resumed session is under the same id, but of another client.
+	if s.sessions[c.sessionID] == c {
+		delete(s.sessions, c.sessionID)
+	}
+	log.Printf("Session %s from %s has been closed.", c.sessionID, c.peer)
+
+	s.checkClosed()
+}
+
+func (s *server) sortedSessions() []*client {
+	list := make([]*client, 0, len(s.sessions))
+	for _, c := range s.sessions {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].connTime.Before(list[j].connTime)
+	})
+
+	return list
+}
+
+func idleTime(c *client) time.Duration {
+	return time.Since(c.lastActive).Truncate(time.Second)
+}
+
+func (s *server) who(c *client) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	var sb strings.Builder
+	list := []sessionInfo{}
+	for _, sc := range s.sortedSessions() {
+		if !sc.isLoggedIn {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\n%s\t%s\t%s\tsince %s\tidle %s",
+			sc.nick, sc.sessionID, getPeer(sc), sc.loginTime.Format("2006-01-02 15:04:05"), idleTime(sc)))
+
+		// Where the others are is for the admins, see "sessions".
+		info := infoOf(sc)
+		info.Dir = ""
+		list = append(list, info)
+	}
+
+	c.msg(fmt.Sprintf("Logged in users:%s", sb.String()))
+	c.setData(list)
+}
+
+func (s *server) lssessions(c *client) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if !c.isAdmin {
+		c.status(statusForbidden)
+		c.msg("Only admin can list sessions.")
+		return
+	}
+
+	var sb strings.Builder
+	list := []sessionInfo{}
+	for _, sc := range s.sortedSessions() {
+		list = append(list, infoOf(sc))
+		if sc.isLoggedIn {
+			sb.WriteString(fmt.Sprintf("\n%s\t%s\t%s\t%s\tlogin %s\tidle %s\t%s",
+				sc.sessionID, sc.nick, getPeer(sc), sc.listener.name, sc.loginTime.Format("2006-01-02 15:04:05"), idleTime(sc), sc.currDir))
+			if sc.detached {
+				sb.WriteString("\tdetached")
+			}
+		} else {
+			sb.WriteString(fmt.Sprintf("\n%s\t-\t%s\t%s\tconnected %s\tidle %s\t-",
+				sc.sessionID, getPeer(sc), sc.listener.name, sc.connTime.Format("2006-01-02 15:04:05"), idleTime(sc)))
+		}
+	}
+
+	c.msg(fmt.Sprintf("Sessions (%d):%s", len(s.sessions), sb.String()))
+	c.setData(list)
+}
+
+func (s *server) kill(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if !c.isAdmin {
+		c.status(statusForbidden)
+		c.msg("Only admin can kill sessions.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "kill [session]"`)
+		return
+	}
+
+	target, ok := s.sessions[args[1]]
+	if !ok {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("Session '%s' does NOT exists.", args[1]))
+		return
+	}
+
+	if target == c {
+		c.status(statusForbidden)
+		c.msg(`You cannot kill your own session. Use "quit" instead.`)
+		return
+	}
+
+	nick := target.nick
+	s.terminate(target, "killed", fmt.Sprintf("killed by '%s'", c.nick))
+
+	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
+	writeAudit(c, string(ucontent), fmt.Sprintf("Killed session %s of '%s'", args[1], nick), -1, "")
+
+	c.msg(fmt.Sprintf("You have successfully killed session '%s' of '%s'.", args[1], nick))
+}
+
+// terminate logs the target out through the usual logout path and closes
+// its connection. kind is the reason for the client, see disconnect.
+func (s *server) terminate(target *client, kind string, reason string) {
+	if target.isLoggedIn {
+		content, _ := os.ReadFile(db_path + target.nick + ".json")
+		writeAudit(target, string(content), fmt.Sprintf("Session %s %s", target.sessionID, reason), -1, "")
+	}
+
+	target.disconnect(kind, fmt.Sprintf("Your session has been %s.", reason))
+	s.logout(target)
+	if target.detached {
+		s.release(target)
+		return
+	}
+	s.quit(target)
+}
+
+// liveSessions returns the logged in sessions of nick except the given one,
+// the oldest first.
+func (s *server) liveSessions(nick string, except *client) []*client {
+	var list []*client
+	for _, sc := range s.sortedSessions() {
+		if sc != except && sc.isLoggedIn && sc.nick == nick {
+			list = append(list, sc)
+		}
+	}
+
+	return list
+}
+
+// admitLogin applies the concurrent logins policy to c, which has just
+// passed the password check.
+func (s *server) admitLogin(c *client) bool {
+	live := s.liveSessions(c.nick, c)
+
+	limit := conf().maxLogins
+	if conf().loginPolicy == "deny" {
+		limit = 1
+	}
+
+	// Detached sessions give way before the policy applies.
+	for i := 0; i < len(live) && len(live) >= limit; {
+		if !live[i].detached {
+			i++
+			continue
+		}
+		s.terminate(live[i], "replaced", fmt.Sprintf("replaced by a new login from '%s'", getPeer(c)))
+		live = append(live[:i], live[i+1:]...)
+	}
+
+	if len(live) < limit {
+		return true
+	}
+
+	if conf().loginPolicy != "kick" {
+		return false
+	}
+
+	for _, old := range live[:len(live)-limit+1] {
+		s.terminate(old, "replaced", fmt.Sprintf("replaced by a new login from '%s'", getPeer(c)))
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestWhoAndSessions(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1:1000", "root", rootPswd)
+	anon, _ := h.connect("10.0.0.2:1000")
+
+	tests := []struct {
+		name string
+		c    *client
+		line string
+		want []string
+	}{
+		{"who needs a login", anon, "who", []string{"You must log in first."}},
+		{"who lists logged in users", root, "who", []string{"Logged in users:", "root\t" + root.sessionID}},
+		{"sessions needs a login", anon, "sessions", []string{"You must log in first."}},
+		{"sessions lists every connection", root, "sessions", []string{"Sessions (2):", root.sessionID, anon.sessionID}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := h.do(tt.c, tt.line)
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("%q: got %q, want it to contain %q", tt.line, out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWhoHidesDirs(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1:1000", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	h.serve()
+
+	w := h.dial("10.0.0.2:1000")
+	w.send("proto json")
+	w.send("1 login dan Pw4Tests_x9")
+
+	out := w.send("2 who")
+	if nicks := gjson.Get(out, "data.#.nick").String(); nicks != `["root","dan"]` {
+		t.Errorf("nicks %s in %q", nicks, out)
+	}
+	if dirs := gjson.Get(out, "data.#.dir").String(); dirs != "[]" {
+		t.Errorf("'who' shows the directories %s", dirs)
+	}
+}
+
+func TestKill(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1:1000", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	other := h.login("10.0.0.1:1001", "dan", "Pw4Tests_x9")
+	otherConn := other.conn.(*testConn)
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"no session", "kill", "Wrong usage."},
+		{"unknown session", "kill 0000", "Session '0000' does NOT exists."},
+		{"own session", "kill " + root.sessionID, "You cannot kill your own session."},
+		{"other session", "kill " + other.sessionID, "You have successfully killed session"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(root, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	if !otherConn.isClosed() {
+		t.Error("the killed session is still connected")
+	}
+	if !strings.Contains(otherConn.output(), "Your session has been killed by 'root'.") {
+		t.Errorf("the killed session got %q", otherConn.output())
+	}
+}
+
+func TestLoginPolicy(t *testing.T) {
+	tests := []struct {
+		policy     string
+		maxLogins  string
+		detachOld  bool
+		wantLogin  bool
+		wantOldOut bool
+	}{
+		{policy: "deny", maxLogins: "3", wantLogin: false},
+		{policy: "deny", maxLogins: "1", detachOld: true, wantLogin: true, wantOldOut: true},
+		{policy: "allow", maxLogins: "1", wantLogin: false},
+		{policy: "allow", maxLogins: "2", wantLogin: true},
+		{policy: "kick", maxLogins: "1", wantLogin: true, wantOldOut: true},
+		{policy: "kick", maxLogins: "2", wantLogin: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.maxLogins, func(t *testing.T) {
+			h := newHarness(t)
+			setFlag(t, "login-policy", tt.policy)
+			setFlag(t, "max-logins", tt.maxLogins)
+
+			old := h.login("10.0.0.1:1000", "root", rootPswd)
+			if tt.detachOld {
+				old.detached = true
+			}
+
+			c, _ := h.connect("10.0.0.1:1001")
+			out := h.do(c, "login root "+rootPswd)
+			if got := strings.Contains(out, "You have successfully logged in."); got != tt.wantLogin {
+				t.Errorf("second login: %q", out)
+			}
+			if !tt.wantLogin && !strings.Contains(out, "This user is already logged in.") {
+				t.Errorf("second login: %q", out)
+			}
+			if old.isLoggedIn == tt.wantOldOut {
+				t.Errorf("old session logged in = %v, want %v", old.isLoggedIn, !tt.wantOldOut)
+			}
+			// A detached session has no connection, it leaves the registry.
+			_, registered := h.s.sessions[old.sessionID]
+			if gone := !registered || old.conn.(*testConn).isClosed(); gone != tt.wantOldOut {
+				t.Errorf("old session gone = %v, want %v", gone, tt.wantOldOut)
+			}
+		})
+	}
+}
+
+func TestLogoutKeepsActiveWhileLoggedInElsewhere(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-policy", "allow")
+	setFlag(t, "max-logins", "2")
+
+	first := h.login("10.0.0.1:1000", "root", rootPswd)
+	second := h.login("10.0.0.1:1001", "root", rootPswd)
+
+	isActive := func() bool {
+		content, _ := os.ReadFile(db_path + "root.json")
+		return gjson.GetBytes(content, "isActive").Bool()
+	}
+
+	h.do(first, "logout")
+	if !isActive() {
+		t.Error("isActive is false while 'root' is still logged in")
+	}
+	h.do(second, "logout")
+	if isActive() {
+		t.Error("isActive is true after the last logout")
+	}
+}
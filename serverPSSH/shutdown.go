@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// closeSessions is run on shutdown: it logs every session out and closes
+// it. Afterwards only logouts and disconnects are served.
+func (s *server) closeSessions() {
+	s.isClosing = true
+
+	for _, c := range s.sortedSessions() {
+		s.terminate(c, "shutdown", "closed because the server is shutting down")
+	}
+
+	s.checkClosed()
+}
+
+func (s *server) checkClosed() {
+	if s.isClosing && len(s.sessions) == 0 && s.closed != nil {
+		close(s.closed)
+		s.closed = nil
+	}
+}
+
+// shutdown waits for closeSessions and the audit sinks, but NOT longer
+// than the timeout.
+func (s *server) shutdown(timeout time.Duration) {
+	end := time.Now().Add(timeout)
+	closed := s.closed
+
+	s.commands <- command{id: CmdShutdown}
+
+	select {
+	case <-closed:
+		log.Printf("All sessions have been closed.")
+	case <-time.After(time.Until(end)):
+		log.Printf("Sessions have NOT been closed in %s.", timeout)
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		stopAuditSinks()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		log.Printf("Audit sinks have been flushed.")
+	case <-time.After(time.Until(end)):
+		log.Printf("Audit sinks have NOT been flushed in %s.", timeout)
+	}
+}
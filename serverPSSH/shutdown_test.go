@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestCloseSessions(t *testing.T) {
+	h := newHarness(t)
+
+	root := h.login("10.0.0.1", "root", rootPswd)
+	rootConn := root.conn.(*testConn)
+	anon, anonConn := h.connect("10.0.0.2")
+	closed := h.s.closed
+
+	h.s.closeSessions()
+
+	for _, conn := range []*testConn{rootConn, anonConn} {
+		if !conn.isClosed() {
+			t.Error("a session is still connected")
+		}
+		if !strings.Contains(conn.output(), "Your session has been closed because the server is shutting down.") {
+			t.Errorf("a session got %q", conn.output())
+		}
+	}
+
+	content, _ := os.ReadFile(db_path + "root.json")
+	if gjson.GetBytes(content, "isActive").Bool() {
+		t.Error("isActive is true after the shutdown")
+	}
+
+	// The readers of both connections see them closed.
+	h.s.disconnect(root)
+	select {
+	case <-closed:
+		t.Fatal("closed before every session is gone")
+	default:
+	}
+	h.s.disconnect(anon)
+	select {
+	case <-closed:
+	default:
+		t.Fatal("NOT closed after every session is gone")
+	}
+}
+
+func TestRefuseCommandsWhileClosing(t *testing.T) {
+	h := newHarness(t)
+	c, conn := h.connect("10.0.0.1")
+	h.s.isClosing = true
+
+	if out := h.do(c, "login root "+rootPswd); !strings.Contains(out, "The server is shutting down.") {
+		t.Errorf("got %q", out)
+	}
+	if !conn.isClosed() {
+		t.Error("the session is still connected")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	h := newHarness(t)
+	h.connect("10.0.0.1") // nobody reads it, so it is never disconnected
+	go h.s.run()
+	t.Cleanup(func() { close(h.s.commands) })
+
+	start := time.Now()
+	h.s.shutdown(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+}
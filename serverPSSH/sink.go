@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const db_sinks = audits_path + "sinks.json"
+const spool_path = audits_path + "spool/"
+
+const sinkQueueSize = 1024
+const sinkRetryInterval = 10 * time.Second
+const sinkDialTimeout = 5 * time.Second
+
+// Syslog facility 13 is "log audit" (RFC 5424, section 6.2.1).
+const syslogFacility = 13
+const syslogSeverity = 5 // notice
+const syslogSDID = "pssh@32473"
+
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"` // u, g or f
+	Object string    `json:"object"`
+	Nick   string    `json:"nick"`
+	Peer   string    `json:"peer"`
+	RW     int64     `json:"rw"`
+	Msg    string    `json:"msg"`
+}
+
+type sinkFilter struct {
+	kinds []string
+	nicks []string
+	rw    int64
+}
+
+type auditSink struct {
+	name    string
+	format  string // syslog or json
+	network string
+	addr    string
+	filter  sinkFilter
+
+	// spoolMu guards the spool file only, it is never held over the network.
+	spoolMu    sync.Mutex
+	spoolFile  string
+	spoolLimit int64
+	spooled    int64 // lines in the spool, -1 until counted, under spoolMu
+	trimmed    int64 // lines dropped over spoolLimit, under spoolMu
+
+	conn   net.Conn // of the deliver goroutine only, as is down
+	down   bool
+	events chan auditEvent
+	wake   chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+var sinksMu sync.RWMutex
+var auditSinks []*auditSink
+
+func newAuditEvent(c *client, kind string, object string, msg string, rw int64) auditEvent {
+	return auditEvent{
+		Time:   time.Now(),
+		Kind:   kind,
+		Object: object,
+		Nick:   c.nick,
+		Peer:   getPeer(c),
+		RW:     rw,
+		Msg:    msg,
+	}
+}
+
+// loadAuditSinks reads sink definitions from audits/sinks.json, e.g.
+//
+//	{"siem": {"format": "syslog", "network": "udp", "addr": "127.0.0.1:514",
+//	          "filter": {"kinds": ["u", "f"], "rw": 2}, "spoolLimit": 10000}}
+//
+// It also returns the definitions as read, to tell whether they changed.
+func loadAuditSinks(path string) ([]*auditSink, string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sinks, err := parseAuditSinks(string(content), path)
+	return sinks, string(content), err
+}
+
+func parseAuditSinks(db string, source string) ([]*auditSink, error) {
+	if !gjson.Valid(db) {
+		return nil, fmt.Errorf("'%s' is NOT a valid JSON", source)
+	}
+
+	var sinks []*auditSink
+	var sErr error
+	gjson.Parse(db).ForEach(func(key, value gjson.Result) bool {
+		var sink *auditSink
+		sink, sErr = parseAuditSink(key.String(), value)
+		if sErr != nil {
+			return false
+		}
+		sinks = append(sinks, sink)
+		return true
+	})
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	return sinks, nil
+}
+
+func parseAuditSink(name string, v gjson.Result) (*auditSink, error) {
+	sink := &auditSink{
+		name:       name,
+		format:     v.Get("format").String(),
+		network:    v.Get("network").String(),
+		addr:       v.Get("addr").String(),
+		spoolFile:  spool_path + name,
+		spoolLimit: v.Get("spoolLimit").Int(),
+		spooled:    -1,
+		filter:     sinkFilter{rw: -1},
+	}
+
+	switch sink.format {
+	case "syslog":
+		switch sink.network {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			return nil, fmt.Errorf("sink '%s': network must be either of 'udp', 'tcp', 'unix', 'unixgram'", name)
+		}
+
+	case "json":
+		switch sink.network {
+		case "unix", "tcp":
+		default:
+			return nil, fmt.Errorf("sink '%s': network must be either of 'unix', 'tcp'", name)
+		}
+
+	default:
+		return nil, fmt.Errorf("sink '%s': format must be either of 'syslog', 'json'", name)
+	}
+
+	if sink.addr == "" {
+		return nil, fmt.Errorf("sink '%s': addr is required", name)
+	}
+
+	for _, kind := range v.Get("filter.kinds").Array() {
+		switch kind.String() {
+		case "u", "g", "f":
+			sink.filter.kinds = append(sink.filter.kinds, kind.String())
+		default:
+			return nil, fmt.Errorf("sink '%s': filter kinds must be either of 'u', 'g', 'f'", name)
+		}
+	}
+	for _, nick := range v.Get("filter.nicks").Array() {
+		sink.filter.nicks = append(sink.filter.nicks, nick.String())
+	}
+	if rw := v.Get("filter.rw"); rw.Exists() {
+		sink.filter.rw = rw.Int()
+	}
+
+	return sink, nil
+}
+
+func startAuditSinks(sinks []*auditSink) {
+	_ = os.MkdirAll(spool_path, os.ModePerm)
+
+	for _, sink := range sinks {
+		sink.events = make(chan auditEvent, sinkQueueSize)
+		sink.wake = make(chan struct{}, 1)
+		sink.quit = make(chan struct{})
+		sink.done = make(chan struct{})
+		go sink.run()
+		go sink.deliver()
+		log.Printf("Audit sink '%s' (%s over %s to %s) has been started.", sink.name, sink.format, sink.network, sink.addr)
+	}
+
+	sinksMu.Lock()
+	auditSinks = sinks
+	sinksMu.Unlock()
+}
+
+// stopAuditSinks detaches the current sinks and waits until their queues
+// are spooled. Whatever is left undelivered is sent by the next sinks of
+// the same name.
+func stopAuditSinks() {
+	sinksMu.Lock()
+	sinks := auditSinks
+	auditSinks = nil
+	sinksMu.Unlock()
+
+	for _, sink := range sinks {
+		close(sink.events)
+		<-sink.done
+	}
+}
+
+// emitAudit queues e for the sinks that want it. It never waits on the
+// network: run only writes to the spool, so the queue drains even while a
+// sink is unreachable, and an event that finds the queue full all the same is
+// written to the spool here.
+func emitAudit(e auditEvent) {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+
+	for _, sink := range auditSinks {
+		if !sink.filter.match(e) {
+			continue
+		}
+
+		select {
+		case sink.events <- e:
+		default:
+			sink.spool(e)
+			select {
+			case sink.wake <- struct{}{}:
+			default: // deliver is already awake
+			}
+		}
+	}
+}
+
+func (f sinkFilter) match(e auditEvent) bool {
+	if len(f.kinds) > 0 && !contains(f.kinds, e.Kind) {
+		return false
+	}
+
+	if len(f.nicks) > 0 && !contains(f.nicks, e.Nick) {
+		return false
+	}
+
+	return (f.rw == -1) || (e.RW == -1) || (f.rw&e.RW == e.RW)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run spools the queued events and wakes deliver up.
+func (sink *auditSink) run() {
+	for e := range sink.events {
+		sink.spool(e)
+
+		select {
+		case sink.wake <- struct{}{}:
+		default: // deliver is already awake
+		}
+	}
+
+	close(sink.quit)
+}
+
+// deliver sends the spool to the sink, on every event, periodically while
+// the sink is unavailable and once more when it stops.
+func (sink *auditSink) deliver() {
+	defer close(sink.done)
+	defer sink.disconnect()
+
+	ticker := time.NewTicker(sinkRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sink.quit:
+			sink.flushSpool()
+			return
+		case <-sink.wake:
+		case <-ticker.C:
+		}
+
+		sink.flushSpool()
+	}
+}
+
+// flushSpool sends spooled events in order and removes the delivered ones.
+// It reports whether all of them have been delivered.
+func (sink *auditSink) flushSpool() bool {
+	sink.spoolMu.Lock()
+	content, err := os.ReadFile(sink.spoolFile)
+	trimmed := sink.trimmed
+	sink.spoolMu.Unlock()
+
+	if errors.Is(err, os.ErrNotExist) || len(content) == 0 {
+		return true
+	}
+	if err != nil {
+		log.Printf("Could NOT read spool of sink '%s': %s", sink.name, err.Error())
+		return false
+	}
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	var sent int64 = 0
+	var sErr error
+	for _, line := range lines {
+		var e auditEvent
+		if err := json.Unmarshal([]byte(line), &e); err == nil { // else a torn line, nothing to recover
+			if sErr = sink.send(e); sErr != nil {
+				break
+			}
+		}
+		sent++
+	}
+
+	sink.spoolMu.Lock()
+	// Lines trimmed meanwhile over spoolLimit were the first ones sent.
+	done := sent - (sink.trimmed - trimmed)
+	if done > 0 && removeLines(sink.spoolFile, 1, done) == nil && sink.spooled >= 0 {
+		sink.spooled -= done
+	}
+	sink.spoolMu.Unlock()
+
+	if sErr != nil {
+		if !sink.down {
+			log.Printf("Audit sink '%s' is unavailable: %s", sink.name, sErr.Error())
+		}
+		sink.down = true
+		return false
+	}
+	if sink.down {
+		log.Printf("Audit sink '%s' has delivered %d spooled events.", sink.name, len(lines))
+	}
+	sink.down = false
+	return true
+}
+
+func (sink *auditSink) spool(e auditEvent) {
+	line, _ := json.Marshal(e)
+
+	sink.spoolMu.Lock()
+	defer sink.spoolMu.Unlock()
+
+	if sink.spoolLimit > 0 {
+		if sink.spooled < 0 {
+			sink.spooled = countSpool(sink.spoolFile)
+		}
+
+		if sink.spooled >= sink.spoolLimit {
+			over := sink.spooled - sink.spoolLimit + 1
+			if removeLines(sink.spoolFile, 1, over) == nil {
+				sink.spooled -= over
+				sink.trimmed += over
+			}
+		}
+	}
+
+	f, err := os.OpenFile(sink.spoolFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, conf().fileMode)
+	if err != nil {
+		log.Printf("Could NOT spool event of sink '%s': %s", sink.name, err.Error())
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	_ = f.Close()
+	if err == nil && sink.spooled >= 0 {
+		sink.spooled++
+	}
+}
+
+// countSpool counts the lines of a spool, once per sink: e.g. those left by
+// the sink of the same name before a restart or a reload.
+func countSpool(path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	var amount int64 = 0
+	fileScanner := bufio.NewScanner(file)
+	for fileScanner.Scan() {
+		amount++
+	}
+
+	return amount
+}
+
+func (sink *auditSink) send(e auditEvent) error {
+	if sink.conn == nil {
+		conn, err := net.DialTimeout(sink.network, sink.addr, sinkDialTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+
+	var payload []byte
+	switch sink.format {
+	case "syslog":
+		payload = []byte(formatSyslog(e))
+		if sink.network == "tcp" || sink.network == "unix" {
+			// Octet-counting framing (RFC 6587, section 3.4.1).
+			payload = append([]byte(fmt.Sprintf("%d ", len(payload))), payload...)
+		}
+
+	default:
+		payload, _ = json.Marshal(e)
+		payload = append(payload, '\n')
+	}
+
+	_ = sink.conn.SetWriteDeadline(time.Now().Add(sinkDialTimeout))
+	if _, err := sink.conn.Write(payload); err != nil {
+		sink.disconnect()
+		return err
+	}
+
+	return nil
+}
+
+func (sink *auditSink) disconnect() {
+	if sink.conn != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+	}
+}
+
+// formatSyslog renders an event as an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func formatSyslog(e auditEvent) string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	msgID := map[string]string{"u": "user", "g": "group", "f": "file"}[e.Kind]
+	if msgID == "" {
+		msgID = "-"
+	}
+
+	sd := fmt.Sprintf(`[%s nick="%s" peer="%s" object="%s" rw="%d"]`,
+		syslogSDID, escapeSDParam(e.Nick), escapeSDParam(e.Peer), escapeSDParam(e.Object), e.RW)
+
+	return fmt.Sprintf("<%d>1 %s %s serverPSSH %d %s %s %s",
+		syslogFacility*8+syslogSeverity, e.Time.Format(time.RFC3339Nano), hostname, os.Getpid(), msgID, sd, e.Msg)
+}
+
+func escapeSDParam(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return r.Replace(s)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParseAuditSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		db      string
+		wantErr string
+	}{
+		{"syslog over udp", `{"format": "syslog", "network": "udp", "addr": "127.0.0.1:514"}`, ""},
+		{"json over unix", `{"format": "json", "network": "unix", "addr": "/run/audit.sock"}`, ""},
+		{"json over udp", `{"format": "json", "network": "udp", "addr": "127.0.0.1:514"}`, "network must be either of"},
+		{"no format", `{"network": "udp", "addr": "127.0.0.1:514"}`, "format must be either of"},
+		{"no addr", `{"format": "syslog", "network": "udp"}`, "addr is required"},
+		{"bad kind", `{"format": "syslog", "network": "udp", "addr": "127.0.0.1:514", "filter": {"kinds": ["x"]}}`, "filter kinds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAuditSink("siem", gjson.Parse(tt.db))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSinkFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter sinkFilter
+		event  auditEvent
+		want   bool
+	}{
+		{"everything", sinkFilter{rw: -1}, auditEvent{Kind: "u", Nick: "dan", RW: 0b10}, true},
+		{"other kind", sinkFilter{kinds: []string{"f"}, rw: -1}, auditEvent{Kind: "u", RW: -1}, false},
+		{"same kind", sinkFilter{kinds: []string{"u", "f"}, rw: -1}, auditEvent{Kind: "f", RW: -1}, true},
+		{"other nick", sinkFilter{nicks: []string{"root"}, rw: -1}, auditEvent{Kind: "u", Nick: "dan", RW: -1}, false},
+		{"reads only, write", sinkFilter{rw: 0b10}, auditEvent{Kind: "u", RW: 0b01}, false},
+		{"reads only, read", sinkFilter{rw: 0b10}, auditEvent{Kind: "u", RW: 0b10}, true},
+		{"reads only, any", sinkFilter{rw: 0b10}, auditEvent{Kind: "u", RW: -1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.match(tt.event); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSyslog(t *testing.T) {
+	e := auditEvent{Time: time.Unix(0, 0).UTC(), Kind: "f", Object: `a"]b`, Nick: "dan", Peer: "127.0.0.1", RW: 2, Msg: "read"}
+	got := formatSyslog(e)
+
+	for _, want := range []string{"<109>1 1970-01-01T00:00:00Z ", " file ", `object="a\"\]b"`, `rw="2"] read`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("formatSyslog() = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestAuditSinkDelivery(t *testing.T) {
+	inTempDir(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan auditEvent, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var e auditEvent
+			_ = json.Unmarshal(scanner.Bytes(), &e)
+			received <- e
+		}
+	}()
+
+	sink, err := parseAuditSink("siem", gjson.Parse(`{"format": "json", "network": "tcp", "addr": "`+l.Addr().String()+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAuditSinks([]*auditSink{sink})
+	defer stopAuditSinks()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		emitAudit(auditEvent{Kind: "u", Nick: "dan", RW: -1, Msg: msg})
+	}
+
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case e := <-received:
+			if e.Msg != want {
+				t.Fatalf("received %q, want %q", e.Msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q has NOT been delivered", want)
+		}
+	}
+}
+
+func TestAuditSinkUnavailable(t *testing.T) {
+	inTempDir(t)
+
+	// Nothing listens there any more.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	sink, err := parseAuditSink("siem", gjson.Parse(`{"format": "json", "network": "tcp", "addr": "`+addr+`", "spoolLimit": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startAuditSinks([]*auditSink{sink})
+
+	start := time.Now()
+	for i := 0; i < 2*sinkQueueSize; i++ {
+		emitAudit(auditEvent{Kind: "u", Nick: "dan", RW: -1, Msg: "event"})
+	}
+	stopAuditSinks()
+	if elapsed := time.Since(start); elapsed > sinkDialTimeout {
+		t.Errorf("emitting and stopping took %s", elapsed)
+	}
+
+	content, err := os.ReadFile(sink.spoolFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "\n"); n != 100 {
+		t.Errorf("spool has %d events, want 100", n)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	inTempDir(t)
+	_ = os.MkdirAll(spool_path, os.ModePerm)
+
+	sink, err := parseAuditSink("siem", gjson.Parse(`{"format": "json", "network": "tcp", "addr": "127.0.0.1:1", "spoolLimit": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left by the sink before a restart.
+	_ = os.WriteFile(sink.spoolFile, []byte(strings.Repeat(`{"msg": "old"}`+"\n", 5)), 0600)
+
+	for _, msg := range []string{"one", "two"} {
+		sink.spool(auditEvent{Kind: "u", Msg: msg})
+	}
+
+	content, _ := os.ReadFile(sink.spoolFile)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], `"one"`) || !strings.Contains(lines[2], `"two"`) {
+		t.Errorf("spool %q, want the oldest line and the 2 new ones", lines)
+	}
+	if sink.spooled != 3 || sink.trimmed != 4 {
+		t.Errorf("spooled %d, trimmed %d, want 3 and 4", sink.spooled, sink.trimmed)
+	}
+}
+
+func TestEmitAuditQueueFull(t *testing.T) {
+	inTempDir(t)
+	_ = os.MkdirAll(spool_path, os.ModePerm)
+
+	// Nothing takes the events off the queue.
+	sink := &auditSink{name: "siem", filter: sinkFilter{rw: -1}, spoolFile: spool_path + "siem", spooled: -1, events: make(chan auditEvent, 1)}
+	sinksMu.Lock()
+	auditSinks = []*auditSink{sink}
+	sinksMu.Unlock()
+	t.Cleanup(func() {
+		sinksMu.Lock()
+		auditSinks = nil
+		sinksMu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			emitAudit(auditEvent{Kind: "u", RW: -1, Msg: "event"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emitAudit waits for a full queue")
+	}
+	content, err := os.ReadFile(sink.spoolFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "\n"); n != 2 {
+		t.Errorf("spool has %d events, want the 2 that found the queue full", n)
+	}
+}
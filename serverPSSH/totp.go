@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const totpIssuer = "PseudoSSH"
+const totpDigits = 6
+const totpPeriod = 30 // seconds
+const totpSkew = 1    // steps accepted before and after the current one
+const recoveryCodes = 10
+
+type pendingLogin struct {
+	nick    string
+	args    []string
+	expires time.Time
+}
+
+// totpClock is the source of time for TOTP, so it can be replaced offline.
+var totpClock = time.Now
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code (HMAC-SHA1, RFC 4226 truncation) of
+// secret for the time step counter.
+func totpCode(secret []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, bin%mod)
+}
+
+func totpStep(t time.Time) uint64 {
+	return uint64(t.Unix()) / totpPeriod
+}
+
+// verifyTOTP returns the matched time step, which must be greater than
+// lastStep so that a code can NOT be replayed.
+func verifyTOTP(secretB32 string, code string, lastStep uint64, t time.Time) (uint64, bool) {
+	secret, err := b32.DecodeString(secretB32)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := totpStep(t)
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		if i > lastStep && hmac.Equal([]byte(totpCode(secret, i)), []byte(code)) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpURI(nick string, secretB32 string) string {
+	v := url.Values{}
+	v.Set("secret", secretB32)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(totpIssuer), url.PathEscape(nick), v.Encode())
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns the codes to show once and their hashes to keep.
+func newRecoveryCodes() ([]string, []string) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes
+}
+
+func is2FAEnabled(db string) bool {
+	return gjson.Get(db, "totp.enabled").Bool()
+}
+
+func is2FARequired(db string) bool {
+	if conf().require2FAAdmins && gjson.Get(db, "isAdmin").Bool() {
+		return true
+	}
+
+	return conf().require2FAMark > 0 && gjson.Get(db, "cm").Uint() > conf().require2FAMark
+}
+
+// check2FA verifies a TOTP code or consumes a recovery code. It returns
+// the updated user db.
+func check2FA(db string, code string) (string, bool) {
+	t := totpClock()
+	step, ok := verifyTOTP(gjson.Get(db, "totp.secret").String(), code, gjson.Get(db, "totp.lastStep").Uint(), t)
+	if ok {
+		db, _ = sjson.Set(db, "totp.lastStep", step)
+		return db, true
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, v := range gjson.Get(db, "totp.recovery").Array() {
+		if hmac.Equal([]byte(v.String()), []byte(hash)) {
+			db, _ = sjson.Delete(db, fmt.Sprintf("totp.recovery.%d", i))
+			return db, true
+		}
+	}
+
+	return db, false
+}
+
+// secondFactor finishes a login whose first factor has been verified.
+func (s *server) secondFactor(c *client, args []string, db string, pathToFile string) {
+	if !is2FAEnabled(db) {
+		s.completeLogin(c, args, db, pathToFile)
+		if c.isLoggedIn && is2FARequired(db) {
+			c.restrict(`Two-factor authentication is required for your account. Use "2fa enroll" first.`, CmdTwoFA)
+			c.status(statusForbidden)
+			c.msg(c.restriction)
+		}
+		return
+	}
+
+	c.pending2FA = &pendingLogin{
+		nick:    c.nick,
+		args:    args,
+		expires: time.Now().Add(challengeTTL),
+	}
+
+	c.status(statusUnauthorized)
+	c.msg(`Two-factor code required. Use "otp [code]" with your authenticator code or a recovery code.`)
+}
+
+// otp answers the second factor of a pending login: "otp [code]".
+func (s *server) otp(c *client, args []string) {
+	p := c.pending2FA
+	c.pending2FA = nil
+
+	if p == nil || time.Now().After(p.expires) {
+		c.status(statusNotFound)
+		c.msg(`There is no pending login. Use "login [nick] [pswd]" first.`)
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "otp [code]"`)
+		return
+	}
+
+	now := time.Now()
+	c.nick = p.nick
+	pathToFile := db_path + c.nick + ".json"
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
+	db, ok := check2FA(db, args[1])
+	if !ok {
+		c.status(statusUnauthorized)
+		c.msg("Wrong two-factor code.")
+
+		c.loginAttempts++
+		writeAudit(c, db, fmt.Sprintf("Failed two-factor code from '%s'. Attempt #%d", getPeer(c), c.loginAttempts), -1, "")
+
+		recordLoginFailure(c, db, pathToFile, now)
+		return
+	}
+	_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+	if left := len(gjson.Get(db, "totp.recovery").Array()); left < recoveryCodes/2 {
+		c.msg(fmt.Sprintf(`Only %d recovery codes are left. Use "2fa codes [code]" to get new ones.`, left))
+	}
+
+	s.completeLogin(c, p.args, db, pathToFile)
+}
+
+// twofa manages enrollment: "2fa (status|enroll|confirm|codes|disable|reset) {code|nick}".
+func (s *server) twofa(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "2fa (status|enroll|confirm|codes|disable|reset) {code|nick}"`)
+		return
+	}
+
+	pathToFile := db_path + c.nick + ".json"
+	content, _ := os.ReadFile(pathToFile)
+	db := string(content)
+
+	switch args[1] {
+	case "status":
+		c.msg(fmt.Sprintf("Two-factor authentication: enabled '%t', required '%t', recovery codes left '%d'",
+			is2FAEnabled(db), is2FARequired(db), len(gjson.Get(db, "totp.recovery").Array())))
+
+	case "enroll":
+		if is2FAEnabled(db) {
+			c.status(statusConflict)
+			c.msg(`Two-factor authentication is already enabled. Use "2fa disable [code]" first.`)
+			return
+		}
+
+		secret := make([]byte, 20)
+		_, _ = rand.Read(secret)
+		secretB32 := b32.EncodeToString(secret)
+
+		db, _ = sjson.Set(db, "totp.pending", secretB32)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+		c.secretMsg(fmt.Sprintf("Add this account to your authenticator app:\n%s\nSecret: %s\nThen confirm it with \"2fa confirm [code]\".",
+			totpURI(c.nick, secretB32), secretB32),
+			"Add this account to your authenticator app: (the secret is NOT recorded)")
+
+	case "confirm":
+		pending := gjson.Get(db, "totp.pending").String()
+		if pending == "" {
+			c.status(statusNotFound)
+			c.msg(`There is no pending enrollment. Use "2fa enroll" first.`)
+			return
+		}
+
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(`Wrong usage. Example: "2fa confirm [code]"`)
+			return
+		}
+
+		step, ok := verifyTOTP(pending, args[2], 0, totpClock())
+		if !ok {
+			c.status(statusUnauthorized)
+			c.msg("Wrong two-factor code.")
+			return
+		}
+
+		codes, hashes := newRecoveryCodes()
+		db, _ = sjson.Delete(db, "totp")
+		db, _ = sjson.Set(db, "totp.enabled", true)
+		db, _ = sjson.Set(db, "totp.secret", pending)
+		db, _ = sjson.Set(db, "totp.lastStep", step)
+		db, _ = sjson.Set(db, "totp.recovery", hashes)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+		c.unrestrict(CmdTwoFA)
+		c.secretMsg(fmt.Sprintf("Two-factor authentication is enabled. Keep these recovery codes, they are shown only once:\n%s",
+			strings.Join(codes, "\n")),
+			"Two-factor authentication is enabled. Keep these recovery codes, they are shown only once: (NOT recorded)")
+		writeAudit(c, db, "Enabled two-factor authentication", -1, "")
+
+	case "codes":
+		if !is2FAEnabled(db) {
+			c.status(statusConflict)
+			c.msg("Two-factor authentication is NOT enabled.")
+			return
+		}
+
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(`Wrong usage. Example: "2fa codes [code]"`)
+			return
+		}
+
+		step, ok := verifyTOTP(gjson.Get(db, "totp.secret").String(), args[2], gjson.Get(db, "totp.lastStep").Uint(), totpClock())
+		if !ok {
+			c.status(statusUnauthorized)
+			c.msg("Wrong two-factor code.")
+			return
+		}
+
+		codes, hashes := newRecoveryCodes()
+		db, _ = sjson.Set(db, "totp.lastStep", step)
+		db, _ = sjson.Set(db, "totp.recovery", hashes)
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+		c.secretMsg(fmt.Sprintf("New recovery codes, the old ones do NOT work anymore:\n%s", strings.Join(codes, "\n")),
+			"New recovery codes, the old ones do NOT work anymore: (NOT recorded)")
+		writeAudit(c, db, "Regenerated two-factor recovery codes", -1, "")
+
+	case "disable":
+		if !is2FAEnabled(db) {
+			c.status(statusConflict)
+			c.msg("Two-factor authentication is NOT enabled.")
+			return
+		}
+
+		if is2FARequired(db) {
+			c.status(statusForbidden)
+			c.msg("Two-factor authentication is required for your account and can NOT be disabled.")
+			return
+		}
+
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(`Wrong usage. Example: "2fa disable [code]"`)
+			return
+		}
+
+		db, ok := check2FA(db, args[2])
+		if !ok {
+			c.status(statusUnauthorized)
+			c.msg("Wrong two-factor code.")
+			return
+		}
+
+		db, _ = sjson.Delete(db, "totp")
+		_ = os.WriteFile(pathToFile, []byte(db), conf().fileMode)
+
+		c.msg("Two-factor authentication is disabled.")
+		writeAudit(c, db, "Disabled two-factor authentication", -1, "")
+
+	case "reset":
+		if !c.isAdmin {
+			c.status(statusForbidden)
+			c.msg("Only admin can reset two-factor authentication of users.")
+			return
+		}
+
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(`Wrong usage. Example: "2fa reset [nick]"`)
+			return
+		}
+
+		object := args[2]
+		if !isValidNick(object) {
+			c.status(statusNotFound)
+			c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
+			return
+		}
+
+		pathToUser := db_path + object + ".json"
+		ucontent, err := os.ReadFile(pathToUser)
+		if err != nil {
+			c.status(statusNotFound)
+			c.msg(fmt.Sprintf("User '%s' does NOT exists.", object))
+			return
+		}
+
+		udb, _ := sjson.Delete(string(ucontent), "totp")
+		_ = os.WriteFile(pathToUser, []byte(udb), conf().fileMode)
+
+		c.msg(fmt.Sprintf("You have successfully reset two-factor authentication of '%s'.", object))
+		writeAudit(c, db, fmt.Sprintf("Reset two-factor authentication of '%s'", object), -1, "")
+
+	default:
+		c.status(statusBadRequest)
+		c.msg("First option must be either of 'status', 'enroll', 'confirm', 'codes', 'disable', 'reset'")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B, cut to 6 digits.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := b32.EncodeToString(rfc6238Secret)
+	at := time.Unix(1111111111, 0) // step 37037037, code 050471
+	step := totpStep(at)
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep uint64
+		at       time.Time
+		want     bool
+	}{
+		{"current step", "050471", 0, at, true},
+		{"one step late", "050471", 0, at.Add(totpPeriod * time.Second), true},
+		{"one step early", "050471", 0, at.Add(-totpPeriod * time.Second), true},
+		{"two steps late", "050471", 0, at.Add(2 * totpPeriod * time.Second), false},
+		{"replayed", "050471", step, at, false},
+		{"wrong code", "050472", 0, at, false},
+		{"short code", "50471", 0, at, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := verifyTOTP(secret, tt.code, tt.lastStep, tt.at); ok != tt.want {
+				t.Errorf("verifyTOTP(%s) = %v, want %v", tt.code, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "login-backoff", "0s")
+
+	now := time.Unix(1700000000, 0)
+	totpClock = func() time.Time { return now }
+	t.Cleanup(func() { totpClock = time.Now })
+
+	codeOf := func(field string) string {
+		content, _ := os.ReadFile(db_path + "root.json")
+		secret, _ := b32.DecodeString(gjson.GetBytes(content, field).String())
+		return totpCode(secret, totpStep(now))
+	}
+
+	root := h.login("10.0.0.1", "root", rootPswd)
+	out := h.do(root, "2fa enroll")
+	_, secret, _ := strings.Cut(out, "Secret: ")
+	secret, _, _ = strings.Cut(secret, "\n")
+	if secret == "" {
+		t.Fatalf("2fa enroll: %q", out)
+	}
+
+	out = h.do(root, "2fa confirm "+codeOf("totp.pending"))
+	if !strings.Contains(out, "Two-factor authentication is enabled.") {
+		t.Fatalf("2fa confirm: %q", out)
+	}
+	recovery := strings.Split(strings.TrimSpace(out), "\n")[1]
+
+	h.do(root, "logout")
+	matches, _ := filepath.Glob(filepath.Join(sessions_path, "root", "*.cast"))
+	if len(matches) == 0 {
+		t.Fatal("the session of 'root' has NOT been recorded")
+	}
+	for _, m := range matches {
+		content, _ := os.ReadFile(m)
+		for _, s := range []string{secret, recovery} {
+			if strings.Contains(string(content), s) {
+				t.Errorf("recording '%s' has the secret %q", m, s)
+			}
+		}
+	}
+
+	// The code that confirmed the enrollment can NOT log in again.
+	now = now.Add(totpPeriod * time.Second)
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"wrong code", "000000", "Wrong two-factor code."},
+		{"code", codeOf("totp.secret"), "You have successfully logged in."},
+		{"replayed code", codeOf("totp.secret"), "Wrong two-factor code."},
+		{"recovery code", recovery, "You have successfully logged in."},
+		{"used recovery code", recovery, "Wrong two-factor code."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := h.connect("10.0.0.2")
+			if out := h.do(c, "login root "+rootPswd); !strings.Contains(out, "Two-factor code required.") {
+				t.Fatalf("login: %q", out)
+			}
+			if out := h.do(c, "otp "+tt.code); !strings.Contains(out, tt.want) {
+				t.Errorf("otp: got %q, want %q", out, tt.want)
+			}
+			h.do(c, "logout")
+		})
+	}
+}
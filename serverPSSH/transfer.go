@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Files go over the line protocol in base64, so that they may have line
+// breaks and any bytes:
+//
+//	put [file] [base64]   adds a chunk to the upload of file
+//	put [file]            writes the chunks to file, as "write" does, but
+//	                      an existing file keeps its group, rights and mark
+//	get [file]            reads file, as "read" does, in base64
+//
+// The chunks of an upload are kept by the session until it is written.
+
+type upload struct {
+	file string
+	data []byte
+}
+
+func (s *server) put(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "put [file] {base64}", then "put [file]" to write it`)
+		return
+	}
+
+	// Uploads land inside the homes only, as mkdir and rm do.
+	file := args[1]
+	path, err := getPathToFile(c, file)
+	if err != nil || !inHomeTree(c, path) {
+		c.upload = nil
+		c.status(statusForbidden)
+		c.msg(fmt.Sprintf("You cannot upload '%s', it is NOT inside %s.", file, homeTreeOf(c)))
+
+		ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
+		writeAudit(c, string(ucontent), fmt.Sprintf("Tried to upload out-of-tree file '%s'", file), 0b01, "")
+		return
+	}
+
+	if c.upload == nil || c.upload.file != file {
+		c.upload = &upload{file: file}
+	}
+
+	if len(args) < 3 {
+		data := c.upload.data
+		c.upload = nil
+		s.writeText(c, file, string(data), true)
+		return
+	}
+
+	chunk, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		c.upload = nil
+		c.err(err)
+		return
+	}
+
+	if len(c.upload.data)+len(chunk) > conf().maxUpload {
+		c.upload = nil
+		c.status(statusBadRequest)
+		c.msg(fmt.Sprintf("The upload of '%s' is longer than %d bytes.", file, conf().maxUpload))
+		return
+	}
+	c.upload.data = append(c.upload.data, chunk...)
+
+	c.msg(fmt.Sprintf("Received %d bytes of '%s'", len(c.upload.data), file))
+}
+
+// inHomeTree reports whether path is under the home of c, where c may make
+// and remove directories, but NOT the home itself. Admins may do so under
+// any home.
+func inHomeTree(c *client, path string) bool {
+	clean := filepath.ToSlash(filepath.Clean(path))
+	if !strings.HasPrefix(clean, users_path) {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(clean, users_path), "/")
+	return len(parts) > 2 && parts[1] == "home" && (c.isAdmin || parts[0] == c.nick)
+}
+
+// homeTreeOf names the homes of inHomeTree, for the messages.
+func homeTreeOf(c *client) string {
+	if c.isAdmin {
+		return "a home directory"
+	}
+	return "your home directory"
+}
+
+func (s *server) mkdir(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "mkdir [dir]"`)
+		return
+	}
+
+	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
+	udb := string(ucontent)
+
+	path, err := getPathToFile(c, args[1])
+	if err != nil {
+		c.err(err)
+		writeAudit(c, udb, fmt.Sprintf("Tried to create out-of-tree directory '%s'", args[1]), 0b01, "")
+		return
+	}
+	if !inHomeTree(c, path) {
+		c.status(statusForbidden)
+		c.msg(fmt.Sprintf("You cannot create directory '%s', it is NOT inside %s.", args[1], homeTreeOf(c)))
+		writeAudit(c, udb, fmt.Sprintf("Tried to create out-of-tree directory '%s'", path), 0b01, "")
+		return
+	}
+
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		c.err(err)
+		writeAudit(c, udb, fmt.Sprintf("Couldn't create directory '%s'", path), 0b01, "")
+		return
+	}
+
+	c.msg(fmt.Sprintf("You have successfully created directory '%s'", args[1]))
+	writeAudit(c, udb, fmt.Sprintf("Created directory '%s'", path), 0b01, "")
+}
+
+func (s *server) rm(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "rm [file]", or an empty directory`)
+		return
+	}
+
+	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
+	udb := string(ucontent)
+
+	pathToFile, err := getPathToFile(c, args[1])
+	if err != nil {
+		c.err(err)
+		writeAudit(c, udb, fmt.Sprintf("Tried to remove out-of-tree file '%s'", args[1]), 0b01, "")
+		return
+	}
+
+	info, err := os.Stat(pathToFile)
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	if info.IsDir() {
+		if filepath.Clean(pathToFile) == filepath.Clean(c.actDir) {
+			c.status(statusForbidden)
+			c.msg("You cannot remove the current directory.")
+			return
+		}
+		if !inHomeTree(c, pathToFile) {
+			c.status(statusForbidden)
+			c.msg(fmt.Sprintf("You cannot remove directory '%s', it is NOT inside %s.", args[1], homeTreeOf(c)))
+			writeAudit(c, udb, fmt.Sprintf("Tried to remove out-of-tree directory '%s'", pathToFile), 0b01, "")
+			return
+		}
+		if err := os.Remove(pathToFile); err != nil {
+			c.err(err)
+			return
+		}
+
+		c.msg(fmt.Sprintf("You have successfully removed directory '%s'", args[1]))
+		writeAudit(c, udb, fmt.Sprintf("Removed directory '%s'", pathToFile), 0b01, "")
+		return
+	}
+
+	content, _ := os.ReadFile(db_files)
+	db := string(content)
+	if !gjson.Get(db, dbKey(pathToFile)).Exists() {
+		c.status(statusNotFound)
+		c.msg("DB: There is no such file in the database.")
+		return
+	}
+
+	owner := gjson.Get(db, dbKey(pathToFile)+".owner").String()
+	if c.nick != owner {
+		c.status(statusForbidden)
+		c.msg("You are not the owner of this file.")
+		writeAudit(c, udb, "not the owner of this file.", 0b01, "")
+		writeFileAudit(c, db, pathToFile, "DS: NOT the owner, could NOT remove the file", 0b01)
+		return
+	}
+
+	if err := os.Remove(pathToFile); err != nil {
+		c.err(err)
+		writeAudit(c, udb, fmt.Sprintf("Couldn't remove file '%s'", pathToFile), 0b01, "")
+		return
+	}
+	writeFileAudit(c, db, pathToFile, fmt.Sprintf("Removed file '%s'", pathToFile), 0b01)
+
+	db, _ = sjson.Delete(db, dbKey(pathToFile))
+	_ = os.WriteFile(db_files, []byte(db), conf().fileMode)
+
+	c.msg(fmt.Sprintf("You have successfully removed '%s'", args[1]))
+	writeAudit(c, udb, fmt.Sprintf("Removed file '%s'", pathToFile), 0b01, "")
+}
+
+func (s *server) chgrp(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 3 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "chgrp [file] [group]"`)
+		return
+	}
+
+	pathToFile, err := getPathToFile(c, args[1])
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	content, _ := os.ReadFile(db_files)
+	db := string(content)
+	if !gjson.Get(db, dbKey(pathToFile)).Exists() {
+		c.status(statusNotFound)
+		c.msg("DB: There is no such file in the database.")
+		return
+	}
+
+	ucontent, _ := os.ReadFile(db_path + c.nick + ".json")
+	udb := string(ucontent)
+
+	owner := gjson.Get(db, dbKey(pathToFile)+".owner").String()
+	if c.nick != owner {
+		c.status(statusForbidden)
+		c.msg("You are not the owner of this file.")
+		writeAudit(c, udb, "not the owner of this file.", -1, "")
+		return
+	}
+
+	group := args[2]
+	if _, err := os.Stat(group_path + group + ".json"); errors.Is(err, os.ErrNotExist) {
+		c.status(statusNotFound)
+		c.msg(fmt.Sprintf("Group '%s' does NOT exists.", group))
+		return
+	}
+
+	c.groups = c.groups[:0]
+	appendGroups(c)
+
+	isMember := false
+	for _, g := range c.groups {
+		if g == group {
+			isMember = true
+		}
+	}
+
+	if !isMember && !c.isAdmin {
+		c.status(statusForbidden)
+		c.msg(fmt.Sprintf("DS: You are NOT in the group '%s'", group))
+		writeAudit(c, udb, fmt.Sprintf("DS: not in the group '%s'", group), -1, "")
+		return
+	}
+
+	db, _ = sjson.Set(db, dbKey(pathToFile)+".group", group)
+	_ = os.WriteFile(db_files, []byte(db), conf().fileMode)
+
+	c.msg(fmt.Sprintf("You have successfully changed group of '%s' to '%s'", pathToFile, group))
+	writeAudit(c, udb, fmt.Sprintf("successfully changed group of '%s' to '%s'", pathToFile, group), -1, "")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestInHomeTree(t *testing.T) {
+	dan := &client{nick: "dan"}
+	root := &client{nick: "root", isAdmin: true}
+
+	tests := []struct {
+		c    *client
+		path string
+		want bool
+	}{
+		{dan, "users/dan/home/docs", true},
+		{dan, "users/dan/home/docs/2026", true},
+		{dan, "users/dan/home/docs/", true},
+		{dan, "users/dan/home", false},
+		{dan, "users/dan/home/", false},
+		{dan, "users/dan", false},
+		{dan, "users/dan/keys", false},
+		{dan, "users/dan/home/../../root/home", false},
+		{dan, "users/root/home/docs", false},
+		{dan, "users/dan/home/../../root/home/docs", false},
+		{dan, "users/../audits/x", false},
+		{dan, "audits/x", false},
+		{root, "users/dan/home/docs", true},
+		{root, "users/dan/home", false},
+	}
+
+	for _, tt := range tests {
+		if got := inHomeTree(tt.c, tt.path); got != tt.want {
+			t.Errorf("inHomeTree(%s, %q) = %v, want %v", tt.c.nick, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	h := newHarness(t)
+	setFlag(t, "max-upload", "8")
+	root := h.login("10.0.0.1", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	dan := h.login("10.0.0.2", "dan", "Pw4Tests_x9")
+
+	chunk := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	// Neither uploads out of the homes nor into those of others.
+	for _, line := range []string{"put users/../db/evil.json " + chunk("{}"), "put users/../db/evil.json"} {
+		if out := h.do(root, line); !strings.Contains(out, "You cannot upload 'users/../db/evil.json', it is NOT inside a home directory.") {
+			t.Errorf("%q: got %q", line, out)
+		}
+	}
+	if _, err := os.Stat(db_path + "evil.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("db/evil.json has been written: %v", err)
+	}
+	if out := h.do(dan, "put users/root/home/x.txt "+chunk("x")); !strings.Contains(out, "You cannot upload 'users/root/home/x.txt', it is NOT inside your home directory.") {
+		t.Errorf("into the home of another: got %q", out)
+	}
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"bad base64", "put a.txt !!", "illegal base64"},
+		{"first chunk", "put a.txt " + chunk("two\n"), "Received 4 bytes of 'a.txt'"},
+		{"too long", "put a.txt " + chunk("lines"), "The upload of 'a.txt' is longer than 8 bytes."},
+		{"starts over", "put a.txt " + chunk("one\n"), "Received 4 bytes of 'a.txt'"},
+		{"second chunk", "put a.txt " + chunk("line"), "Received 8 bytes of 'a.txt'"},
+		{"write", "put a.txt", ""},
+		{"get", "get a.txt", "Data of file 'a.txt': " + chunk("one\nline")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(root, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	if content, _ := os.ReadFile(root.actDir + "/a.txt"); string(content) != "one\nline" {
+		t.Errorf("a.txt: %q", content)
+	}
+}
+
+func TestPutKeepsRecord(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	h.do(root, "addgroup team mark 40")
+	h.do(root, "u2g team dan")
+	h.do(root, "write users/dan/home/k.txt old")
+	h.do(root, "chgrp users/dan/home/k.txt team")
+	h.do(root, "chmark f users/dan/home/k.txt 40")
+	h.do(root, "chmod users/dan/home/k.txt 1111")
+
+	// dan may write the file as a member of its group, NOT change its record.
+	dan := h.login("10.0.0.2", "dan", "Pw4Tests_x9 40")
+	h.do(dan, "put k.txt "+base64.StdEncoding.EncodeToString([]byte("new")))
+	if out := h.do(dan, "put k.txt"); !strings.Contains(out, "You have successfully written text to 'k.txt'") {
+		t.Fatalf("put: %q", out)
+	}
+
+	content, _ := os.ReadFile(db_files)
+	record := gjson.Get(string(content), dbKey("users/dan/home/k.txt"))
+	if record.Get("group").String() != "team" || record.Get("cm").Uint() != 40 || record.Get("rights").Int() != 0b1111 {
+		t.Errorf("record %s, want group 'team', mark 40 and rights 1111", record.Raw)
+	}
+}
+
+func TestMkdirAndRm(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1", "root", rootPswd)
+	h.do(root, "reg dan Pw4Tests_x9")
+	dan := h.login("10.0.0.2", "dan", "Pw4Tests_x9")
+	h.do(root, "write mine.txt root's")
+	h.do(root, "mkdir shared")
+
+	tests := []struct {
+		name string
+		c    *client
+		line string
+		want string
+	}{
+		{"mkdir", dan, "mkdir docs/2026", "You have successfully created directory 'docs/2026'"},
+		{"mkdir outside of a home", dan, "mkdir users/../audits/x", "You cannot create directory 'users/../audits/x', it is NOT inside your home directory."},
+		{"mkdir in the home of another", dan, "mkdir users/root/home/x", "You cannot create directory 'users/root/home/x', it is NOT inside your home directory."},
+		{"rm in the home of another", dan, "rm users/root/home/shared", "You cannot remove directory 'users/root/home/shared', it is NOT inside your home directory."},
+		{"rm a full directory", dan, "rm docs", "directory not empty"},
+		{"rm a directory", dan, "rm docs/2026", "You have successfully removed directory 'docs/2026'"},
+		{"rm the own home", dan, "rm users/root/home/../../dan/home", "You cannot remove the current directory."},
+		{"rm the home of another", root, "rm users/dan/home", "You cannot remove directory 'users/dan/home', it is NOT inside a home directory."},
+		{"rm a file of another", dan, "rm " + root.actDir + "/mine.txt", "You are not the owner of this file."},
+		{"rm a file", root, "rm mine.txt", "You have successfully removed 'mine.txt'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := h.do(tt.c, tt.line); !strings.Contains(out, tt.want) {
+				t.Errorf("%q: got %q, want %q", tt.line, out, tt.want)
+			}
+		})
+	}
+
+	if _, err := os.Stat(dan.actDir); err != nil {
+		t.Errorf("the home of 'dan': %s", err)
+	}
+	if _, err := os.Stat(root.actDir + "/shared"); err != nil {
+		t.Errorf("the directory of 'root': %s", err)
+	}
+	if _, err := os.Stat(users_path + "root/home/x"); err == nil {
+		t.Error("'dan' has made a directory in the home of 'root'")
+	}
+}
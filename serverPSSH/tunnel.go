@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels forward TCP connections over a session of the json protocol, as
+// "ssh -L" and "ssh -R" do. They are allowed by the 'forwarding' rules of
+// the configuration file, see forwarding.go:
+//
+//	tunnel open [host:port]     connects to host:port from the server
+//	tunnel listen [host:port]   accepts connections on the server
+//	tunnel close [id]           closes a tunnel or a tunnel listener
+//	tunnel ls                   lists the tunnels of the session
+//
+// The data of a tunnel goes in base64, from the client as lines that are
+// NOT commands, "@{id} {base64}", and to the client as frames of type
+// "tunnel". "@{id}" alone, or the event "eof", ends the data of one side.
+// A tunnel is closed once both sides have ended their data.
+
+// tunnelChunk is the most bytes of a tunnel sent in one frame.
+const tunnelChunk = 3072
+
+type tunnel struct {
+	id       string
+	kind     string // "local" or "remote"
+	addr     string // the destination of a local tunnel, the peer of a remote one
+	listener string // of a remote tunnel
+	rule     string
+	opened   time.Time
+	in, out  int64 // bytes from and to the client
+
+	conn                 net.Conn // nil while a local tunnel is connecting
+	clientEOF, targetEOF bool
+}
+
+type tunnelListener struct {
+	id     string
+	addr   string
+	rule   string
+	opened time.Time
+	ln     net.Listener
+}
+
+// tunnelSet holds the tunnels of a session. The data of the tunnels is
+// moved by their own goroutines and by readInput, so it is locked.
+type tunnelSet struct {
+	mu        sync.Mutex
+	lastID    int
+	tunnels   map[string]*tunnel
+	listeners map[string]*tunnelListener
+}
+
+// tunnelData is the payload of the "tunnel" frames.
+type tunnelData struct {
+	Tunnel   string `json:"tunnel"`
+	Event    string `json:"event"`              // "open", "accept", "data", "eof" or "close"
+	Data     string `json:"data,omitempty"`     // base64, of "data"
+	Listener string `json:"listener,omitempty"` // of "accept"
+	From     string `json:"from,omitempty"`     // of "accept"
+	Reason   string `json:"reason,omitempty"`   // of "close", if it has failed
+}
+
+type tunnelInfo struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"` // "local", "remote" or "listen"
+	Addr     string `json:"addr"`
+	Listener string `json:"listener,omitempty"`
+	Rule     string `json:"rule"`
+	Opened   int64  `json:"opened"`
+	In       int64  `json:"in"`
+	Out      int64  `json:"out"`
+}
+
+func newTunnelSet() *tunnelSet {
+	return &tunnelSet{
+		tunnels:   make(map[string]*tunnel),
+		listeners: make(map[string]*tunnelListener),
+	}
+}
+
+func (ts *tunnelSet) nextID() string {
+	ts.lastID++
+	return strconv.Itoa(ts.lastID)
+}
+
+func (ts *tunnelSet) add(t *tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t.id = ts.nextID()
+	ts.tunnels[t.id] = t
+}
+
+func (ts *tunnelSet) addListener(l *tunnelListener) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	l.id = ts.nextID()
+	ts.listeners[l.id] = l
+}
+
+func (ts *tunnelSet) get(id string) *tunnel {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.tunnels[id]
+}
+
+func (ts *tunnelSet) getListener(id string) *tunnelListener {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.listeners[id]
+}
+
+func (ts *tunnelSet) count() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return len(ts.tunnels) + len(ts.listeners)
+}
+
+// connect gives a local tunnel its connection. A tunnel closed while it was
+// connecting does NOT take it.
+func (ts *tunnelSet) connect(t *tunnel, conn net.Conn) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.tunnels[t.id] != t {
+		return false
+	}
+	t.conn = conn
+	return true
+}
+
+// connOf returns the connection of a tunnel that is open, else nil.
+func (ts *tunnelSet) connOf(id string) (*tunnel, net.Conn) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t := ts.tunnels[id]
+	if t == nil || t.conn == nil || t.clientEOF {
+		return nil, nil
+	}
+	return t, t.conn
+}
+
+// end marks the data of one side ("client" or "target") as ended. It
+// reports whether both sides have ended.
+func (ts *tunnelSet) end(t *tunnel, side string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if side == "client" {
+		t.clientEOF = true
+	} else {
+		t.targetEOF = true
+	}
+	return t.clientEOF && t.targetEOF
+}
+
+func (ts *tunnelSet) remove(t *tunnel) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.tunnels[t.id] != t {
+		return false
+	}
+	delete(ts.tunnels, t.id)
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+	return true
+}
+
+func (ts *tunnelSet) removeListener(id string) *tunnelListener {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	l := ts.listeners[id]
+	if l != nil {
+		delete(ts.listeners, id)
+		_ = l.ln.Close()
+	}
+	return l
+}
+
+// ids returns the ids of the tunnels and of the listeners, in order.
+func (ts *tunnelSet) ids() ([]string, []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var tunnels, listeners []string
+	for id := range ts.tunnels {
+		tunnels = append(tunnels, id)
+	}
+	for id := range ts.listeners {
+		listeners = append(listeners, id)
+	}
+	byNumber := func(ids []string) {
+		sort.Slice(ids, func(i, j int) bool {
+			a, _ := strconv.Atoi(ids[i])
+			b, _ := strconv.Atoi(ids[j])
+			return a < b
+		})
+	}
+	byNumber(tunnels)
+	byNumber(listeners)
+
+	return tunnels, listeners
+}
+
+func (s *server) tunnel(c *client, args []string) {
+	if !c.isLoggedIn {
+		c.status(statusUnauthorized)
+		c.msg("You must log in first.")
+		return
+	}
+
+	if len(args) < 2 {
+		c.status(statusBadRequest)
+		c.msg(`Wrong usage. Example: "tunnel (open|listen) [host:port]", "tunnel close [id]" or "tunnel ls"`)
+		return
+	}
+
+	switch args[1] {
+	case "open", "listen":
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(fmt.Sprintf(`Wrong usage. Example: "tunnel %s [host:port]"`, args[1]))
+			return
+		}
+		if !c.structured {
+			c.status(statusBadRequest)
+			c.msg(`Tunnels need the json protocol, "proto json" as the first line.`)
+			return
+		}
+		s.openTunnel(c, args[1], args[2])
+
+	case "close":
+		if len(args) < 3 {
+			c.status(statusBadRequest)
+			c.msg(`Wrong usage. Example: "tunnel close [id]"`)
+			return
+		}
+		s.closeTunnel(c, args[2])
+
+	case "ls":
+		s.lstunnels(c)
+
+	default:
+		c.status(statusBadRequest)
+		c.msg("First option must be either of 'open', 'listen', 'close', 'ls'")
+	}
+}
+
+func (s *server) openTunnel(c *client, how string, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	n, pErr := strconv.Atoi(port)
+	if err != nil || pErr != nil || host == "" || n < 1 || n > 65535 {
+		c.status(statusBadRequest)
+		c.msg(fmt.Sprintf(`Wrong usage. Example: "tunnel %s [host:port]", NOT '%s'`, how, addr))
+		return
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	db := string(content)
+
+	kind := "local"
+	if how == "listen" {
+		kind = "remote"
+	}
+
+	// A user may have been added to a group since logging in.
+	c.groups = c.groups[:0]
+	appendGroups(c)
+
+	rule := forwardingRule(c, kind, addr)
+	if rule == "" {
+		if kind == "local" {
+			c.status(statusForbidden)
+			c.msg(fmt.Sprintf("You are NOT allowed to open tunnels to '%s'.", addr))
+			writeAudit(c, db, fmt.Sprintf("Refused a tunnel to '%s'", addr), -1, "")
+		} else {
+			c.status(statusForbidden)
+			c.msg(fmt.Sprintf("You are NOT allowed to listen on '%s'.", addr))
+			writeAudit(c, db, fmt.Sprintf("Refused a tunnel listener on '%s'", addr), -1, "")
+		}
+		log.Printf("A user '%s' has been refused a %s tunnel on '%s'.", c.nick, kind, addr)
+		return
+	}
+
+	if c.tunnels.count() >= conf().maxTunnels {
+		c.status(statusTooMany)
+		c.msg(fmt.Sprintf("Too many tunnels, a session can have %d.", conf().maxTunnels))
+		return
+	}
+
+	if kind == "local" {
+		t := &tunnel{kind: kind, addr: addr, rule: rule, opened: time.Now()}
+		c.tunnels.add(t)
+		c.msg(fmt.Sprintf("Opening tunnel %s to '%s'.", t.id, addr))
+		c.setData(t.info())
+		go s.dialTunnel(c, t, conf().tunnelDialTimeout)
+		return
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.status(statusError)
+		c.msg(fmt.Sprintf("Couldn't listen on '%s': %s", addr, err.Error()))
+		return
+	}
+
+	l := &tunnelListener{addr: ln.Addr().String(), rule: rule, opened: time.Now(), ln: ln}
+	c.tunnels.addListener(l)
+	go s.acceptTunnels(c, l)
+
+	writeAudit(c, db, fmt.Sprintf("Opened tunnel listener %s on '%s' by the rule '%s'", l.id, l.addr, rule), -1, "")
+	log.Printf("A user '%s' has opened tunnel listener %s on '%s'.", c.nick, l.id, l.addr)
+
+	c.msg(fmt.Sprintf("Listening on '%s' as tunnel %s.", l.addr, l.id))
+	c.setData(l.info())
+}
+
+func (s *server) dialTunnel(c *client, t *tunnel, timeout time.Duration) {
+	reason := ""
+	conn, err := net.DialTimeout("tcp", t.addr, timeout)
+	if err != nil {
+		reason = err.Error()
+	} else if !c.tunnels.connect(t, conn) {
+		_ = conn.Close()
+		return
+	}
+
+	c.commands <- command{
+		id:     CmdTunnelUp,
+		client: c,
+		args:   []string{t.id, reason},
+	}
+}
+
+func (s *server) acceptTunnels(c *client, l *tunnelListener) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+
+		t := &tunnel{
+			kind:     "remote",
+			addr:     conn.RemoteAddr().String(),
+			listener: l.id,
+			rule:     l.rule,
+			opened:   time.Now(),
+			conn:     conn,
+		}
+		c.tunnels.add(t)
+		c.commands <- command{
+			id:     CmdTunnelAccept,
+			client: c,
+			args:   []string{t.id},
+		}
+	}
+}
+
+// tunnelUp is run when a local tunnel has connected, or has failed to.
+func (s *server) tunnelUp(c *client, id string, reason string) {
+	t := c.tunnels.get(id)
+	if t == nil {
+		return
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	db := string(content)
+
+	if reason != "" {
+		c.tunnels.remove(t)
+		writeAudit(c, db, fmt.Sprintf("Couldn't open tunnel %s to '%s': %s", t.id, t.addr, reason), -1, "")
+		log.Printf("Tunnel %s of '%s' to '%s' has NOT been opened: %s", t.id, c.nick, t.addr, reason)
+		c.tunnelEvent(fmt.Sprintf("Couldn't open tunnel %s to '%s': %s", t.id, t.addr, reason),
+			tunnelData{Tunnel: t.id, Event: "close", Reason: reason})
+		return
+	}
+
+	writeAudit(c, db, fmt.Sprintf("Opened tunnel %s to '%s' by the rule '%s'", t.id, t.addr, t.rule), -1, "")
+	log.Printf("A user '%s' has opened tunnel %s to '%s'.", c.nick, t.id, t.addr)
+
+	c.tunnelEvent(fmt.Sprintf("Tunnel %s to '%s' is open.", t.id, t.addr), tunnelData{Tunnel: t.id, Event: "open"})
+	go s.pumpTunnel(c, t)
+}
+
+// tunnelAccept is run when a listener has accepted a connection.
+func (s *server) tunnelAccept(c *client, id string) {
+	t := c.tunnels.get(id)
+	if t == nil {
+		return
+	}
+
+	// Accepted while the listener was being closed, e.g. on logout.
+	if c.tunnels.getListener(t.listener) == nil {
+		c.tunnels.remove(t)
+		log.Printf("A tunnel from '%s' has been refused: listener %s is closed.", t.addr, t.listener)
+		return
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	db := string(content)
+
+	if c.tunnels.count() > conf().maxTunnels {
+		c.tunnels.remove(t)
+		writeAudit(c, db, fmt.Sprintf("Refused a tunnel from '%s' on listener %s: too many tunnels", t.addr, t.listener), -1, "")
+		log.Printf("A tunnel of '%s' from '%s' has been refused: too many tunnels.", c.nick, t.addr)
+		return
+	}
+
+	writeAudit(c, db, fmt.Sprintf("Accepted tunnel %s from '%s' on listener %s", t.id, t.addr, t.listener), -1, "")
+	log.Printf("A user '%s' has accepted tunnel %s from '%s'.", c.nick, t.id, t.addr)
+
+	c.tunnelEvent(fmt.Sprintf("Tunnel %s from '%s' has been accepted.", t.id, t.addr),
+		tunnelData{Tunnel: t.id, Event: "accept", Listener: t.listener, From: t.addr})
+	go s.pumpTunnel(c, t)
+}
+
+// pumpTunnel sends what comes from the target of a tunnel to the client.
+func (s *server) pumpTunnel(c *client, t *tunnel) {
+	buf := make([]byte, tunnelChunk)
+	reason := ""
+	for {
+		n, err := t.conn.Read(buf)
+		if n > 0 {
+			c.writeFrame(frame{
+				Type:   "tunnel",
+				Status: statusOK,
+				Data:   tunnelData{Tunnel: t.id, Event: "data", Data: base64.StdEncoding.EncodeToString(buf[:n])},
+			})
+			atomic.AddInt64(&t.out, int64(n))
+		}
+		if err != nil {
+			if !isNetConnClosedErr(err) {
+				reason = err.Error()
+			}
+			break
+		}
+	}
+
+	c.commands <- command{
+		id:     CmdTunnelEnd,
+		client: c,
+		args:   []string{t.id, "target", reason},
+	}
+}
+
+// feedTunnel writes a line "@{id} {base64}" of the client to the target of
+// the tunnel. It is run by readInput, so a slow target holds up the session.
+func (c *client) feedTunnel(line string) {
+	id, payload, _ := strings.Cut(line, " ")
+	t, conn := c.tunnels.connOf(id)
+	if t == nil {
+		return // the tunnel has just been closed
+	}
+
+	if payload == "" {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		c.commands <- command{
+			id:     CmdTunnelEnd,
+			client: c,
+			args:   []string{id, "client", ""},
+		}
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err == nil {
+		if conf().writeTimeout > 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(conf().writeTimeout))
+		}
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		c.commands <- command{
+			id:     CmdTunnelEnd,
+			client: c,
+			args:   []string{id, "client", err.Error()},
+		}
+		return
+	}
+	atomic.AddInt64(&t.in, int64(len(data)))
+}
+
+// tunnelEnd is run when one side of a tunnel has ended its data, or has
+// failed, then the reason is set.
+func (s *server) tunnelEnd(c *client, id string, side string, reason string) {
+	t := c.tunnels.get(id)
+	if t == nil {
+		return
+	}
+
+	if reason != "" {
+		s.endTunnel(c, t, reason)
+		return
+	}
+
+	if side == "target" {
+		c.tunnelEvent("", tunnelData{Tunnel: t.id, Event: "eof"})
+	}
+	if c.tunnels.end(t, side) {
+		s.endTunnel(c, t, "")
+	}
+}
+
+func (s *server) endTunnel(c *client, t *tunnel, reason string) {
+	if !c.tunnels.remove(t) {
+		return
+	}
+
+	msg := fmt.Sprintf("Closed tunnel %s to '%s'", t.id, t.addr)
+	if t.kind == "remote" {
+		msg = fmt.Sprintf("Closed tunnel %s from '%s'", t.id, t.addr)
+	}
+	msg += fmt.Sprintf(": %d bytes in, %d bytes out in %s",
+		atomic.LoadInt64(&t.in), atomic.LoadInt64(&t.out), time.Since(t.opened).Truncate(time.Second))
+	if reason != "" {
+		msg += ", " + reason
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	writeAudit(c, string(content), msg, -1, "")
+	log.Printf("Tunnel %s of '%s' has been closed.", t.id, c.nick)
+
+	c.tunnelEvent(msg+".", tunnelData{Tunnel: t.id, Event: "close", Reason: reason})
+}
+
+func (s *server) endTunnelListener(c *client, id string) bool {
+	l := c.tunnels.removeListener(id)
+	if l == nil {
+		return false
+	}
+
+	content, _ := os.ReadFile(db_path + c.nick + ".json")
+	writeAudit(c, string(content), fmt.Sprintf("Closed tunnel listener %s on '%s'", l.id, l.addr), -1, "")
+	log.Printf("Tunnel listener %s of '%s' has been closed.", l.id, c.nick)
+	return true
+}
+
+func (s *server) closeTunnel(c *client, id string) {
+	if t := c.tunnels.get(id); t != nil {
+		s.endTunnel(c, t, "closed by the client")
+		c.msg(fmt.Sprintf("You have successfully closed tunnel %s.", id))
+		return
+	}
+
+	// The connections a listener has accepted stay open.
+	if s.endTunnelListener(c, id) {
+		c.msg(fmt.Sprintf("You have successfully closed tunnel listener %s.", id))
+		return
+	}
+
+	c.status(statusNotFound)
+	c.msg(fmt.Sprintf("Tunnel '%s' does NOT exists.", id))
+}
+
+// closeTunnels closes all the tunnels of a session that is ending.
+func (s *server) closeTunnels(c *client, reason string) {
+	tunnels, listeners := c.tunnels.ids()
+	for _, id := range listeners {
+		s.endTunnelListener(c, id)
+	}
+	for _, id := range tunnels {
+		if t := c.tunnels.get(id); t != nil {
+			s.endTunnel(c, t, reason)
+		}
+	}
+}
+
+func (s *server) lstunnels(c *client) {
+	tunnels, listeners := c.tunnels.ids()
+
+	lines := []string{}
+	infos := []tunnelInfo{}
+	for _, id := range listeners {
+		l := c.tunnels.getListener(id)
+		if l == nil {
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("%s: listening on '%s' by the rule '%s'", l.id, l.addr, l.rule))
+		infos = append(infos, l.info())
+	}
+	for _, id := range tunnels {
+		t := c.tunnels.get(id)
+		if t == nil {
+			continue
+		}
+
+		where := "to"
+		if t.kind == "remote" {
+			where = "from"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s '%s' by the rule '%s', %d bytes in, %d bytes out",
+			t.id, where, t.addr, t.rule, atomic.LoadInt64(&t.in), atomic.LoadInt64(&t.out)))
+		infos = append(infos, t.info())
+	}
+
+	c.msg(fmt.Sprintf("Tunnels: %d", len(infos)))
+	for _, line := range lines {
+		c.msg(line)
+	}
+	c.setData(infos)
+}
+
+// tunnelEvent sends a frame of type "tunnel" that is NOT of any request.
+func (c *client) tunnelEvent(msg string, data tunnelData) {
+	if c.isConnErr.Load() || !c.structured {
+		return
+	}
+
+	c.writeFrame(frame{Type: "tunnel", Status: statusOK, Message: msg, Data: data})
+}
+
+func (t *tunnel) info() tunnelInfo {
+	return tunnelInfo{
+		ID:       t.id,
+		Kind:     t.kind,
+		Addr:     t.addr,
+		Listener: t.listener,
+		Rule:     t.rule,
+		Opened:   t.opened.Unix(),
+		In:       atomic.LoadInt64(&t.in),
+		Out:      atomic.LoadInt64(&t.out),
+	}
+}
+
+func (l *tunnelListener) info() tunnelInfo {
+	return tunnelInfo{
+		ID:     l.id,
+		Kind:   "listen",
+		Addr:   l.addr,
+		Rule:   l.rule,
+		Opened: l.opened.Unix(),
+	}
+}
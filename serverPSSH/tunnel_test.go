@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// echoServer answers a connection with what it sends, and closes it once
+// the connection has ended its data.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readFrame decodes the next line of w, with its data as a map.
+func readFrame(t *testing.T, w *wire) (frame, map[string]interface{}) {
+	t.Helper()
+	var f frame
+	if err := json.Unmarshal([]byte(w.next()), &f); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := f.Data.(map[string]interface{})
+	return f, data
+}
+
+// readFrameOf sends a line and decodes the reply.
+func readFrameOf(t *testing.T, w *wire, line string) (frame, map[string]interface{}) {
+	t.Helper()
+	_, _ = w.conn.Write([]byte(line + "\n"))
+	return readFrame(t, w)
+}
+
+func TestTunnel(t *testing.T) {
+	h := newHarness(t)
+	rules, err := parseForwarding(`{"lab": {"users": ["root"], "local": ["127.0.0.1:*"]}}`, "config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSettings(t, func(st *settings) { st.forwardRules = rules })
+	addr := echoServer(t)
+
+	h.serve()
+	w := h.dial("10.0.0.1")
+	w.send("proto json")
+	w.send("1 login root " + rootPswd)
+
+	if f, _ := readFrameOf(t, w, "2 tunnel open 10.9.9.9:22"); f.Status != statusForbidden {
+		t.Errorf("NOT allowed: %+v", f)
+	}
+
+	// The tunnel may be open before the response comes.
+	_, _ = w.conn.Write([]byte("3 tunnel open " + addr + "\n"))
+	id := ""
+	for opened := false; id == "" || !opened; {
+		f, data := readFrame(t, w)
+		switch {
+		case f.Type == "response" && f.ID == "3" && f.Status == statusOK:
+			id, _ = data["id"].(string)
+		case f.Type == "tunnel" && data["event"] == "open":
+			opened = true
+		default:
+			t.Fatalf("open: %+v", f)
+		}
+	}
+
+	_, _ = w.conn.Write([]byte("@" + id + " " + base64.StdEncoding.EncodeToString([]byte("hello")) + "\n"))
+	f, data := readFrame(t, w)
+	if text, _ := base64.StdEncoding.DecodeString(data["data"].(string)); f.Type != "tunnel" || data["event"] != "data" || string(text) != "hello" {
+		t.Errorf("data: %+v", f)
+	}
+
+	// Once both sides have ended their data, the tunnel is closed.
+	_, _ = w.conn.Write([]byte("@" + id + "\n"))
+	var events []string
+	for len(events) == 0 || events[len(events)-1] != "close" {
+		f, data := readFrame(t, w)
+		events = append(events, data["event"].(string))
+		if data["event"] == "close" && (data["reason"] != nil || !strings.Contains(f.Message, "5 bytes in, 5 bytes out")) {
+			t.Errorf("close: %+v", f)
+		}
+	}
+	if strings.Join(events, ",") != "eof,close" {
+		t.Errorf("events %q", events)
+	}
+
+	if f, _ := readFrameOf(t, w, "4 tunnel ls"); !strings.Contains(f.Message, "Tunnels: 0") {
+		t.Errorf("ls: %+v", f)
+	}
+}
+
+func TestTunnelNeedsJSON(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1", "root", rootPswd)
+
+	if out := h.do(root, "tunnel open 127.0.0.1:22"); !strings.Contains(out, `Tunnels need the json protocol`) {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestTunnelAcceptOfClosedListener(t *testing.T) {
+	h := newHarness(t)
+	root := h.login("10.0.0.1", "root", rootPswd)
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	tn := &tunnel{kind: "remote", addr: "10.0.0.9:4000", listener: "1", conn: server}
+	root.tunnels.add(tn)
+
+	h.s.tunnelAccept(root, tn.id)
+	if root.tunnels.count() != 0 {
+		t.Error("a tunnel of a closed listener is kept")
+	}
+}